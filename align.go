@@ -39,19 +39,29 @@ type AlignmentKey struct {
 }
 
 type Alignment struct {
-	Key         *AlignmentKey `json:"-"`
-	Id          uint64        `json:"-"`
-	EditStop    int           `json:"edit_stop"`
-	JuncStart   int           `json:"junc_start"`
-	JuncEnd     int           `json:"junc_end"`
-	JuncLen     int           `json:"junc_len"`
-	ReadCount   uint32        `json:"read_count"`
-	Norm        float64       `json:"norm_count"`
-	HasMutation uint8         `json:"has_mutation"`
-	Mismatches  uint8         `json:"mismatches"`
-	Indel       uint8         `json:"indel"`
-	AltEditing  uint8         `json:"alt_editing"`
-	JuncSeq     string        `json:"-"`
+	Key           *AlignmentKey   `json:"-"`
+	Id            uint64          `json:"-"`
+	EditStop      int             `json:"edit_stop"`
+	JuncStart     int             `json:"junc_start"`
+	JuncEnd       int             `json:"junc_end"`
+	JuncLen       int             `json:"junc_len"`
+	ReadCount     uint32          `json:"read_count"`
+	Molecules     uint32          `json:"molecules,omitempty"`
+	Norm          float64         `json:"norm_count"`
+	HasMutation   uint8           `json:"has_mutation"`
+	Mismatches    uint8           `json:"mismatches"`
+	Indel         uint8           `json:"indel"`
+	AltEditing    uint8           `json:"alt_editing"`
+	AltMatch      uint64          `json:"alt_match"`
+	Orientation   OrientationType `json:"orientation"`
+	PrimerMissing uint8           `json:"primer_missing"`
+	Mutations     []*Mutation     `json:"mutations,omitempty"`
+	Chimera       uint8           `json:"chimera"`
+	JuncSeq       string          `json:"-"`
+
+	// Edit base count of the read at each template site. Only set when
+	// aligned with a policy finding chimera parents.
+	sites []uint32
 }
 
 func (k *AlignmentKey) UnmarshalBinary(data []byte) error {
@@ -85,11 +95,10 @@ func (k *AlignmentKey) MarshalBinary() ([]byte, error) {
 		}, ";")), nil
 }
 
-func writeBase(buf *bytes.Buffer, base rune, count, max uint32) {
-	buf.WriteString(strings.Repeat("-", int(max-count)))
-	if count > 0 {
-		buf.WriteString(strings.Repeat(string(base), int(count)))
-	}
+// writeBase writes the edit bases of a site padded with gaps to max
+func writeBase(buf *bytes.Buffer, seq string, max uint32) {
+	buf.WriteString(strings.Repeat("-", int(max)-len(seq)))
+	buf.WriteString(seq)
 }
 
 func (a *Alignment) findJES(b *bitset.BitSet) int {
@@ -119,47 +128,102 @@ func (a *Alignment) findJSS(b *bitset.BitSet) int {
 	}
 }
 
-func (a *Alignment) computeT(frag *Fragment, tmpl *Template, excludeSnps bool) []*bitset.BitSet {
+func (a *Alignment) computeT(frag *Fragment, tmpl *Template, policy *MutationPolicy) []*bitset.BitSet {
 	size := uint(tmpl.Len())
 	T := make([]*bitset.BitSet, tmpl.Size())
 	for i := range T {
 		T[i] = bitset.New(size)
 	}
 
-	aln1, aln2, _ := nwalgo.Align(tmpl.Bases, frag.Bases, 1, -1, -1)
+	aln1, aln2 := tmpl.AlignBases(frag.Bases)
+
+	if policy.ChimeraParents {
+		a.sites = make([]uint32, size)
+		for i := range a.sites {
+			a.sites[i] = anySite
+		}
+	}
+
+	// Sites covered by primers match all templates. Bases of the read
+	// extending past the primers are ignored.
+	mask := tmpl.PrimerMask()
+	from, _ := tmpl.coreSites()
+	site := func(ti int) int {
+		return len(tmpl.Bases) - ti + int(tmpl.EditOffset)
+	}
+	masked := func(ti int) bool {
+		if mask != nil && mask[ti] {
+			for i := range T {
+				T[i] = T[i].Set((size - 1) - uint(ti))
+			}
+			return true
+		}
+		return false
+	}
 
 	fi := 0
 	ti := 0
 	for ai := 0; ai < len(aln1); ai++ {
 		if aln1[ai] == '-' {
 			fi++
-			// insertion
+			if mask != nil && (mask[ti] || ti == from) {
+				continue
+			}
+			// insertion. The edit bases preceding the inserted base are
+			// not counted at any site.
 			a.HasMutation = uint8(1)
 			a.Indel = uint8(1)
+			a.addMutation(site(ti), INSERTION, "", string(aln2[ai]))
+			continue
+		}
+
+		if masked(ti) {
+			if aln2[ai] != '-' {
+				fi++
+			}
+			ti++
 			continue
 		}
 
 		count := uint32(0)
+		seq := ""
 		if aln2[ai] != '-' {
 			count = frag.EditSite[fi]
+			if tmpl.SiteSeq != nil {
+				seq = frag.EditSeq(fi)
+			}
 
-			if frag.Bases[fi] != tmpl.Bases[ti] {
+			if frag.Bases[fi] != tmpl.Bases[ti] && !policy.ignoreMismatch(frag, fi) {
 				// SNP
-				a.Mismatches++
+				if a.Mismatches < 0xff {
+					a.Mismatches++
+				}
+				a.addMutation(site(ti), SUBSTITUTION, string(tmpl.Bases[ti]), string(frag.Bases[fi]))
 
-				//TODO: make the number of mismatches configurable
-				if excludeSnps || a.Mismatches > 2 {
+				if int(a.Mismatches) > policy.MaxMismatches {
 					a.HasMutation = uint8(1)
 				}
 			}
+
+			// Edit sites at the ends of the read may be partial
+			if fi > 0 {
+				if a.sites != nil {
+					a.sites[ti] = count
+				}
+				if policy.editIndelMutant(tmpl, ti, count) {
+					a.HasMutation = uint8(1)
+					a.Indel = uint8(1)
+				}
+			}
 		} else {
 			// deletion
 			a.HasMutation = uint8(1)
 			a.Indel = uint8(1)
+			a.addMutation(site(ti), DELETION, string(tmpl.Bases[ti]), "")
 		}
 
 		for i := range tmpl.EditSite {
-			if tmpl.EditSite[i][ti] == count {
+			if tmpl.siteMatch(i, ti, count, seq) {
 				T[i] = T[i].Set((size - 1) - uint(ti))
 			}
 		}
@@ -171,8 +235,15 @@ func (a *Alignment) computeT(frag *Fragment, tmpl *Template, excludeSnps bool) [
 	}
 
 	// Last edit site
+	if masked(ti) {
+		return T
+	}
+	seq := ""
+	if tmpl.SiteSeq != nil {
+		seq = frag.EditSeq(fi)
+	}
 	for i := range tmpl.EditSite {
-		if tmpl.EditSite[i][ti] == frag.EditSite[fi] {
+		if tmpl.siteMatch(i, ti, frag.EditSite[fi], seq) {
 			T[i] = T[i].Set((size - 1) - uint(ti))
 		}
 	}
@@ -180,64 +251,130 @@ func (a *Alignment) computeT(frag *Fragment, tmpl *Template, excludeSnps bool) [
 	return T
 }
 
+// computeAltEditing checks the junction start against each alt template.
+// Alt regions may overlap so a read can match more than one alt template. All
+// matches are flagged in AltMatch and the alt template which explains the
+// longest stretch of the read is recorded in AltEditing.
 func (a *Alignment) computeAltEditing(tmpl *Template, T []*bitset.BitSet) {
-	// Compute alt editing
-	// See if junc start matches an alt template
-	shift := a.JuncStart
-	alt := 0
-	hasAlt := false
-	for i, v := range T[2:] {
-		if v.Test(uint(shift)) {
-			alt = i
-			hasAlt = true
-			break
+	start := a.JuncStart
+	best := -1
+	bestShift := 0
+
+	for alt, region := range tmpl.AltRegion {
+		if start < region.Start || start >= region.End {
+			continue
+		}
+
+		// Read must match the alt template across the entire region
+		match := true
+		for x := region.Start; x <= start; x++ {
+			if !T[alt+2].Test(uint(x)) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+
+		// Shift Edit Stop Site to first site that doesn't match alt template
+		shift := tmpl.Len()
+		for x := start; x < tmpl.Len(); x++ {
+			if !T[alt+2].Test(uint(x)) {
+				shift = x
+				break
+			}
+		}
+
+		// If we're not after the end of alt editing
+		if shift < region.End {
+			continue
+		}
+
+		a.AltMatch |= 1 << uint(alt)
+		if best == -1 || shift > bestShift {
+			best = alt
+			bestShift = shift
 		}
 	}
 
-	if !hasAlt {
+	if best == -1 {
 		return
 	}
 
-	// If we're not at the start of alt editing return
-	if shift != tmpl.AltRegion[alt].Start {
-		return
+	a.AltEditing = uint8(best + 1)
 
+	// Shift Junc Start to first site that doesn't match FE template
+	if bestShift == tmpl.Len() {
+		a.JuncStart = tmpl.Len() - 1
+	} else {
+		for j := bestShift; j < tmpl.Len(); j++ {
+			if !T[0].Test(uint(j)) {
+				a.JuncStart = j
+				break
+			}
+		}
 	}
+}
 
-	// Shift Edit Stop Site to first site that doesn't match alt template
-	fullMatch := true
-	for x := shift; x < tmpl.Len(); x++ {
-		if T[alt+2].Test(uint(x)) {
-			continue
-		}
+// MoleculeCount returns the number of unique molecules of the read. Reads
+// loaded without UMIs count each read as a molecule.
+func (a *Alignment) MoleculeCount() uint32 {
+	if a.Molecules > 0 {
+		return a.Molecules
+	}
+
+	return a.ReadCount
+}
 
-		fullMatch = false
-		shift = x
-		break
+// HasAlt returns true if the read matched the i-th alt template. Alt
+// templates are numbered from 1.
+func (a *Alignment) HasAlt(i int) bool {
+	if i <= 0 {
+		return false
+	}
+	if int(a.AltEditing) == i {
+		return true
 	}
 
-	if fullMatch || shift >= tmpl.AltRegion[alt].End {
-		// If we're after the end of alt editing
-		// flag which alt tempalte we matched
-		a.AltEditing = uint8(alt + 1)
-		// Shift Junc Start to first site that doesn't match FE template
-		if fullMatch {
-			a.JuncStart = tmpl.Len() - 1
-		} else {
-			for j := shift; j < tmpl.Len(); j++ {
-				if !T[0].Test(uint(j)) {
-					a.JuncStart = j
-					break
-				}
-			}
+	return i <= MAX_ALT_TEMPLATES && a.AltMatch&(1<<uint(i-1)) != 0
+}
+
+// AltMatches returns the alt templates matched by the read numbered from 1
+func (a *Alignment) AltMatches() []int {
+	matches := make([]int, 0)
+	for i := 1; i <= MAX_ALT_TEMPLATES; i++ {
+		if a.HasAlt(i) {
+			matches = append(matches, i)
 		}
 	}
+
+	return matches
 }
 
+// NewAlignment aligns the fragment to the template using the default mutation
+// policy. If excludeSnps is true any mismatch is a mutation.
 func NewAlignment(frag *Fragment, tmpl *Template, excludeSnps bool) *Alignment {
+	policy := DefaultMutationPolicy()
+	if excludeSnps {
+		policy.MaxMismatches = 0
+	}
+
+	return NewAlignmentPolicy(frag, tmpl, policy)
+}
+
+// NewAlignmentPolicy aligns the fragment to the template classifying
+// mutations using the policy. A nil policy uses the default.
+func NewAlignmentPolicy(frag *Fragment, tmpl *Template, policy *MutationPolicy) *Alignment {
+	if policy == nil {
+		policy = DefaultMutationPolicy()
+	}
+
 	a := new(Alignment)
+	a.Orientation = FORWARD
 
-	T := a.computeT(frag, tmpl, excludeSnps)
+	T := a.computeT(frag, tmpl, policy)
+	a.scoreChimera(T, policy)
 
 	a.JuncStart = a.findJSS(T[0])
 	a.computeAltEditing(tmpl, T)
@@ -250,7 +387,7 @@ func NewAlignment(frag *Fragment, tmpl *Template, excludeSnps bool) *Alignment {
 			from := (tmpl.Len() - 1) - a.JuncEnd
 			to := (tmpl.Len() - 1) - a.EditStop
 			for i := from; i < to; i++ {
-				a.JuncSeq += strings.Repeat(string(frag.EditBase), int(frag.EditSite[i]))
+				a.JuncSeq += frag.EditSeq(i)
 				if i < len(frag.Bases) {
 					a.JuncSeq += string(frag.Bases[i])
 				}
@@ -310,6 +447,31 @@ func (a *Alignment) UnmarshalBinary(buf []byte) error {
 
 	a.JuncSeq = string(buf[36 : 36+int(seqLen)])
 
+	// Fields added after the junction sequence are absent in older records
+	ext := buf[36+int(seqLen):]
+	if len(ext) >= 8 {
+		a.AltMatch = binary.BigEndian.Uint64(ext[0:8])
+	}
+
+	// Reads were always loaded in forward orientation before it was recorded
+	a.Orientation = FORWARD
+	if len(ext) >= 9 {
+		a.Orientation = OrientationType(int8(ext[8]))
+	}
+	if len(ext) >= 10 {
+		a.PrimerMissing = ext[9]
+	}
+	if len(ext) > 10 {
+		var rest []byte
+		a.Mutations, rest = unmarshalMutations(ext[10:])
+		if len(rest) > 0 {
+			a.Chimera = rest[0]
+		}
+		if len(rest) >= 5 {
+			a.Molecules = binary.BigEndian.Uint32(rest[1:5])
+		}
+	}
+
 	return nil
 }
 
@@ -331,6 +493,17 @@ func (a *Alignment) MarshalBinary() ([]byte, error) {
 	binary.BigEndian.PutUint32(buf[32:36], uint32(len(seq)))
 	buf = append(buf, seq...)
 
+	ext := make([]byte, 10)
+	binary.BigEndian.PutUint64(ext[0:8], a.AltMatch)
+	ext[8] = byte(a.Orientation)
+	ext[9] = a.PrimerMissing
+	ext = marshalMutations(ext, a.Mutations)
+	ext = append(ext, a.Chimera)
+	n := make([]byte, 4)
+	binary.BigEndian.PutUint32(n, a.Molecules)
+	ext = append(ext, n...)
+	buf = append(buf, ext...)
+
 	return buf, nil
 }
 
@@ -344,17 +517,17 @@ func (a *Alignment) SimpleAlign(f1, f2 *Fragment) (string, string) {
 	ti := 0
 	for ai := 0; ai < n; ai++ {
 		if aln1[ai] == '-' {
-			writeBase(&buf[0], f1.EditBase, 0, f2.EditSite[fi])
+			writeBase(&buf[0], "", f2.EditSite[fi])
 			buf[0].WriteString("-")
 
-			writeBase(&buf[1], f2.EditBase, f2.EditSite[fi], f2.EditSite[fi])
+			writeBase(&buf[1], f2.EditSeq(fi), f2.EditSite[fi])
 			buf[1].WriteString(string(f2.Bases[fi]))
 			fi++
 		} else if aln2[ai] == '-' {
-			writeBase(&buf[0], f1.EditBase, f1.EditSite[ti], f1.EditSite[ti])
+			writeBase(&buf[0], f1.EditSeq(ti), f1.EditSite[ti])
 			buf[0].WriteString(string(f1.Bases[ti]))
 
-			writeBase(&buf[1], '-', 0, f1.EditSite[ti])
+			writeBase(&buf[1], "", f1.EditSite[ti])
 			buf[1].WriteString("-")
 			ti++
 		} else {
@@ -363,10 +536,10 @@ func (a *Alignment) SimpleAlign(f1, f2 *Fragment) (string, string) {
 				max = f2.EditSite[fi]
 			}
 
-			writeBase(&buf[0], f1.EditBase, f1.EditSite[ti], max)
+			writeBase(&buf[0], f1.EditSeq(ti), max)
 			buf[0].WriteString(string(f1.Bases[ti]))
 
-			writeBase(&buf[1], f2.EditBase, f2.EditSite[fi], max)
+			writeBase(&buf[1], f2.EditSeq(fi), max)
 			buf[1].WriteString(string(f2.Bases[fi]))
 			fi++
 			ti++
@@ -379,8 +552,8 @@ func (a *Alignment) SimpleAlign(f1, f2 *Fragment) (string, string) {
 		max = f2.EditSite[fi]
 	}
 
-	writeBase(&buf[0], f1.EditBase, f1.EditSite[ti], max)
-	writeBase(&buf[1], f2.EditBase, f2.EditSite[fi], max)
+	writeBase(&buf[0], f1.EditSeq(ti), max)
+	writeBase(&buf[1], f2.EditSeq(fi), max)
 
 	return buf[0].String(), buf[1].String()
 }
@@ -390,7 +563,7 @@ func (a *Alignment) WriteTo(w io.Writer, frag *Fragment, template *Template, tw
 		tw = 80
 	}
 
-	aln1, aln2, _ := nwalgo.Align(template.Bases, frag.Bases, 1, -1, -1)
+	aln1, aln2 := template.AlignBases(frag.Bases)
 
 	fragCount := template.Size() + 1
 
@@ -402,21 +575,21 @@ func (a *Alignment) WriteTo(w io.Writer, frag *Fragment, template *Template, tw
 	for ai := 0; ai < n; ai++ {
 		if aln1[ai] == '-' {
 			for i := range template.EditSite {
-				writeBase(&buf[i], template.EditBase, 0, frag.EditSite[fi])
+				writeBase(&buf[i], "", frag.EditSite[fi])
 				buf[i].WriteString("-")
 			}
 
-			writeBase(&buf[fragCount-1], frag.EditBase, frag.EditSite[fi], frag.EditSite[fi])
+			writeBase(&buf[fragCount-1], frag.EditSeq(fi), frag.EditSite[fi])
 			buf[fragCount-1].WriteString(string(frag.Bases[fi]))
 			fi++
 		} else if aln2[ai] == '-' {
 			max := template.Max(ti)
 
-			for i, t := range template.EditSite {
-				writeBase(&buf[i], template.EditBase, t[ti], max)
+			for i := range template.EditSite {
+				writeBase(&buf[i], template.EditSeq(i, ti), max)
 				buf[i].WriteString(string(template.Bases[ti]))
 			}
-			writeBase(&buf[fragCount-1], '-', 0, max)
+			writeBase(&buf[fragCount-1], "", max)
 			buf[fragCount-1].WriteString("-")
 			ti++
 		} else {
@@ -425,11 +598,11 @@ func (a *Alignment) WriteTo(w io.Writer, frag *Fragment, template *Template, tw
 				max = frag.EditSite[fi]
 			}
 
-			for i, t := range template.EditSite {
-				writeBase(&buf[i], template.EditBase, t[ti], max)
+			for i := range template.EditSite {
+				writeBase(&buf[i], template.EditSeq(i, ti), max)
 				buf[i].WriteString(string(template.Bases[ti]))
 			}
-			writeBase(&buf[fragCount-1], frag.EditBase, frag.EditSite[fi], max)
+			writeBase(&buf[fragCount-1], frag.EditSeq(fi), max)
 			buf[fragCount-1].WriteString(string(frag.Bases[fi]))
 			fi++
 			ti++
@@ -442,10 +615,10 @@ func (a *Alignment) WriteTo(w io.Writer, frag *Fragment, template *Template, tw
 		max = frag.EditSite[fi]
 	}
 
-	for i, t := range template.EditSite {
-		writeBase(&buf[i], template.EditBase, t[ti], max)
+	for i := range template.EditSite {
+		writeBase(&buf[i], template.EditSeq(i, ti), max)
 	}
-	writeBase(&buf[fragCount-1], frag.EditBase, frag.EditSite[fi], max)
+	writeBase(&buf[fragCount-1], frag.EditSeq(fi), max)
 
 	cols := tw - 4
 	rows := buf[0].Len() / cols
@@ -485,6 +658,18 @@ func (a *Alignment) WriteTo(w io.Writer, frag *Fragment, template *Template, tw
 			return err
 		}
 	}
+	if a.Chimera > 0 {
+		_, err = w.Write([]byte(fmt.Sprintf("Chimera: %d\n", a.Chimera)))
+		if err != nil {
+			return err
+		}
+	}
+	for _, m := range a.Mutations {
+		_, err = w.Write([]byte(fmt.Sprintf("Mutation: %s\n", m)))
+		if err != nil {
+			return err
+		}
+	}
 	_, err = w.Write([]byte(strings.Repeat("=", tw) + "\n\n"))
 	if err != nil {
 		return err
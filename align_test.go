@@ -24,6 +24,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/aebruno/gofasta"
@@ -144,3 +145,248 @@ func BenchmarkBinaryMarshal(b *testing.B) {
 		x.UnmarshalBinary(buf)
 	}
 }
+
+func TestAlignOverlappingAlt(t *testing.T) {
+	full := NewFragment("FE", "AATTCTTGCTTTCTTGTGAATA", FORWARD, 't')
+	pre := NewFragment("PE", "AACTGCCTTTGGTTAATAT", FORWARD, 't')
+	alt1 := NewFragment("A1", "AATTCTTGTTTCTTCTGTTGAATA", FORWARD, 't')
+	alt2 := NewFragment("A2", "AATTCTTGTTTCTTCTGTTGAATA", FORWARD, 't')
+
+	tmpl, err := NewTemplate(full, pre, []*Fragment{alt1, alt2}, []*AltRegion{
+		{Name: "first", Start: 4, End: 7},
+		{Name: "second", Start: 3, End: 7},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	frag := NewFragment("read", "AATTCTTGTTTCTTCTGTTGAATA", FORWARD, 't')
+	aln := NewAlignment(frag, tmpl, false)
+
+	if aln.AltEditing != 1 {
+		t.Errorf("Wrong Alt Editing. %d != %d", aln.AltEditing, 1)
+	}
+	if !aln.HasAlt(1) || !aln.HasAlt(2) || aln.HasAlt(3) {
+		t.Errorf("Read should match both overlapping alt templates: %v", aln.AltMatches())
+	}
+
+	data, err := aln.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	other := new(Alignment)
+	err = other.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if other.AltMatch != aln.AltMatch || other.JuncSeq != aln.JuncSeq {
+		t.Errorf("Alt matches not preserved. %d != %d", other.AltMatch, aln.AltMatch)
+	}
+
+	if tmpl.AltIndex("second") != 2 || tmpl.AltIndex("A1") != 1 || tmpl.AltName(2) != "second" {
+		t.Errorf("Wrong alt template names")
+	}
+}
+
+func TestAlignMultiBase(t *testing.T) {
+	full := NewFragmentBases("FE", "AATCTAGTTCCAGA", FORWARD, "TC")
+	pre := NewFragmentBases("PE", "AACTTAGCTAGA", FORWARD, "TC")
+
+	tmpl, err := NewTemplate(full, pre, nil, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tmpl.String() != "AATCTAGTTCCAGA" || tmpl.EditBaseSet() != "TC" {
+		t.Errorf("Wrong template %s", tmpl.String())
+	}
+
+	// Edit sites must match in both count and order of the edit bases. The
+	// third read is fully edited 3' of the site where TCT was edited from CTT
+	tests := map[string]int{
+		"AATCTAGTTCCAGA": tmpl.Len() - 1,
+		"AACTTAGCTAGA":   tmpl.EditStop,
+		"AACTTAGTTCCAGA": 4,
+	}
+
+	for seq, ess := range tests {
+		frag := NewFragmentBases("read", seq, FORWARD, "TC")
+		aln := NewAlignment(frag, tmpl, false)
+		if int(aln.EditStop) != ess {
+			t.Errorf("Wrong ESS. %d != %d for sequence: %s", int(aln.EditStop), ess, seq)
+		}
+		if aln.HasMutation != 0 {
+			t.Errorf("Sequence should not be mutant: %s", seq)
+		}
+	}
+}
+
+func TestAlignOrientation(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	seq := tmpl.String()[10:80]
+	for _, o := range []OrientationType{FORWARD, REVERSE} {
+		read := seq
+		if o == REVERSE {
+			read = ReverseComplement(seq)
+		}
+
+		frag, orientation := NewFragmentOriented("read", read, AUTO, "T", tmpl)
+		if orientation != o {
+			t.Errorf("Wrong orientation. %s != %s", orientation, o)
+		}
+		if frag.String() != seq {
+			t.Errorf("%s != %s", frag.String(), seq)
+		}
+
+		aln := NewAlignment(frag, tmpl, false)
+		aln.Orientation = orientation
+		data, err := aln.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		other := new(Alignment)
+		err = other.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if other.Orientation != o {
+			t.Errorf("Orientation not preserved. %s != %s", other.Orientation, o)
+		}
+	}
+
+	if o, err := ParseOrientation("auto"); err != nil || o != AUTO {
+		t.Errorf("Failed to parse orientation auto")
+	}
+}
+
+func TestAlignOrientationConcurrent(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	read := ReverseComplement(tmpl.String()[10:80])
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, orientation := NewFragmentOriented("read", read, AUTO, "T", tmpl)
+			if orientation != REVERSE {
+				t.Errorf("Wrong orientation. %s != %s", orientation, REVERSE)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMutationPolicy(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fe := tmpl.String()
+	mismatch := func(seq string, i int, base byte) string {
+		return seq[:i] + string(base) + seq[i+1:]
+	}
+	// Position of the non-edit base at index i
+	pos := func(i int) int {
+		n := -1
+		for j := 0; j < len(fe); j++ {
+			if fe[j] != 'T' {
+				n++
+			}
+			if n == i {
+				return j
+			}
+		}
+		return -1
+	}
+
+	mid := pos(len(tmpl.Bases) / 2)
+	base := byte('A')
+	if fe[mid] == 'A' {
+		base = 'G'
+	}
+
+	tests := []struct {
+		name   string
+		seq    string
+		policy *MutationPolicy
+		mutant bool
+	}{
+		{"default", mismatch(fe, mid, base), nil, false},
+		{"max 0", mismatch(fe, mid, base), &MutationPolicy{MaxMismatches: 0}, true},
+		{"ignore n", mismatch(fe, mid, 'N'), &MutationPolicy{MaxMismatches: 0, IgnoreN: true}, false},
+		{"ignore ends", mismatch(fe, pos(1), base), &MutationPolicy{MaxMismatches: 0, IgnoreEnds: 2}, false},
+		{"edit indel", fe[:mid] + "TTTTTTTTTT" + fe[mid:], DefaultMutationPolicy(), false},
+		{"edit indel mutant", fe[:mid] + "TTTTTTTTTT" + fe[mid:], &MutationPolicy{MaxMismatches: 2, EditIndelMutant: true}, true},
+	}
+
+	for _, test := range tests {
+		frag := NewFragment(test.name, test.seq, FORWARD, 't')
+		aln := NewAlignmentPolicy(frag, tmpl, test.policy)
+		if (aln.HasMutation == 1) != test.mutant {
+			t.Errorf("%s: expected mutant %t got %d", test.name, test.mutant, aln.HasMutation)
+		}
+	}
+
+	if aln := NewAlignmentPolicy(NewFragment("fe", fe, FORWARD, 't'), tmpl, &MutationPolicy{}); aln.HasMutation != 0 {
+		t.Errorf("Fully edited read should not be a mutant with a strict policy")
+	}
+}
+
+func TestAlignMutations(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fe := tmpl.String()
+	tests := []struct {
+		name string
+		seq  string
+		want []*Mutation
+	}{
+		{"sub", strings.Replace(fe, "GCGTATGTGAT", "GCGTATCTGAT", 1), []*Mutation{{Site: 133, Type: SUBSTITUTION, Ref: "G", Alt: "C"}}},
+		{"del", strings.Replace(fe, "GCGTATGTGAT", "GCGTATTGAT", 1), []*Mutation{{Site: 132, Type: DELETION, Ref: "G"}}},
+		{"ins", strings.Replace(fe, "CCGC", "CCAAGC", 1), []*Mutation{{Site: 108, Type: INSERTION, Alt: "AA"}}},
+	}
+
+	for _, test := range tests {
+		aln := NewAlignment(NewFragment(test.name, test.seq, FORWARD, 't'), tmpl, false)
+		if len(aln.Mutations) != len(test.want) {
+			t.Errorf("%s: wrong number of mutations %d != %d", test.name, len(aln.Mutations), len(test.want))
+			continue
+		}
+		for i, m := range aln.Mutations {
+			if *m != *test.want[i] {
+				t.Errorf("%s: %s != %s", test.name, m, test.want[i])
+			}
+			if !aln.HasMutationAt(m.Site) {
+				t.Errorf("%s: mutation not found at site %d", test.name, m.Site)
+			}
+		}
+
+		data, err := aln.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		other := new(Alignment)
+		err = other.UnmarshalBinary(data)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if len(other.Mutations) != len(aln.Mutations) || *other.Mutations[0] != *aln.Mutations[0] {
+			t.Errorf("%s: mutations not preserved", test.name)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/willf/bitset"
+)
+
+// anySite marks an edit site of a read which matches any edit base count.
+// Sites at the ends of the read may be partial and sites covered by primers
+// are not compared.
+const anySite = ^uint32(0)
+
+// chimeraSwitches returns the number of switches between runs of sites
+// matching only the fully edited and only the pre-edited template beyond the
+// single switch from fully edited to pre-edited expected at the junction.
+// Sites matching both, neither or an alt template are ignored, as are runs
+// shorter than MIN_SWITCH_RUN.
+func chimeraSwitches(T []*bitset.BitSet) int {
+	last := 0
+	first := 0
+	switches := 0
+	state, run := 0, 0
+	for i := uint(0); i <= T[0].Len(); i++ {
+		next := 0
+		if i < T[0].Len() {
+			fe, pe := T[0].Test(i), T[1].Test(i)
+			if fe == pe {
+				continue
+			}
+
+			next = 1
+			if pe {
+				alt := false
+				for _, b := range T[2:] {
+					alt = alt || b.Test(i)
+				}
+				if alt {
+					continue
+				}
+				next = 2
+			}
+
+			if next == state {
+				run++
+				continue
+			}
+		}
+
+		// End of a run of sites matching one template
+		if run >= MIN_SWITCH_RUN {
+			if first == 0 {
+				first = state
+			} else if state != last {
+				switches++
+			}
+			last = state
+		}
+		state, run = next, 1
+	}
+
+	// Reads match the fully edited template from the 3' end up to the
+	// junction
+	if first == 1 && switches > 0 {
+		switches--
+	}
+
+	return switches
+}
+
+// scoreChimera sets the chimera score of the alignment to the number of
+// switches beyond the maximum allowed by the policy
+func (a *Alignment) scoreChimera(T []*bitset.BitSet, policy *MutationPolicy) {
+	switches := chimeraSwitches(T) - policy.MaxSwitches
+	if switches <= 0 {
+		return
+	}
+	if switches > 0xfe {
+		switches = 0xfe
+	}
+
+	a.Chimera = uint8(switches)
+}
+
+// IsChimera returns true if the read is likely a PCR chimera
+func (a *Alignment) IsChimera() bool {
+	return a.Chimera > 0
+}
+
+type chimeraProfile struct {
+	sites []uint32
+	count uint64
+	ids   []uint64
+}
+
+// ChimeraDetector finds reads of a sample which are a recombination of two
+// more abundant parent reads. Reads are compared by the edit base count at
+// each site of the template. Mutant reads are ignored.
+type ChimeraDetector struct {
+	skew     float64
+	profiles map[string]*chimeraProfile
+}
+
+func NewChimeraDetector(policy *MutationPolicy) *ChimeraDetector {
+	return &ChimeraDetector{skew: policy.ChimeraSkew, profiles: make(map[string]*chimeraProfile)}
+}
+
+// Add records the alignment of the read with the given id. Only alignments
+// computed for the fragment with a policy finding chimera parents can be
+// added as the edit site counts are not stored. The edit site counts of the
+// alignment are released.
+func (d *ChimeraDetector) Add(id uint64, a *Alignment) {
+	if a.HasMutation != 0 || a.sites == nil {
+		return
+	}
+
+	buf := make([]byte, 4*len(a.sites))
+	for i, n := range a.sites {
+		binary.BigEndian.PutUint32(buf[4*i:], n)
+	}
+
+	key := string(buf)
+	p, ok := d.profiles[key]
+	if !ok {
+		p = &chimeraProfile{sites: a.sites}
+		d.profiles[key] = p
+	}
+	p.count += uint64(a.ReadCount)
+	p.ids = append(p.ids, id)
+	a.sites = nil
+}
+
+// matchSites returns the number of sites of the read matching the parent from
+// the 5' end and from the 3' end
+func matchSites(read, parent []uint32) (int, int) {
+	n := len(read)
+	left := 0
+	for left < n && (read[left] == parent[left] || read[left] == anySite || parent[left] == anySite) {
+		left++
+	}
+	right := 0
+	for right < n && (read[n-1-right] == parent[n-1-right] || read[n-1-right] == anySite || parent[n-1-right] == anySite) {
+		right++
+	}
+
+	return left, right
+}
+
+// Chimeras returns the ids of the reads explained by the 5' end of one parent
+// and the 3' end of another. Parents are among the MAX_CHIMERA_PARENTS most
+// abundant reads with at least skew times the read count of the chimera. The
+// recorded reads are released.
+func (d *ChimeraDetector) Chimeras() []uint64 {
+	profiles := make([]*chimeraProfile, 0, len(d.profiles))
+	for _, p := range d.profiles {
+		profiles = append(profiles, p)
+	}
+	d.profiles = make(map[string]*chimeraProfile)
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].count > profiles[j].count
+	})
+
+	parents := profiles
+	if len(parents) > MAX_CHIMERA_PARENTS {
+		parents = parents[:MAX_CHIMERA_PARENTS]
+	}
+
+	ids := make([]uint64, 0)
+	for _, p := range profiles {
+		maxLeft, maxRight := 0, 0
+		n := len(p.sites)
+		for _, parent := range parents {
+			if float64(parent.count) < d.skew*float64(p.count) {
+				break
+			}
+			if parent == p {
+				continue
+			}
+
+			left, right := matchSites(p.sites, parent.sites)
+			if left == n {
+				// Read is a less abundant copy of the parent
+				maxLeft = 0
+				break
+			}
+			if left > maxLeft {
+				maxLeft = left
+			}
+			if right > maxRight {
+				maxRight = right
+			}
+		}
+
+		if maxLeft > 0 && maxRight > 0 && maxLeft+maxRight >= n {
+			ids = append(ids, p.ids...)
+		}
+	}
+
+	return ids
+}
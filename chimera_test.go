@@ -0,0 +1,127 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChimera(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	// build returns a read with the edit bases at each site from the
+	// template selected by pick
+	build := func(pick func(ti int) int) string {
+		var buf bytes.Buffer
+		for i := range tmpl.EditSite[0] {
+			buf.WriteString(tmpl.EditSeq(pick(i), i))
+			if i < len(tmpl.Bases) {
+				buf.WriteByte(tmpl.Bases[i])
+			}
+		}
+		return buf.String()
+	}
+
+	diff := make([]int, 0)
+	for i := range tmpl.EditSite[0] {
+		if tmpl.EditSite[0][i] != tmpl.EditSite[1][i] {
+			diff = append(diff, i)
+		}
+	}
+	if len(diff) < 20 {
+		t.Fatalf("Too few differing edit sites in template: %d", len(diff))
+	}
+
+	fe := build(func(ti int) int { return 0 })
+	pe := build(func(ti int) int { return 1 })
+	junc := build(func(ti int) int {
+		if ti < diff[len(diff)/2] {
+			return 1
+		}
+		return 0
+	})
+	flip := build(func(ti int) int {
+		for j, d := range diff[:16] {
+			if d == ti {
+				return (j / 4) % 2
+			}
+		}
+		return 0
+	})
+
+	policy := DefaultMutationPolicy()
+	aln := NewAlignmentPolicy(NewFragment("junc-5", junc, FORWARD, 't'), tmpl, policy)
+	if aln.IsChimera() {
+		t.Errorf("Read with a single junction flagged as chimera: %d", aln.Chimera)
+	}
+
+	aln = NewAlignmentPolicy(NewFragment("flip-3", flip, FORWARD, 't'), tmpl, policy)
+	if !aln.IsChimera() || aln.HasMutation != 0 {
+		t.Errorf("Read switching between templates not flagged as chimera: %d", aln.Chimera)
+	}
+
+	data, err := aln.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	dec := new(Alignment)
+	if err := dec.UnmarshalBinary(data); err != nil || dec.Chimera != aln.Chimera {
+		t.Errorf("Chimera score not decoded: %d != %d", dec.Chimera, aln.Chimera)
+	}
+
+	policy.MaxSwitches = 0xff
+	aln = NewAlignmentPolicy(NewFragment("flip-3", flip, FORWARD, 't'), tmpl, policy)
+	if aln.IsChimera() {
+		t.Errorf("Read flagged as chimera within max switches: %d", aln.Chimera)
+	}
+
+	policy.ChimeraParents = true
+	detector := NewChimeraDetector(policy)
+	reads := []struct {
+		name string
+		seq  string
+	}{
+		{"1-100", fe},
+		{"2-80", pe},
+		{"3-10", junc},
+		{"4-10", fe},
+		{"5-60", junc},
+	}
+	for i, r := range reads[:3] {
+		detector.Add(uint64(i+1), NewAlignmentPolicy(NewFragment(r.name, r.seq, FORWARD, 't'), tmpl, policy))
+	}
+	detector.Add(4, NewAlignmentPolicy(NewFragment(reads[3].name, reads[3].seq, FORWARD, 't'), tmpl, policy))
+
+	ids := detector.Chimeras()
+	if len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("Wrong chimeras found: %v", ids)
+	}
+
+	// Parents must be more abundant than the chimera
+	detector = NewChimeraDetector(policy)
+	for i, r := range []int{0, 1, 4} {
+		detector.Add(uint64(i+1), NewAlignmentPolicy(NewFragment(reads[r].name, reads[r].seq, FORWARD, 't'), tmpl, policy))
+	}
+	if ids := detector.Chimeras(); len(ids) != 0 {
+		t.Errorf("Abundant read flagged as chimera: %v", ids)
+	}
+}
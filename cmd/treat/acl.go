@@ -0,0 +1,133 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	PERM_NONE = iota
+	PERM_READ
+	PERM_UPLOAD
+)
+
+const ACL_ALL_DBS = "*"
+
+type aclRule struct {
+	principal string
+	perm      int
+}
+
+// ACL maps database names to the users and groups allowed to access them.
+// ACL files contain one rule per line in the format:
+//
+//	[db name|*]  [read|upload]  [user|@group] ...
+//
+// For example:
+//
+//	# Read Lab databases
+//	rps12-kd.db  read    @readlab carol
+//	rps12-kd.db  upload  alice
+//	*            upload  @admin
+//
+// Users not matching any rule have no access. The upload permission implies
+// read.
+type ACL struct {
+	rules map[string][]*aclRule
+}
+
+func parsePerm(val string) (int, error) {
+	switch strings.ToLower(val) {
+	case "read":
+		return PERM_READ, nil
+	case "upload":
+		return PERM_UPLOAD, nil
+	}
+
+	return PERM_NONE, fmt.Errorf("Invalid permission: %s", val)
+}
+
+func NewACLFromFile(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open acl file: %s", err)
+	}
+	defer f.Close()
+
+	acl := &ACL{rules: make(map[string][]*aclRule)}
+
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("Invalid acl rule on line %d: %s", lineNum, line)
+		}
+
+		perm, err := parsePerm(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid acl rule on line %d: %s", lineNum, err)
+		}
+
+		for _, p := range fields[2:] {
+			acl.rules[fields[0]] = append(acl.rules[fields[0]], &aclRule{principal: p, perm: perm})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+func (r *aclRule) matches(user *User) bool {
+	if strings.HasPrefix(r.principal, "@") {
+		return user.HasGroup(r.principal[1:])
+	}
+
+	return r.principal == user.Name
+}
+
+// Permission returns the highest permission the user has on the database
+func (acl *ACL) Permission(user *User, dbname string) int {
+	if user == nil {
+		return PERM_NONE
+	}
+
+	perm := PERM_NONE
+	for _, name := range []string{dbname, ACL_ALL_DBS} {
+		for _, r := range acl.rules[name] {
+			if r.perm > perm && r.matches(user) {
+				perm = r.perm
+			}
+		}
+	}
+
+	return perm
+}
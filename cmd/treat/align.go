@@ -20,6 +20,7 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/Sirupsen/logrus"
@@ -28,12 +29,20 @@ import (
 )
 
 type AlignOptions struct {
-	TemplatePath string
-	FragmentPath string
-	EditBase     string
-	S1           string
-	S2           string
-	EditOffset   int
+	TemplatePath   string
+	FragmentPath   string
+	EditBase       string
+	S1             string
+	S2             string
+	EditOffset     int
+	Orientation    string
+	Primer5        string
+	Primer3        string
+	PrimerMismatch int
+	CountFormat    string
+	CountPattern   string
+	Policy         *treat.MutationPolicy
+	Pairs          PairOptions
 }
 
 func PrintAlignment(a1, a2 string, tw int) {
@@ -57,33 +66,74 @@ func PrintAlignment(a1, a2 string, tw int) {
 }
 
 func Align(options *AlignOptions) {
-	if len(options.EditBase) != 1 {
-		logrus.Fatal("Please provide the edit base")
+	bases, err := treat.ParseEditBases(options.EditBase)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	options.EditBase = bases
+
+	orientation, err := treat.ParseOrientation(options.Orientation)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	counts, err := treat.NewCountParser(options.CountFormat, options.CountPattern)
+	if err != nil {
+		logrus.Fatal(err)
 	}
 
 	if (len(options.S1) > 0 && len(options.S2) == 0) || (len(options.S1) == 0 && len(options.S2) > 0) {
 		logrus.Fatal("Please provide 2 fragments to align")
 	}
 	if len(options.S1) > 0 && len(options.S2) > 0 {
-		frag1 := treat.NewFragment("1-1", options.S1, treat.FORWARD, rune(options.EditBase[0]))
-		frag2 := treat.NewFragment("2-1", options.S2, treat.FORWARD, rune(options.EditBase[0]))
+		if orientation == treat.AUTO {
+			logrus.Fatal("Auto orientation requires a template")
+		}
+		frag1 := treat.NewFragmentBases("1-1", options.S1, treat.FORWARD, options.EditBase)
+		frag2 := treat.NewFragmentBases("2-1", options.S2, orientation, options.EditBase)
 		aln := new(treat.Alignment)
 		a1, a2 := aln.SimpleAlign(frag1, frag2)
 		PrintAlignment(a1, a2, 80)
 		return
-	} else if len(options.FragmentPath) == 0 {
-		logrus.Fatal("Please provide either 2 sequences to align or a path to fragment FASTA file")
+	} else if len(options.FragmentPath) == 0 && !options.Pairs.IsPaired() {
+		logrus.Fatal("Please provide either 2 sequences to align, a path to fragment FASTA file or R1/R2 FASTQ files")
 	}
 
 	var tmpl *treat.Template
 
 	if len(options.TemplatePath) > 0 {
-		t, err := treat.NewTemplateFromFasta(options.TemplatePath, treat.FORWARD, rune(options.EditBase[0]))
+		t, err := treat.NewTemplateFromFastaBases(options.TemplatePath, treat.FORWARD, options.EditBase)
 		if err != nil {
 			logrus.Fatal(err)
 		}
 		tmpl = t
-		tmpl.SetOffset(options.EditOffset)
+		if options.EditOffset > 0 {
+			tmpl.SetOffset(options.EditOffset)
+		}
+		options.EditBase = tmpl.EditBaseSet()
+
+		err = setPrimers(tmpl, options.Primer5, options.Primer3)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if options.Pairs.IsPaired() {
+		if tmpl == nil {
+			logrus.Fatal("Please provide a template to align paired-end reads")
+		}
+
+		buf := bufio.NewWriter(os.Stdout)
+		stats, err := mergePairs(&options.Pairs, func(rec *gofasta.SeqRecord) error {
+			return writeAlignment(buf, rec, orientation, options, tmpl, counts)
+		})
+		buf.Flush()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		logrus.Printf("Merged paired-end reads: %s", stats)
+		return
 	}
 
 	f, err := os.Open(options.FragmentPath)
@@ -93,9 +143,17 @@ func Align(options *AlignOptions) {
 	defer f.Close()
 
 	if tmpl == nil {
+		if orientation == treat.AUTO {
+			logrus.Fatal("Auto orientation requires a template")
+		}
+
 		frags := make([]*treat.Fragment, 0)
 		for rec := range gofasta.SimpleParser(f) {
-			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, rune(options.EditBase[0]))
+			o := treat.FORWARD
+			if len(frags) > 0 {
+				o = orientation
+			}
+			frag := treat.NewFragmentBases(rec.Id, rec.Seq, o, options.EditBase)
 			frags = append(frags, frag)
 			if len(frags) >= 2 {
 				break
@@ -112,11 +170,38 @@ func Align(options *AlignOptions) {
 
 	} else {
 		for rec := range gofasta.SimpleParser(f) {
-			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, rune(options.EditBase[0]))
-			aln := treat.NewAlignment(frag, tmpl, false)
 			buf := bufio.NewWriter(os.Stdout)
-			aln.WriteTo(buf, frag, tmpl, 80)
-			buf.Flush()
+			err := writeAlignment(buf, rec, orientation, options, tmpl, counts)
+			if err == nil {
+				err = buf.Flush()
+			}
+			if err != nil {
+				logrus.Fatal(err)
+			}
 		}
 	}
 }
+
+// writeAlignment aligns the record to the template and writes the alignment.
+// Records aligned as reverse complement or lacking primers are noted.
+func writeAlignment(w io.Writer, rec *gofasta.SeqRecord, orientation treat.OrientationType, options *AlignOptions, tmpl *treat.Template, counts treat.CountParser) error {
+	frag, o := treat.NewFragmentOriented(rec.Id, rec.Seq, orientation, options.EditBase, tmpl)
+	frag.ReadCount = parseReadCount(counts, rec.Id)
+	if o == treat.REVERSE {
+		fmt.Fprintf(w, "%s: reverse complement\n", rec.Id)
+	}
+
+	if tmpl.HasPrimers() {
+		var missing uint8
+		frag, missing = tmpl.TrimPrimers(frag, options.PrimerMismatch)
+		if missing&treat.PRIMER5_MISSING != 0 {
+			fmt.Fprintf(w, "%s: 5' primer not found\n", rec.Id)
+		}
+		if missing&treat.PRIMER3_MISSING != 0 {
+			fmt.Fprintf(w, "%s: 3' primer not found\n", rec.Id)
+		}
+	}
+
+	aln := treat.NewAlignmentPolicy(frag, tmpl, options.Policy)
+	return aln.WriteTo(w, frag, tmpl, 80)
+}
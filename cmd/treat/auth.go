@@ -0,0 +1,584 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	AUTH_NONE     = "none"
+	AUTH_LOCAL    = "local"
+	AUTH_HTPASSWD = "htpasswd"
+	AUTH_PROXY    = "proxy"
+	BUCKET_USERS  = "users"
+)
+
+var (
+	ErrInvalidLogin = errors.New("Invalid username or password")
+	ErrUserNotFound = errors.New("User not found")
+)
+
+type User struct {
+	Name   string   `json:"name"`
+	Hash   string   `json:"hash,omitempty"`
+	Groups []string `json:"groups"`
+}
+
+type AuthOptions struct {
+	Mode         string `toml:"mode"`
+	UsersPath    string `toml:"users"`
+	HtpasswdPath string `toml:"htpasswd"`
+	HtgroupPath  string `toml:"htgroup"`
+	Header       string `toml:"header"`
+	GroupsHeader string `toml:"groups_header"`
+	// Addresses or CIDR ranges of reverse proxies allowed to set the user
+	// headers. Required in proxy mode, the server config defaults to loopback
+	// only.
+	TrustedProxies []string `toml:"trusted_proxies"`
+}
+
+// Authenticator verifies user credentials for the TREAT server
+type Authenticator interface {
+	// Authenticate checks the username and password and returns the user
+	Authenticate(username, password string) (*User, error)
+
+	// Lookup returns the user with the given username
+	Lookup(username string) (*User, error)
+}
+
+// PasswordAuth authenticates users against a set of bcrypt password hashes
+type PasswordAuth struct {
+	users map[string]*User
+}
+
+// UserStore is a local users database
+type UserStore struct {
+	db *bolt.DB
+}
+
+// ProxyAuth trusts the username set in a request header by a reverse proxy.
+// Groups are optionally read from a comma separated list in GroupsHeader. The
+// headers are only honoured on requests from one of the trusted proxies.
+type ProxyAuth struct {
+	Header       string
+	GroupsHeader string
+	trusted      []*net.IPNet
+}
+
+type UsersByName []*User
+
+func (s UsersByName) Len() int           { return len(s) }
+func (s UsersByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s UsersByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+func NewAuthenticator(options *AuthOptions) (Authenticator, error) {
+	switch options.Mode {
+	case "", AUTH_NONE:
+		return nil, nil
+	case AUTH_LOCAL:
+		return NewLocalAuth(options.UsersPath)
+	case AUTH_HTPASSWD:
+		return NewHtpasswdAuth(options.HtpasswdPath, options.HtgroupPath)
+	case AUTH_PROXY:
+		return NewProxyAuth(options)
+	}
+
+	return nil, fmt.Errorf("Invalid auth mode: %s", options.Mode)
+}
+
+func (u *User) HasGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewUserStore(path string, readOnly bool) (*UserStore, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Please provide path to users database")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open users database %s - %s", path, err)
+	}
+
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte(BUCKET_USERS))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &UserStore{db: db}, nil
+}
+
+func (us *UserStore) Close() error {
+	return us.db.Close()
+}
+
+func (us *UserStore) GetUser(username string) (*User, error) {
+	var user *User
+	err := us.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_USERS))
+		if b == nil {
+			return fmt.Errorf("database error. users bucket does not exist!")
+		}
+
+		v := b.Get([]byte(username))
+		if v == nil {
+			return ErrUserNotFound
+		}
+
+		u := new(User)
+		err := json.Unmarshal(v, u)
+		if err != nil {
+			return err
+		}
+
+		user = u
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (us *UserStore) PutUser(user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return us.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_USERS))
+		if b == nil {
+			return fmt.Errorf("database error. users bucket does not exist!")
+		}
+
+		return b.Put([]byte(user.Name), data)
+	})
+}
+
+func (us *UserStore) DeleteUser(username string) error {
+	return us.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_USERS))
+		if b == nil {
+			return fmt.Errorf("database error. users bucket does not exist!")
+		}
+
+		if b.Get([]byte(username)) == nil {
+			return ErrUserNotFound
+		}
+
+		return b.Delete([]byte(username))
+	})
+}
+
+func (us *UserStore) Users() ([]*User, error) {
+	users := make([]*User, 0)
+	err := us.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_USERS))
+		if b == nil {
+			return fmt.Errorf("database error. users bucket does not exist!")
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			u := new(User)
+			err := json.Unmarshal(v, u)
+			if err != nil {
+				return err
+			}
+
+			users = append(users, u)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// NewLocalAuth loads all users from the local users database. The database is
+// only read at startup so the server must be restarted to pick up users added
+// or removed with treat user.
+func NewLocalAuth(path string) (*PasswordAuth, error) {
+	store, err := NewUserStore(path, true)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	users, err := store.Users()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PasswordAuth{users: make(map[string]*User)}
+	for _, u := range users {
+		p.users[u.Name] = u
+	}
+
+	return p, nil
+}
+
+// NewHtpasswdAuth loads users from an Apache htpasswd file. Only bcrypt hashes
+// are supported (htpasswd -B). Group membership is optionally loaded from an
+// Apache htgroup file.
+func NewHtpasswdAuth(path, groupPath string) (*PasswordAuth, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Please provide path to htpasswd file")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open htpasswd file: %s", err)
+	}
+	defer f.Close()
+
+	h := &PasswordAuth{users: make(map[string]*User)}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			logrus.WithFields(logrus.Fields{
+				"path": path,
+			}).Warn("Skipping invalid line in htpasswd file")
+			continue
+		}
+
+		if !strings.HasPrefix(parts[1], "$2") {
+			logrus.WithFields(logrus.Fields{
+				"user": parts[0],
+			}).Warn("Skipping htpasswd user with unsupported hash. Only bcrypt is supported")
+			continue
+		}
+
+		h.users[parts[0]] = &User{Name: parts[0], Hash: parts[1]}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(groupPath) > 0 {
+		err = h.loadHtgroup(groupPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// loadHtgroup parses an Apache htgroup file in the format:
+//
+//	group: user1 user2
+func (p *PasswordAuth) loadHtgroup(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open htgroup file: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			logrus.WithFields(logrus.Fields{
+				"path": path,
+			}).Warn("Skipping invalid line in htgroup file")
+			continue
+		}
+
+		group := strings.TrimSpace(parts[0])
+		for _, name := range strings.Fields(parts[1]) {
+			if user, ok := p.users[name]; ok {
+				user.Groups = append(user.Groups, group)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (p *PasswordAuth) Lookup(username string) (*User, error) {
+	user, ok := p.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+func (p *PasswordAuth) Authenticate(username, password string) (*User, error) {
+	user, err := p.Lookup(username)
+	if err != nil {
+		return nil, ErrInvalidLogin
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(user.Hash), []byte(password))
+	if err != nil {
+		return nil, ErrInvalidLogin
+	}
+
+	return user, nil
+}
+
+// NewProxyAuth returns a ProxyAuth trusting the user headers only from the
+// configured reverse proxy addresses
+func NewProxyAuth(options *AuthOptions) (*ProxyAuth, error) {
+	if len(options.Header) == 0 {
+		return nil, fmt.Errorf("Please provide the name of the reverse proxy user header")
+	}
+	if len(options.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("Please provide the addresses of the trusted reverse proxies")
+	}
+
+	p := &ProxyAuth{Header: options.Header, GroupsHeader: options.GroupsHeader}
+	for _, addr := range options.TrustedProxies {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy address: %s", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy address: %s", addr)
+		}
+		p.trusted = append(p.trusted, ipnet)
+	}
+
+	return p, nil
+}
+
+// Trusted returns true if the request was sent by a trusted reverse proxy
+func (p *ProxyAuth) Trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range p.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *ProxyAuth) Lookup(username string) (*User, error) {
+	if len(username) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	return &User{Name: username}, nil
+}
+
+func (p *ProxyAuth) Authenticate(username, password string) (*User, error) {
+	return nil, fmt.Errorf("Login is handled by the reverse proxy")
+}
+
+// UserFromRequest returns the user set in the request headers by the reverse
+// proxy. Requests not sent by a trusted proxy are unauthenticated.
+func (p *ProxyAuth) UserFromRequest(r *http.Request) *User {
+	if !p.Trusted(r) {
+		logrus.WithFields(logrus.Fields{
+			"remote": r.RemoteAddr,
+		}).Warn("Ignoring user header from untrusted address")
+		return nil
+	}
+
+	user, err := p.Lookup(r.Header.Get(p.Header))
+	if err != nil {
+		return nil
+	}
+
+	if len(p.GroupsHeader) > 0 {
+		for _, g := range strings.Split(r.Header.Get(p.GroupsHeader), ",") {
+			g = strings.TrimSpace(g)
+			if len(g) > 0 {
+				user.Groups = append(user.Groups, g)
+			}
+		}
+	}
+
+	return user
+}
+
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	// Allow password to be piped in for scripting
+	if !terminal.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return "", fmt.Errorf("Failed to read password: %s", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Print("Password: ")
+	pass, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Print("Confirm password: ")
+	confirm, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+
+	if string(pass) != string(confirm) {
+		return "", fmt.Errorf("Passwords do not match")
+	}
+
+	if len(pass) == 0 {
+		return "", fmt.Errorf("Password can not be empty")
+	}
+
+	return string(pass), nil
+}
+
+func UserAdd(path, username string, groups []string) {
+	if len(username) == 0 {
+		logrus.Fatal("Please provide a username")
+	}
+
+	store, err := NewUserStore(path, false)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer store.Close()
+
+	password, err := readPassword()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	user, err := store.GetUser(username)
+	if err != nil {
+		user = &User{Name: username}
+	}
+	user.Hash = string(hash)
+	if len(groups) > 0 {
+		user.Groups = groups
+	}
+
+	err = store.PutUser(user)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Printf("Saved user %s", username)
+}
+
+func UserRemove(path, username string) {
+	store, err := NewUserStore(path, false)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer store.Close()
+
+	err = store.DeleteUser(username)
+	if err != nil {
+		logrus.Fatalf("Failed to remove user %s: %s", username, err)
+	}
+
+	logrus.Printf("Removed user %s", username)
+}
+
+func UserList(path string) {
+	store, err := NewUserStore(path, true)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer store.Close()
+
+	users, err := store.Users()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	sort.Sort(UsersByName(users))
+
+	for _, u := range users {
+		fmt.Printf("%-20s%s\n", u.Name, strings.Join(u.Groups, ","))
+	}
+}
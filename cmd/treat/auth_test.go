@@ -0,0 +1,60 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestProxyAuthTrusted(t *testing.T) {
+	p, err := NewProxyAuth(&AuthOptions{
+		Header:         "X-Remote-User",
+		TrustedProxies: []string{"127.0.0.1", "::1", "10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tests := map[string]bool{
+		"127.0.0.1:5000":   true,
+		"[::1]:5000":       true,
+		"10.1.20.3:5000":   true,
+		"10.2.0.1:5000":    false,
+		"192.168.1.1:5000": false,
+	}
+
+	for remote, trusted := range tests {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		r.Header.Set("X-Remote-User", "alice")
+
+		user := p.UserFromRequest(r)
+		if trusted && (user == nil || user.Name != "alice") {
+			t.Errorf("User header from trusted proxy %s ignored", remote)
+		}
+		if !trusted && user != nil {
+			t.Errorf("User header from untrusted address %s accepted", remote)
+		}
+	}
+
+	_, err = NewProxyAuth(&AuthOptions{Header: "X-Remote-User", TrustedProxies: []string{"bogus"}})
+	if err == nil {
+		t.Errorf("Invalid trusted proxy address accepted")
+	}
+}
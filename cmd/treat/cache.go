@@ -0,0 +1,205 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/hashicorp/golang-lru"
+)
+
+// cachedResponse is a complete http response stored in the cache
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// CacheStats reports the usage of a ResponseCache
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// ResponseCache is a thread-safe LRU cache of http responses keyed by
+// request path, search fields and any other query parameters. Each database
+// has it's own cache which is discarded when the database is reloaded.
+type ResponseCache struct {
+	lru       *lru.Cache
+	capacity  int
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func NewResponseCache(size int) (*ResponseCache, error) {
+	c := &ResponseCache{capacity: size}
+
+	l, err := lru.NewWithEvict(size, func(key interface{}, value interface{}) {
+		atomic.AddUint64(&c.evictions, 1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.lru = l
+
+	return c, nil
+}
+
+func (c *ResponseCache) Get(key string) (*cachedResponse, bool) {
+	val, ok := c.lru.Get(key)
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+	return val.(*cachedResponse), true
+}
+
+func (c *ResponseCache) Add(key string, resp *cachedResponse) {
+	c.lru.Add(key, resp)
+}
+
+func (c *ResponseCache) Stats() *CacheStats {
+	return &CacheStats{
+		Size:      c.lru.Len(),
+		Capacity:  c.capacity,
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+// searchFieldKeys are the query parameters decoded into the search fields
+var searchFieldKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(SearchFields{})
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("schema"); len(name) > 0 {
+			keys[name] = true
+		}
+	}
+	return keys
+}()
+
+// cacheWriter records the response written by a handler while passing it
+// through to the client
+type cacheWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (cw *cacheWriter) WriteHeader(status int) {
+	cw.status = status
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.buf.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+// CacheHandler serves responses for the wrapped handler from the database
+// response cache. Only successful responses are cached.
+func CacheHandler(app *Application, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.enableCache {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		db, err := app.GetDbFromContext(r)
+		if err != nil || db.cache == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Searches stored in the session apply to the request so the
+		// response is keyed by the effective search fields
+		fields, session, err := app.searchFields(r, db)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Query parameters other than search fields (export, page..) also
+		// change the response
+		extra := r.URL.Query()
+		for k := range extra {
+			if searchFieldKeys[k] {
+				extra.Del(k)
+			}
+		}
+
+		key := r.URL.Path + "?" + string(data) + "&" + extra.Encode()
+		if resp, ok := db.cache.Get(key); ok {
+			app.saveSearchFields(w, r, session, fields)
+			for k, v := range resp.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		cw := &cacheWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+
+		if cw.status != http.StatusOK {
+			return
+		}
+
+		header := make(http.Header)
+		for k, v := range w.Header() {
+			// Session cookies are per user and must never be shared
+			if k == "Set-Cookie" {
+				continue
+			}
+			header[k] = v
+		}
+
+		db.cache.Add(key, &cachedResponse{
+			status: cw.status,
+			header: header,
+			body:   cw.buf.Bytes(),
+		})
+
+		logrus.WithFields(logrus.Fields{
+			"dbname": db.name,
+			"url":    key,
+		}).Debug("Cached response")
+	})
+}
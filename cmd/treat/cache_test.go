@@ -0,0 +1,78 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCacheExport(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	loadTestSample(t, s, "A6", "sample", "test-templates.fa", "test-sample.fa")
+	dbpath := s.DB.Path()
+	s.Close()
+
+	options := DefaultServerOptions()
+	options.DbPath = dbpath
+	options.TemplateDir = "templates"
+	options.EnableCache = true
+	options.DbScanInterval = 0
+
+	app, err := NewApplication(options)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer app.Close()
+
+	handler := DbContext(app)(CacheHandler(app, EditHistogramHandler(app)))
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", url, w.Code)
+		}
+		return w
+	}
+
+	// Each request twice so the second is served from the cache
+	for _, url := range []string{"/data/es-hist", "/data/es-hist?export=1", "/data/es-hist"} {
+		for i := 0; i < 2; i++ {
+			w := get(url)
+			export := strings.Contains(url, "export=1")
+			disposition := w.Header().Get("Content-Disposition")
+			if export && (len(disposition) == 0 || !strings.HasPrefix(w.Body.String(), "edit_stop")) {
+				t.Errorf("%s: expected csv export got %q", url, w.Body.String())
+			}
+			if !export && (len(disposition) > 0 || !strings.HasPrefix(w.Body.String(), "{")) {
+				t.Errorf("%s: expected json got %q", url, w.Body.String())
+			}
+		}
+	}
+
+	db, _ := app.GetDb(app.defaultDb)
+	if stats := db.cache.Stats(); stats.Size != 2 {
+		t.Errorf("Wrong number of cached responses %d != 2", stats.Size)
+	}
+}
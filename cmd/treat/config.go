@@ -0,0 +1,141 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli"
+)
+
+type ServerOptions struct {
+	DbPath       string `toml:"db"`
+	TemplateDir  string `toml:"templates"`
+	Bind         string `toml:"bind"`
+	Port         int    `toml:"port"`
+	TLSCert      string `toml:"tls_cert"`
+	TLSKey       string `toml:"tls_key"`
+	EnableCache  bool   `toml:"enable_cache"`
+	CacheSize    int    `toml:"cache_size"`
+	CookieSecret string `toml:"cookie_secret"`
+	AclPath      string `toml:"acl"`
+	AuditLogPath string `toml:"audit_log"`
+	ReadTimeout  int    `toml:"read_timeout"`
+	WriteTimeout int    `toml:"write_timeout"`
+	// Interval in seconds to scan for new, changed or removed databases. Set
+	// to 0 to disable.
+	DbScanInterval int          `toml:"db_scan_interval"`
+	Auth           *AuthOptions `toml:"auth"`
+}
+
+func DefaultServerOptions() *ServerOptions {
+	return &ServerOptions{
+		DbPath:         "treat.db",
+		Port:           8080,
+		CacheSize:      1000,
+		ReadTimeout:    30,
+		WriteTimeout:   300,
+		DbScanInterval: 10,
+		Auth: &AuthOptions{
+			Mode:           AUTH_NONE,
+			UsersPath:      "treat-users.db",
+			Header:         "X-Remote-User",
+			TrustedProxies: []string{"127.0.0.1", "::1"},
+		},
+	}
+}
+
+// LoadServerOptions builds the server options from the defaults, the config
+// file (if given) and finally any command line flags explicitly set by the
+// user.
+func LoadServerOptions(c *cli.Context) (*ServerOptions, error) {
+	options := DefaultServerOptions()
+
+	if path := c.String("config"); len(path) > 0 {
+		_, err := toml.DecodeFile(path, options)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse config file %s: %s", path, err)
+		}
+	}
+
+	if c.GlobalIsSet("db") {
+		options.DbPath = c.GlobalString("db")
+	}
+	if c.IsSet("templates") {
+		options.TemplateDir = c.String("templates")
+	}
+	if c.IsSet("bind") {
+		options.Bind = c.String("bind")
+	}
+	if c.IsSet("port") {
+		options.Port = c.Int("port")
+	}
+	if c.IsSet("tls-cert") {
+		options.TLSCert = c.String("tls-cert")
+	}
+	if c.IsSet("tls-key") {
+		options.TLSKey = c.String("tls-key")
+	}
+	if c.IsSet("enable-cache") {
+		options.EnableCache = c.Bool("enable-cache")
+	}
+	if c.IsSet("cookie-secret") || len(options.CookieSecret) == 0 {
+		options.CookieSecret = c.String("cookie-secret")
+	}
+	if c.IsSet("db-scan-interval") {
+		options.DbScanInterval = c.Int("db-scan-interval")
+	}
+	if c.IsSet("acl") {
+		options.AclPath = c.String("acl")
+	}
+	if c.IsSet("audit-log") {
+		options.AuditLogPath = c.String("audit-log")
+	}
+	if c.IsSet("auth") {
+		options.Auth.Mode = c.String("auth")
+	}
+	if c.IsSet("users") {
+		options.Auth.UsersPath = c.String("users")
+	}
+	if c.IsSet("htpasswd") {
+		options.Auth.HtpasswdPath = c.String("htpasswd")
+	}
+	if c.IsSet("htgroup") {
+		options.Auth.HtgroupPath = c.String("htgroup")
+	}
+	if c.IsSet("auth-header") {
+		options.Auth.Header = c.String("auth-header")
+	}
+	if c.IsSet("auth-groups-header") {
+		options.Auth.GroupsHeader = c.String("auth-groups-header")
+	}
+	if c.IsSet("auth-trusted-proxy") {
+		options.Auth.TrustedProxies = c.StringSlice("auth-trusted-proxy")
+	}
+
+	if (len(options.TLSCert) > 0) != (len(options.TLSKey) > 0) {
+		return nil, fmt.Errorf("Please provide both a TLS certificate and key")
+	}
+
+	return options, nil
+}
+
+func (o *ServerOptions) Addr() string {
+	return fmt.Sprintf("%s:%d", o.Bind, o.Port)
+}
@@ -0,0 +1,334 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+type ExtractOptions struct {
+	Genes   []string
+	Samples []string
+}
+
+// newOutputDb creates a new empty database at path. Existing files are never
+// overwritten.
+func newOutputDb(path string) (*Storage, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("Please provide an output database file")
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("Output file %s already exists", path)
+	}
+
+	s, err := NewStorageWrite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.Initialize()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// mergeTemplate adds the template for the gene to dst. It is an error if dst
+// already has a different template for the gene. Returns the template version
+// in dst.
+func mergeTemplate(dst *Storage, gene string, tmpl *treat.Template) (uint64, error) {
+	existing, err := dst.GetTemplate(gene)
+	if err == nil && !existing.Equal(tmpl) {
+		return 0, fmt.Errorf("Template conflict for gene %s. Templates must match to merge databases", gene)
+	}
+
+	return dst.PutTemplate(gene, tmpl)
+}
+
+// copySample copies the sample to dst and links it to the dst template
+// version. Samples aligned against an older template version are linked to
+// an unknown version.
+func copySample(src, dst *Storage, k, nkey *treat.AlignmentKey, version uint64) error {
+	err := src.CopySample(dst, k, nkey)
+	if err != nil {
+		return err
+	}
+
+	current, err := src.TemplateVersion(k.Gene)
+	if err != nil {
+		return err
+	}
+
+	sversion, err := src.SampleTemplate(k)
+	if err != nil {
+		return err
+	}
+
+	if sversion != current {
+		logrus.Warnf("Sample %s for gene %s was not aligned against the current template. Please re-align", k.Sample, k.Gene)
+		return nil
+	}
+
+	return dst.SetSampleTemplate(nkey, version)
+}
+
+// uniqueSampleName returns a sample name not already used in the gene
+func uniqueSampleName(dst *Storage, gene, sample string) (string, error) {
+	samples, err := dst.Samples(gene)
+	if err != nil {
+		return "", err
+	}
+
+	used := make(map[string]bool)
+	for _, s := range samples {
+		used[s] = true
+	}
+
+	name := sample
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s_%d", sample, i)
+	}
+
+	return name, nil
+}
+
+func mergeDb(dst *Storage, path string) error {
+	src, err := NewStorage(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	templates, err := src.TemplateMap()
+	if err != nil {
+		return err
+	}
+
+	for gene, tmpl := range templates {
+		version, err := mergeTemplate(dst, gene, tmpl)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+
+		keys, err := src.SampleKeys(gene)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			name, err := uniqueSampleName(dst, gene, k.Sample)
+			if err != nil {
+				return err
+			}
+
+			nkey := *k
+			if name != k.Sample {
+				logrus.Warnf("Duplicate sample %s for gene %s in %s. Renaming to %s", k.Sample, gene, filepath.Base(path), name)
+				nkey.Sample = name
+			}
+
+			err = copySample(src, dst, k, &nkey, version)
+			if err != nil {
+				return err
+			}
+		}
+
+		logrus.Printf("Merged %d samples for gene %s from %s", len(keys), gene, filepath.Base(path))
+	}
+
+	return nil
+}
+
+// DbMerge merges the samples of one or more databases into a new database
+func DbMerge(paths []string, output string) {
+	if len(paths) < 2 {
+		logrus.Fatal("Please provide two or more databases to merge")
+	}
+
+	dst, err := newOutputDb(output)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	for _, path := range paths {
+		err = mergeDb(dst, path)
+		if err != nil {
+			dst.Close()
+			os.Remove(output)
+			logrus.Fatal(err)
+		}
+	}
+
+	dst.Close()
+
+	logrus.Warn("Normalized counts were copied as is. Re-run norm on the merged database to normalize across all samples")
+}
+
+func hasString(list []string, val string) bool {
+	for _, s := range list {
+		if s == val {
+			return true
+		}
+	}
+
+	return false
+}
+
+func extractDb(src, dst *Storage, options *ExtractOptions) error {
+	templates, err := src.TemplateMap()
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for gene, tmpl := range templates {
+		if len(options.Genes) > 0 && !hasString(options.Genes, gene) {
+			continue
+		}
+
+		keys, err := src.SampleKeys(gene)
+		if err != nil {
+			return err
+		}
+
+		samples := make(map[string]bool)
+		for _, k := range keys {
+			if k.Gene == gene && (len(options.Samples) == 0 || hasString(options.Samples, k.Sample)) {
+				samples[k.Sample] = true
+			}
+		}
+
+		if len(samples) == 0 {
+			continue
+		}
+
+		version, err := dst.PutTemplate(gene, tmpl)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if k.Gene != gene || !samples[k.Sample] {
+				continue
+			}
+
+			err = copySample(src, dst, k, k, version)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = extractNormSets(src, dst, gene, samples)
+		if err != nil {
+			return err
+		}
+
+		logrus.Printf("Extracted %d samples for gene %s", len(samples), gene)
+		count += len(samples)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("No matching samples found")
+	}
+
+	return nil
+}
+
+// extractNormSets copies the normalization sets of the gene restricted to the
+// extracted samples. The active set is copied last so it remains active.
+func extractNormSets(src, dst *Storage, gene string, samples map[string]bool) error {
+	sets, err := src.NormSets(gene)
+	if err != nil {
+		return err
+	}
+
+	active, err := src.GetNormMeta(gene)
+	if err != nil {
+		return err
+	}
+
+	if active != nil {
+		for i, m := range sets {
+			if m.Name == active.Name {
+				sets = append(append(sets[:i:i], sets[i+1:]...), m)
+				break
+			}
+		}
+	}
+
+	for _, m := range sets {
+		for sample := range m.Scale {
+			if !samples[sample] {
+				delete(m.Scale, sample)
+			}
+		}
+
+		err = dst.PutNormSet(m, "extract")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DbExtract copies a subset of genes and samples into a new database
+func DbExtract(dbpath, output string, options *ExtractOptions) {
+	src, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer src.Close()
+
+	dst, err := newOutputDb(output)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = extractDb(src, dst, options)
+	dst.Close()
+	if err != nil {
+		os.Remove(output)
+		logrus.Fatal(err)
+	}
+
+	logrus.Printf("Extracted %s from %s to %s", describeExtract(options), dbpath, output)
+}
+
+func describeExtract(options *ExtractOptions) string {
+	genes := "all genes"
+	if len(options.Genes) > 0 {
+		genes = "genes " + strings.Join(options.Genes, ",")
+	}
+
+	samples := "all samples"
+	if len(options.Samples) > 0 {
+		samples = "samples " + strings.Join(options.Samples, ",")
+	}
+
+	return samples + " of " + genes
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// closeTestStorage closes s so the database file can be opened by path and
+// returns the path
+func closeTestStorage(t *testing.T, s *Storage) string {
+	path := s.DB.Path()
+	err := s.Close()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return path
+}
+
+func TestDbMerge(t *testing.T) {
+	src1, cleanup1 := newTestStorage(t)
+	defer cleanup1()
+	loadSampleMeta(t, src1, "A6", "sample")
+	loadTestSample(t, src1, "SIMPLE", "simple", "simple-templates.fa", "simple-sequences.fa")
+	akey, err := src1.GetKey("A6", "sample")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	counts := sampleBuckets(t, src1, akey)
+
+	src2, cleanup2 := newTestStorage(t)
+	defer cleanup2()
+	loadSampleMeta(t, src2, "A6", "sample")
+
+	conflict, cleanup3 := newTestStorage(t)
+	defer cleanup3()
+	loadTestSample(t, conflict, "A6", "sample", "simple-templates.fa", "simple-sequences.fa")
+
+	paths := []string{closeTestStorage(t, src1), closeTestStorage(t, src2), closeTestStorage(t, conflict)}
+
+	dst, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	for _, path := range paths[:2] {
+		err := mergeDb(dst, path)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+
+	samples, err := dst.Samples("A6")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sort.Strings(samples)
+	if strings.Join(samples, ",") != "sample,sample_2" {
+		t.Errorf("Wrong merged samples for duplicate sample name: %v", samples)
+	}
+
+	version, err := dst.TemplateVersion("A6")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	for _, sample := range samples {
+		k, err := dst.GetKey("A6", sample)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		merged := sampleBuckets(t, dst, k)
+		for name, n := range counts {
+			if merged[name] != n {
+				t.Errorf("Wrong number of %s entries for merged sample %s %d != %d", name, sample, merged[name], n)
+			}
+		}
+
+		sversion, err := dst.SampleTemplate(k)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if sversion != version {
+			t.Errorf("Merged sample %s not linked to template version %d != %d", sample, sversion, version)
+		}
+	}
+
+	samples, err = dst.Samples("SIMPLE")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(samples) != 1 || samples[0] != "simple" {
+		t.Errorf("Wrong merged samples for gene SIMPLE: %v", samples)
+	}
+
+	err = mergeDb(dst, paths[2])
+	if err == nil {
+		t.Errorf("Merging database with a different template should fail")
+	} else if !strings.Contains(err.Error(), "Template conflict") {
+		t.Errorf("Wrong error for template conflict: %s", err)
+	}
+}
+
+func TestDbExtract(t *testing.T) {
+	src, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	loadNormSamples(t, src)
+	loadTestSample(t, src, "A6", "sample", "test-templates.fa", "test-sample.fa")
+
+	err := normalizeGene(src, "G", &NormOptions{Name: "median", Method: NORM_MEDIAN_RATIO}, "normalize")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = normalizeGene(src, "G", &NormOptions{Name: NORM_DEFAULT_SET, Method: NORM_TOTAL, Target: 100}, "normalize")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	dir := filepath.Dir(src.DB.Path())
+
+	_, err = newOutputDb(src.DB.Path())
+	if err == nil {
+		t.Errorf("Extracting to an existing file should fail")
+	}
+
+	empty, err := newOutputDb(filepath.Join(dir, "empty.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer empty.Close()
+
+	err = extractDb(src, empty, &ExtractOptions{Genes: []string{"G"}, Samples: []string{"missing"}})
+	if err == nil {
+		t.Errorf("Extracting no matching samples should fail")
+	}
+
+	dst, err := newOutputDb(filepath.Join(dir, "extract.db"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer dst.Close()
+
+	err = extractDb(src, dst, &ExtractOptions{Genes: []string{"G"}, Samples: []string{"s1", "s3"}})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	templates, err := dst.TemplateMap()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, ok := templates["A6"]; ok || len(templates) != 1 {
+		t.Errorf("Extracted templates for genes not requested: %d", len(templates))
+	}
+
+	samples, err := dst.Samples("G")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sort.Strings(samples)
+	if strings.Join(samples, ",") != "s1,s3" {
+		t.Errorf("Wrong extracted samples: %v", samples)
+	}
+
+	for _, sample := range samples {
+		k, err := src.GetKey("G", sample)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		counts := sampleBuckets(t, src, k)
+		extracted := sampleBuckets(t, dst, k)
+		for name, n := range counts {
+			if extracted[name] != n {
+				t.Errorf("Wrong number of %s entries for extracted sample %s %d != %d", name, sample, extracted[name], n)
+			}
+		}
+	}
+
+	sets, err := dst.NormSets("G")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(sets) != 2 {
+		t.Fatalf("Wrong number of extracted normalization sets %d != 2", len(sets))
+	}
+	for _, m := range sets {
+		if _, ok := m.Scale["s2"]; ok || len(m.Scale) != 2 {
+			t.Errorf("Normalization set %s not restricted to extracted samples: %v", m.Name, m.Scale)
+		}
+	}
+
+	active, err := dst.GetNormMeta("G")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if active == nil || active.Name != NORM_DEFAULT_SET || active.Method != NORM_TOTAL {
+		t.Errorf("Wrong active normalization set after extract: %#v", active)
+	}
+}
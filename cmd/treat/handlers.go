@@ -27,6 +27,7 @@ import (
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/ubccr/treat"
@@ -35,7 +36,6 @@ import (
 func renderTemplate(app *Application, tmpl string, w http.ResponseWriter, data interface{}) {
 	if data == nil {
 		data = map[string]interface{}{
-			"dbs":   app.dbs,
 			"curdb": ""}
 	}
 
@@ -99,14 +99,16 @@ func IndexHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.UserDbs(r),
 			"curdb":      db.name,
+			"user":       app.GetUserFromContext(r),
 			"Template":   tmpl,
 			"Count":      count,
 			"Fields":     fields,
 			"Samples":    db.geneSamples[fields.Gene],
 			"KnockDowns": db.geneKnockDowns[fields.Gene],
 			"Replicates": db.geneReplicates[fields.Gene],
+			"NormSets":   db.geneNormSets[fields.Gene],
 			"Pages":      []int{10, 50, 100, 1000},
 			"Genes":      db.genes}
 
@@ -167,13 +169,6 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		return
 	}
 
-	if app.enableCache {
-		if _, ok := db.cache[r.URL.String()]; ok {
-			w.Write(db.cache[r.URL.String()])
-			return
-		}
-	}
-
 	fields, err := app.NewSearchFields(w, r, db)
 	fields.Limit = 0
 	fields.Offset = 0
@@ -290,10 +285,6 @@ func highChartHist(app *Application, w http.ResponseWriter, r *http.Request, max
 		return
 	}
 
-	if app.enableCache {
-		db.cache[r.URL.String()] = out
-	}
-
 	w.Write(out)
 	//json.NewEncoder(w).Encode(data)
 }
@@ -361,8 +352,9 @@ func ShowHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":       app.dbs,
+			"dbs":       app.UserDbs(r),
 			"curdb":     db.name,
+			"user":      app.GetUserFromContext(r),
 			"Template":  tmpl,
 			"Fragment":  frag,
 			"Alignment": alignment,
@@ -418,6 +410,13 @@ func SearchHandler(app *Application) http.Handler {
 
 		sort.Sort(ByReadCount{alignments})
 
+		editStopTotals, err := db.EditStopTotals(fields)
+		if err != nil {
+			logrus.Printf("Error computing edit stop totals for gene %s: %s", fields.Gene, err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
 		if r.URL.Query().Get("export") == "1" {
 			csvout := csv.NewWriter(w)
 			defer csvout.Flush()
@@ -437,7 +436,7 @@ func SearchHandler(app *Application) http.Handler {
 					strconv.Itoa(int(a.ReadCount)),
 					fmt.Sprintf("%.4f", a.Norm),
 					pctSearchFunc(a, totalMap),
-					pctEditStopFunc(a, db.cacheEditStopTotals[fields.Gene]),
+					pctEditStopFunc(a, editStopTotals),
 					strconv.Itoa(int(a.EditStop)),
 					strconv.Itoa(int(a.JuncEnd)),
 					strconv.Itoa(int(a.JuncLen)),
@@ -481,12 +480,13 @@ func SearchHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":            app.dbs,
+			"dbs":            app.UserDbs(r),
 			"curdb":          db.name,
+			"user":           app.GetUserFromContext(r),
 			"Template":       tmpl,
 			"Count":          count,
 			"SearchTotals":   totalMap,
-			"EditStopTotals": db.cacheEditStopTotals[fields.Gene],
+			"EditStopTotals": editStopTotals,
 			"Showing":        showing,
 			"Page":           page,
 			"Query":          r.URL.RawQuery,
@@ -495,6 +495,7 @@ func SearchHandler(app *Application) http.Handler {
 			"Samples":        db.geneSamples[fields.Gene],
 			"KnockDowns":     db.geneKnockDowns[fields.Gene],
 			"Replicates":     db.geneReplicates[fields.Gene],
+			"NormSets":       db.geneNormSets[fields.Gene],
 			"Pages":          []int{10, 50, 100, 1000},
 			"Genes":          db.genes}
 
@@ -528,13 +529,15 @@ func HeatHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.UserDbs(r),
 			"curdb":      db.name,
+			"user":       app.GetUserFromContext(r),
 			"Template":   tmpl,
 			"Fields":     fields,
 			"Samples":    db.geneSamples[fields.Gene],
 			"KnockDowns": db.geneKnockDowns[fields.Gene],
 			"Replicates": db.geneReplicates[fields.Gene],
+			"NormSets":   db.geneNormSets[fields.Gene],
 			"Pages":      []int{10, 50, 100, 1000},
 			"Genes":      db.genes}
 
@@ -655,13 +658,15 @@ func BubbleHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.UserDbs(r),
 			"curdb":      db.name,
+			"user":       app.GetUserFromContext(r),
 			"Template":   tmpl,
 			"Fields":     fields,
 			"Samples":    db.geneSamples[fields.Gene],
 			"KnockDowns": db.geneKnockDowns[fields.Gene],
 			"Replicates": db.geneReplicates[fields.Gene],
+			"NormSets":   db.geneNormSets[fields.Gene],
 			"Pages":      []int{10, 50, 100, 1000},
 			"Genes":      db.genes}
 
@@ -792,13 +797,15 @@ func TemplateSummaryHandler(app *Application) http.Handler {
 		}
 
 		vars := map[string]interface{}{
-			"dbs":        app.dbs,
+			"dbs":        app.UserDbs(r),
 			"curdb":      db.name,
+			"user":       app.GetUserFromContext(r),
 			"Template":   tmpl,
 			"Fields":     fields,
 			"Samples":    db.geneSamples[fields.Gene],
 			"KnockDowns": db.geneKnockDowns[fields.Gene],
 			"Replicates": db.geneReplicates[fields.Gene],
+			"NormSets":   db.geneNormSets[fields.Gene],
 			"Pages":      []int{10, 50, 100, 1000},
 			"Genes":      db.genes}
 
@@ -918,6 +925,17 @@ func DbHandler(app *Application) http.Handler {
 			return
 		}
 
+		user := app.GetUserFromContext(r)
+		if !app.CanAccess(user, name, PERM_READ) {
+			logrus.WithFields(logrus.Fields{
+				"dbname": name,
+				"user":   userName(user),
+			}).Warn("User does not have access to database")
+			w.WriteHeader(http.StatusForbidden)
+			renderTemplate(app, "403.html", w, nil)
+			return
+		}
+
 		session.Values[TREAT_COOKIE_DB] = name
 		session.Values[TREAT_COOKIE_SEARCH] = nil
 		err = session.Save(r, w)
@@ -946,6 +964,8 @@ func StatsHandler(app *Application) http.Handler {
 		countBy := COUNT_FRAG
 		if "Unique" == countByString {
 			countBy = COUNT_UNIQUE
+		} else if "Molecules" == countByString {
+			countBy = COUNT_MOLECULE
 		} else {
 			countByString = "Fragments"
 		}
@@ -964,23 +984,295 @@ func StatsHandler(app *Application) http.Handler {
 			return
 		}
 
-		stats, err := geneStats(db.storage, fields.Gene, countBy)
+		stats, err := geneStats(db.storage, fields.Gene, tmpl, countBy)
 		if err != nil {
 			logrus.Printf("Failed to compute stats for gene %s: %s", fields.Gene, err)
 			errorHandler(app, w, http.StatusInternalServerError)
 			return
 		}
 
+		norm, err := db.storage.GetNormMeta(fields.Gene)
+		if err != nil {
+			logrus.Printf("Failed to fetch normalization for gene %s: %s", fields.Gene, err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		normLog, err := db.storage.NormLog(fields.Gene)
+		if err != nil {
+			logrus.Printf("Failed to fetch normalization log for gene %s: %s", fields.Gene, err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
 		vars := map[string]interface{}{
-			"dbs":      app.dbs,
+			"dbs":      app.UserDbs(r),
 			"curdb":    db.name,
+			"user":     app.GetUserFromContext(r),
 			"stats":    stats,
+			"Norm":     norm,
+			"NormLog":  normLog,
 			"Fields":   fields,
 			"Template": tmpl,
-			"Counts":   []string{"Fragments", "Unique"},
+			"Counts":   []string{"Fragments", "Unique", "Molecules"},
 			"Countby":  countByString,
 			"Genes":    db.genes}
 
 		renderTemplate(app, "stats.html", w, vars)
 	})
 }
+
+func QCHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("qc handler: database not found in request context")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		fields, err := app.NewSearchFields(w, r, db)
+		if err != nil {
+			logrus.Printf("Error parsing get request: %s", err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		if _, ok := db.geneTemplates[fields.Gene]; !ok {
+			logrus.Warnf("Error fetching template for gene: %s", fields.Gene)
+			http.Redirect(w, r, fmt.Sprintf("/?gene=%s", url.QueryEscape(db.defaultGene)), 302)
+			return
+		}
+
+		reports, err := sampleQC(db.storage, fields.Gene, "")
+		if err != nil {
+			logrus.Printf("Failed to fetch QC reports for gene %s: %s", fields.Gene, err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		vars := map[string]interface{}{
+			"dbs":     app.UserDbs(r),
+			"curdb":   db.name,
+			"user":    app.GetUserFromContext(r),
+			"Reports": reports,
+			"Fields":  fields,
+			"Genes":   db.genes}
+
+		renderTemplate(app, "qc.html", w, vars)
+	})
+}
+
+func LoginHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.auth == nil {
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+
+		if _, ok := app.auth.(*ProxyAuth); ok {
+			http.Redirect(w, r, "/", 302)
+			return
+		}
+
+		// Only allow redirects to local paths
+		next := r.FormValue("next")
+		if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+			next = "/"
+		}
+
+		vars := map[string]interface{}{
+			"curdb":    "",
+			"Username": "",
+			"Next":     next}
+
+		if r.Method == "POST" {
+			username := r.FormValue("username")
+			user, err := app.auth.Authenticate(username, r.FormValue("password"))
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"user":   username,
+					"remote": r.RemoteAddr,
+				}).Warn("Failed login attempt")
+
+				vars["Error"] = err.Error()
+				vars["Username"] = username
+				w.WriteHeader(http.StatusUnauthorized)
+				renderTemplate(app, "login.html", w, vars)
+				return
+			}
+
+			session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+			session.Values[TREAT_COOKIE_USER] = user.Name
+			err = session.Save(r, w)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("Login handler: failed to save session")
+				errorHandler(app, w, http.StatusInternalServerError)
+				return
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"user":   user.Name,
+				"remote": r.RemoteAddr,
+			}).Info("User logged in")
+
+			http.Redirect(w, r, next, 302)
+			return
+		}
+
+		renderTemplate(app, "login.html", w, vars)
+	})
+}
+
+func LogoutHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+		delete(session.Values, TREAT_COOKIE_USER)
+		session.Values[TREAT_COOKIE_SEARCH] = nil
+		err := session.Save(r, w)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Logout handler: failed to save session")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/login", 302)
+	})
+}
+
+func CacheStatsHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := make(map[string]*CacheStats)
+		for name, db := range app.UserDbs(r) {
+			if db.cache != nil {
+				stats[name] = db.cache.Stats()
+			}
+		}
+
+		out, err := json.Marshal(stats)
+		if err != nil {
+			logrus.Printf("Error encoding data as json: %s", err)
+			http.Error(w, "Fatal system error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+}
+
+// sameOrigin checks the Origin or Referer header of a form post matches the
+// host to guard against cross site request forgery
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = r.Header.Get("Referer")
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || len(u.Host) == 0 {
+		return false
+	}
+
+	return u.Host == r.Host
+}
+
+func SamplesHandler(app *Application) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		db, err := app.GetDbFromContext(r)
+		if err != nil {
+			logrus.Error("samples handler: database not found in request context")
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		user := app.GetUserFromContext(r)
+		canUpdate := app.CanUpdate(user, db.name)
+
+		if r.Method == "POST" {
+			if !canUpdate || !sameOrigin(r) {
+				logrus.WithFields(logrus.Fields{
+					"dbname": db.name,
+					"user":   userName(user),
+				}).Warn("User not allowed to update database")
+				w.WriteHeader(http.StatusForbidden)
+				renderTemplate(app, "403.html", w, nil)
+				return
+			}
+
+			gene := r.PostFormValue("gene")
+			sample := r.PostFormValue("sample")
+			err = app.UpdateDb(db.name, func(s *Storage) error {
+				switch r.PostFormValue("action") {
+				case "rm":
+					return removeSample(s, gene, sample)
+				case "set":
+					rep, err := strconv.Atoi(r.PostFormValue("rep"))
+					if err != nil {
+						return fmt.Errorf("Invalid replicate: %s", r.PostFormValue("rep"))
+					}
+					return updateSample(s, gene, sample, &SampleEdit{
+						Name:            r.PostFormValue("name"),
+						KnockDown:       r.PostFormValue("kd"),
+						Replicate:       rep,
+						Tetracycline:    r.PostFormValue("tet") == "1",
+						SetKnockDown:    true,
+						SetReplicate:    true,
+						SetTetracycline: true,
+					})
+				}
+
+				return fmt.Errorf("Invalid action")
+			})
+
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"dbname": db.name,
+					"gene":   gene,
+					"sample": sample,
+					"error":  err.Error(),
+				}).Error("Failed to update sample")
+				session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+				session.AddFlash(err.Error())
+				session.Save(r, w)
+			}
+
+			http.Redirect(w, r, fmt.Sprintf("/samples?gene=%s", url.QueryEscape(gene)), 302)
+			return
+		}
+
+		fields, err := app.NewSearchFields(w, r, db)
+		if err != nil {
+			logrus.Printf("Error parsing get request: %s", err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		keys, err := db.storage.SampleKeys(fields.Gene)
+		if err != nil {
+			logrus.Printf("Failed to fetch samples for gene %s: %s", fields.Gene, err)
+			errorHandler(app, w, http.StatusInternalServerError)
+			return
+		}
+
+		session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+		flashes := session.Flashes()
+		session.Save(r, w)
+
+		vars := map[string]interface{}{
+			"dbs":       app.UserDbs(r),
+			"curdb":     db.name,
+			"user":      user,
+			"Fields":    fields,
+			"Keys":      keys,
+			"CanUpdate": canUpdate,
+			"Errors":    flashes,
+			"Genes":     db.genes}
+
+		renderTemplate(app, "samples.html", w, vars)
+	})
+}
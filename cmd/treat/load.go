@@ -26,19 +26,27 @@ import (
 )
 
 type LoadOptions struct {
-	Gene         string
-	Sample       string
-	KnockDown    string
-	EditBase     string
-	TemplatePath string
-	FastaPath    string
-	Replicate    int
-	EditOffset   int
-	SkipFrags    bool
-	ExcludeSnps  bool
-	Force        bool
-	Tetracycline bool
-	Collapse     bool
+	Gene           string
+	Sample         string
+	KnockDown      string
+	EditBase       string
+	TemplatePath   string
+	FastaPath      string
+	Replicate      int
+	EditOffset     int
+	SkipFrags      bool
+	Force          bool
+	Tetracycline   bool
+	Collapse       bool
+	Orientation    string
+	Primer5        string
+	Primer3        string
+	PrimerMismatch int
+	CountFormat    string
+	CountPattern   string
+	Policy         *treat.MutationPolicy
+	UMI            treat.UMIOptions
+	Pairs          PairOptions
 }
 
 func cleanName(name string) string {
@@ -50,38 +58,118 @@ func cleanName(name string) string {
 	return name
 }
 
-func Load(dbpath string, options *LoadOptions) {
-	if len(options.Gene) == 0 {
-		logrus.Fatal("Gene name is required")
+// parseReadCount returns the read count in the header of a record or 1 if
+// the header has no read count
+func parseReadCount(counts treat.CountParser, id string) uint32 {
+	if reads, ok := counts.ParseCount(id); ok {
+		return reads
+	}
+
+	return 1
+}
+
+// setPrimers locates the primer sequences in the template. Primers replace
+// any primer regions given in the template file.
+func setPrimers(tmpl *treat.Template, primer5, primer3 string) error {
+	if len(primer5) > 0 {
+		r, err := tmpl.FindPrimer(primer5, false)
+		if err != nil {
+			return err
+		}
+		tmpl.Primer5 = r
+	}
+	if len(primer3) > 0 {
+		r, err := tmpl.FindPrimer(primer3, true)
+		if err != nil {
+			return err
+		}
+		tmpl.Primer3 = r
 	}
+
+	if tmpl.HasPrimers() {
+		logrus.Printf("Trimming primers 5': %s 3': %s", tmpl.PrimerSeq(tmpl.Primer5), tmpl.PrimerSeq(tmpl.Primer3))
+	}
+
+	return nil
+}
+
+func Load(dbpath string, options *LoadOptions) {
 	if len(options.TemplatePath) == 0 {
 		logrus.Fatal("Please provide path to templates file")
 	}
-	if len(options.FastaPath) == 0 {
-		logrus.Fatal("Please provide a fasta file to load")
+	if len(options.FastaPath) == 0 && !options.Pairs.IsPaired() {
+		logrus.Fatal("Please provide a fasta file or R1/R2 FASTQ files to load")
 	}
-	if len(options.EditBase) != 1 {
-		logrus.Fatal("Please provide the edit base")
+	if len(options.FastaPath) > 0 && options.Pairs.IsPaired() {
+		logrus.Fatal("Please provide either a fasta file or R1/R2 FASTQ files, not both")
+	}
+	bases, err := treat.ParseEditBases(options.EditBase)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	options.EditBase = bases
+
+	if _, err := treat.ParseOrientation(options.Orientation); err != nil {
+		logrus.Fatal(err)
+	}
+
+	if options.Policy == nil {
+		options.Policy = treat.DefaultMutationPolicy()
+	}
+	if err := options.Policy.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
+	if _, err := treat.NewUMIDedup(&options.UMI); err != nil {
+		logrus.Fatal(err)
+	}
+	if _, err := treat.NewCountParser(options.CountFormat, options.CountPattern); err != nil {
+		logrus.Fatal(err)
 	}
 
 	if len(options.Sample) == 0 {
-		fname := filepath.Base(options.FastaPath)
-		options.Sample = fname[:len(fname)-len(filepath.Ext(options.FastaPath))]
+		path := options.FastaPath
+		if options.Pairs.IsPaired() {
+			path = options.Pairs.R1Path
+		}
+		fname := filepath.Base(path)
+		options.Sample = fname[:len(fname)-len(filepath.Ext(path))]
+		if i := strings.LastIndex(options.Sample, "_R1"); options.Pairs.IsPaired() && i > 0 {
+			options.Sample = options.Sample[:i]
+		}
+	}
+
+	tmpl, err := treat.NewTemplateFromFastaBases(options.TemplatePath, treat.FORWARD, options.EditBase)
+	if err != nil {
+		logrus.Fatalln(err)
+	}
+
+	if len(options.Gene) == 0 {
+		options.Gene = tmpl.Gene
+	}
+	if len(options.Gene) == 0 {
+		logrus.Fatal("Gene name is required")
+	}
+	if len(tmpl.Gene) > 0 && cleanName(tmpl.Gene) != cleanName(options.Gene) {
+		logrus.Fatalf("Gene name %s does not match the gene %s in the template file", options.Gene, tmpl.Gene)
 	}
 
 	options.Gene = cleanName(options.Gene)
 	options.Sample = cleanName(options.Sample)
 	options.KnockDown = cleanName(options.KnockDown)
+	options.EditBase = tmpl.EditBaseSet()
 
-	tmpl, err := treat.NewTemplateFromFasta(options.TemplatePath, treat.FORWARD, rune(options.EditBase[0]))
-	if err != nil {
-		logrus.Fatalln(err)
+	if options.EditOffset > 0 {
+		tmpl.SetOffset(options.EditOffset)
 	}
 
-	tmpl.SetOffset(options.EditOffset)
+	err = setPrimers(tmpl, options.Primer5, options.Primer3)
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
 	logrus.Printf("Using template Edit Stop Site: %d", tmpl.EditStop)
 	logrus.Printf("Using Edit Site numbering offset: %d", tmpl.EditOffset)
+	logrus.Printf("Using mutation policy: %s", options.Policy)
 
 	storage, err := NewStorageWrite(dbpath)
 	if err != nil {
@@ -93,12 +181,50 @@ func Load(dbpath string, options *LoadOptions) {
 		logrus.Fatal(err)
 	}
 
-	err = storage.PutTemplate(options.Gene, tmpl)
+	current, err := storage.GetTemplate(options.Gene)
+	if err == nil && !current.Equal(tmpl) {
+		samples, err := storage.Samples(options.Gene)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		if len(samples) > 0 {
+			logrus.Fatalf("Template for gene %s does not match the template of existing samples. "+
+				"Compare using 'treat template diff'. To change the template use 'treat template set' and re-align existing samples with 'treat realign'", options.Gene)
+		}
+	}
+
+	version, err := storage.PutTemplate(options.Gene, tmpl)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var akey *treat.AlignmentKey
+	var stats *treat.MergeStats
+	if options.Pairs.IsPaired() {
+		akey, stats, err = storage.ImportPairs(&options.Pairs, options)
+	} else {
+		akey, err = storage.ImportSample(options.FastaPath, options)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if stats != nil {
+		logrus.Printf("Merged paired-end reads for sample %s: %s", options.Sample, stats)
+	}
+
+	err = storage.SetMergeStats(akey, stats)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = storage.SetMutationPolicy(akey, options.Policy)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	_, err = storage.ImportSample(options.FastaPath, options)
+	err = storage.SetSampleTemplate(akey, version)
 	if err != nil {
 		logrus.Fatal(err)
 	}
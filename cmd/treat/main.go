@@ -19,7 +19,10 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/ubccr/treat"
 	"github.com/urfave/cli"
 )
 
@@ -57,85 +60,388 @@ func main() {
 		{
 			Name:  "load",
 			Usage: "Load samples into database",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
 				&cli.StringFlag{Name: "sample, s", Usage: "Sample Name"},
 				&cli.StringFlag{Name: "knock-down, k", Usage: "Knock Down Gene"},
 				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
 				&cli.StringFlag{Name: "fasta, f", Usage: "Path to fragment FASTA files"},
-				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base"},
+				&cli.StringFlag{Name: "r1", Usage: "Path to R1 FASTQ file of paired-end reads"},
+				&cli.StringFlag{Name: "r2", Usage: "Path to R2 FASTQ file of paired-end reads"},
+				&cli.IntFlag{Name: "min-overlap", Value: 10, Usage: "Minimum overlap when merging paired-end reads"},
+				&cli.Float64Flag{Name: "max-mismatch", Value: 0.1, Usage: "Maximum fraction of mismatches in the overlap of paired-end reads"},
+				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base(s). e.g. T or TC for multi-base editing"},
 				&cli.BoolFlag{Name: "skip-fragments", Usage: "Do not store raw fragments. Only alignment summary data."},
-				&cli.BoolFlag{Name: "exclude-snps", Usage: "Exclude fragments containing SNPs."},
 				&cli.BoolFlag{Name: "force", Usage: "Force delete gene data if already exists"},
 				&cli.BoolFlag{Name: "tet", Usage: "Tetracycline positive"},
 				&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
 				&cli.IntFlag{Name: "replicate", Value: 0, Usage: "Replicate number"},
-			},
+				&cli.StringFlag{Name: "orientation", Value: "forward", Usage: "Read orientation: forward, reverse (complement) or auto"},
+				&cli.StringFlag{Name: "primer5", Usage: "5' primer sequence to trim. Overrides the template"},
+				&cli.StringFlag{Name: "primer3", Usage: "3' (reverse) primer sequence to trim. Overrides the template"},
+				&cli.IntFlag{Name: "primer-mismatch", Value: 2, Usage: "Maximum mismatches when matching primers"},
+				&cli.StringFlag{Name: "umi-header", Usage: "Regular expression with a capture group matching the UMI in the read header"},
+				&cli.StringFlag{Name: "umi-prefix", Usage: "UMI at the start of the read. N is a UMI base and X a discarded base, e.g. NNNNNNNNXXXX"},
+				&cli.IntFlag{Name: "umi-distance", Value: treat.DEFAULT_UMI_DISTANCE, Usage: "Maximum mismatches between UMIs of the same molecule"},
+				&cli.StringFlag{Name: "count-format", Value: treat.COUNT_AUTO, Usage: "Format of the read count in the FASTA header (" + strings.Join(treat.CountFormats(), ", ") + ")"},
+				&cli.StringFlag{Name: "count-pattern", Usage: "Regular expression with a capture group matching the read count in the FASTA header"},
+			}, policyFlags...),
 			Action: func(c *cli.Context) {
 				Load(c.GlobalString("db"), &LoadOptions{
-					Gene:         c.String("gene"),
-					Sample:       c.String("sample"),
-					KnockDown:    c.String("knock-down"),
-					TemplatePath: c.String("template"),
-					FastaPath:    c.String("fasta"),
-					EditBase:     c.String("base"),
-					EditOffset:   c.Int("offset"),
-					SkipFrags:    c.Bool("skip-fragments"),
-					ExcludeSnps:  c.Bool("exclude-snps"),
-					Force:        c.Bool("force"),
-					Tetracycline: c.Bool("tet"),
-					Replicate:    c.Int("replicate"),
+					Gene:           c.String("gene"),
+					Sample:         c.String("sample"),
+					KnockDown:      c.String("knock-down"),
+					TemplatePath:   c.String("template"),
+					FastaPath:      c.String("fasta"),
+					EditBase:       c.String("base"),
+					EditOffset:     c.Int("offset"),
+					SkipFrags:      c.Bool("skip-fragments"),
+					Policy:         parsePolicy(c),
+					Force:          c.Bool("force"),
+					Tetracycline:   c.Bool("tet"),
+					Replicate:      c.Int("replicate"),
+					Orientation:    c.String("orientation"),
+					Primer5:        c.String("primer5"),
+					Primer3:        c.String("primer3"),
+					PrimerMismatch: c.Int("primer-mismatch"),
+					CountFormat:    c.String("count-format"),
+					CountPattern:   c.String("count-pattern"),
+					UMI: treat.UMIOptions{
+						Header:      c.String("umi-header"),
+						Prefix:      c.String("umi-prefix"),
+						MaxDistance: c.Int("umi-distance"),
+					},
+					Pairs: PairOptions{
+						R1Path:      c.String("r1"),
+						R2Path:      c.String("r2"),
+						MinOverlap:  c.Int("min-overlap"),
+						MaxMismatch: c.Float64("max-mismatch"),
+					},
 				})
 			},
 		},
 		{
 			Name:  "align",
 			Usage: "Align one or more fragments",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
 				&cli.StringFlag{Name: "fragment, f", Usage: "Path to fragment FASTA file"},
-				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base"},
+				&cli.StringFlag{Name: "r1", Usage: "Path to R1 FASTQ file of paired-end reads"},
+				&cli.StringFlag{Name: "r2", Usage: "Path to R2 FASTQ file of paired-end reads"},
+				&cli.IntFlag{Name: "min-overlap", Value: 10, Usage: "Minimum overlap when merging paired-end reads"},
+				&cli.Float64Flag{Name: "max-mismatch", Value: 0.1, Usage: "Maximum fraction of mismatches in the overlap of paired-end reads"},
+				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base(s). e.g. T or TC for multi-base editing"},
 				&cli.StringFlag{Name: "s1, 1", Usage: "first sequence to align"},
 				&cli.StringFlag{Name: "s2, 2", Usage: "second sequence to align"},
 				&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
-			},
+				&cli.StringFlag{Name: "orientation", Value: "forward", Usage: "Read orientation: forward, reverse (complement) or auto"},
+				&cli.StringFlag{Name: "primer5", Usage: "5' primer sequence to trim. Overrides the template"},
+				&cli.StringFlag{Name: "primer3", Usage: "3' (reverse) primer sequence to trim. Overrides the template"},
+				&cli.IntFlag{Name: "primer-mismatch", Value: 2, Usage: "Maximum mismatches when matching primers"},
+				&cli.StringFlag{Name: "count-format", Value: treat.COUNT_AUTO, Usage: "Format of the read count in the FASTA header (" + strings.Join(treat.CountFormats(), ", ") + ")"},
+				&cli.StringFlag{Name: "count-pattern", Usage: "Regular expression with a capture group matching the read count in the FASTA header"},
+			}, policyFlags...),
 			Action: func(c *cli.Context) {
 				Align(&AlignOptions{
-					TemplatePath: c.String("template"),
-					FragmentPath: c.String("fragment"),
-					EditBase:     c.String("base"),
-					S1:           c.String("s1"),
-					S2:           c.String("s2"),
-					EditOffset:   c.Int("offset"),
+					TemplatePath:   c.String("template"),
+					FragmentPath:   c.String("fragment"),
+					EditBase:       c.String("base"),
+					S1:             c.String("s1"),
+					S2:             c.String("s2"),
+					EditOffset:     c.Int("offset"),
+					Orientation:    c.String("orientation"),
+					Primer5:        c.String("primer5"),
+					Primer3:        c.String("primer3"),
+					PrimerMismatch: c.Int("primer-mismatch"),
+					CountFormat:    c.String("count-format"),
+					CountPattern:   c.String("count-pattern"),
+					Policy:         parsePolicy(c),
+					Pairs: PairOptions{
+						R1Path:      c.String("r1"),
+						R2Path:      c.String("r2"),
+						MinOverlap:  c.Int("min-overlap"),
+						MaxMismatch: c.Float64("max-mismatch"),
+					},
 				})
 			},
 		},
 		{
 			Name:  "mutant",
-			Usage: "Indel mutation analysis",
-			Flags: []cli.Flag{
+			Usage: "Report substitutions and indels by template position",
+			Flags: append([]cli.Flag{
 				&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
 				&cli.StringSliceFlag{Name: "fragment, f", Value: &cli.StringSlice{}, Usage: "One or more fragment FASTA files"},
-				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base"},
-				&cli.IntFlag{Name: "n", Value: 5, Usage: "Max number of indels to ouptut"},
-			},
+				&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base(s). e.g. T or TC for multi-base editing"},
+				&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+				&cli.StringFlag{Name: "orientation", Value: "forward", Usage: "Read orientation: forward, reverse (complement) or auto"},
+				&cli.StringFlag{Name: "primer5", Usage: "5' primer sequence to trim. Overrides the template"},
+				&cli.StringFlag{Name: "primer3", Usage: "3' (reverse) primer sequence to trim. Overrides the template"},
+				&cli.IntFlag{Name: "primer-mismatch", Value: 2, Usage: "Maximum mismatches when matching primers"},
+				&cli.StringFlag{Name: "format", Value: FORMAT_TSV, Usage: "Output format: tsv, json or vcf"},
+				&cli.Float64Flag{Name: "min-freq", Usage: "Minimum frequency of variants to output"},
+				&cli.IntFlag{Name: "min-reads", Value: 1, Usage: "Minimum reads of variants to output"},
+				&cli.StringFlag{Name: "count-format", Value: treat.COUNT_AUTO, Usage: "Format of the read count in the FASTA header (" + strings.Join(treat.CountFormats(), ", ") + ")"},
+				&cli.StringFlag{Name: "count-pattern", Usage: "Regular expression with a capture group matching the read count in the FASTA header"},
+			}, policyFlags...),
 			Action: func(c *cli.Context) {
-				Mutant(&AlignOptions{
-					TemplatePath: c.String("template"),
-					EditBase:     c.String("base"),
-				}, c.StringSlice("fragment"), c.Int("n"))
+				Mutant(&MutantOptions{
+					AlignOptions: AlignOptions{
+						TemplatePath:   c.String("template"),
+						EditBase:       c.String("base"),
+						EditOffset:     c.Int("offset"),
+						Orientation:    c.String("orientation"),
+						Primer5:        c.String("primer5"),
+						Primer3:        c.String("primer3"),
+						PrimerMismatch: c.Int("primer-mismatch"),
+						CountFormat:    c.String("count-format"),
+						CountPattern:   c.String("count-pattern"),
+						Policy:         parsePolicy(c),
+					},
+					Fragments: c.StringSlice("fragment"),
+					Format:    c.String("format"),
+					MinFreq:   c.Float64("min-freq"),
+					MinReads:  uint64(c.Int("min-reads")),
+				})
 			},
 		},
 		{
 			Name:  "server",
 			Usage: "Run http server",
 			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "config, c", Usage: "Path to server config file (TOML)"},
 				&cli.StringFlag{Name: "templates, t", Usage: "Path to html templates directory"},
+				&cli.StringFlag{Name: "bind", Usage: "Address to listen on (all interfaces by default)"},
 				&cli.IntFlag{Name: "port, p", Value: 8080, Usage: "Port to listen on"},
+				&cli.StringFlag{Name: "tls-cert", Usage: "Path to TLS certificate"},
+				&cli.StringFlag{Name: "tls-key", Usage: "Path to TLS private key"},
 				&cli.BoolFlag{Name: "enable-cache", Usage: "Enable url caching"},
+				&cli.IntFlag{Name: "db-scan-interval", Value: 10, Usage: "Interval in seconds to scan for new or changed databases (0 to disable)"},
+				&cli.StringFlag{Name: "cookie-secret", EnvVar: "TREAT_COOKIE_SECRET", Usage: "Secret key used to sign session cookies"},
+				&cli.StringFlag{Name: "auth", Value: AUTH_NONE, Usage: "Authentication mode (none, local, htpasswd, proxy)"},
+				&cli.StringFlag{Name: "users", Value: "treat-users.db", Usage: "Path to local users database"},
+				&cli.StringFlag{Name: "htpasswd", Usage: "Path to htpasswd file"},
+				&cli.StringFlag{Name: "auth-header", Value: "X-Remote-User", Usage: "Reverse proxy header containing the username"},
+				&cli.StringFlag{Name: "auth-groups-header", Usage: "Reverse proxy header containing a comma separated list of groups"},
+				&cli.StringSliceFlag{Name: "auth-trusted-proxy", Value: &cli.StringSlice{}, Usage: "One or more addresses or CIDR ranges of trusted reverse proxies (loopback by default)"},
+				&cli.StringFlag{Name: "htgroup", Usage: "Path to htgroup file"},
+				&cli.StringFlag{Name: "acl", Usage: "Path to database access control list file"},
+				&cli.StringFlag{Name: "audit-log", Usage: "Path to audit log file"},
+			},
+			Action: func(c *cli.Context) {
+				Server(func() (*ServerOptions, error) {
+					return LoadServerOptions(c)
+				})
+			},
+		},
+		{
+			Name:  "user",
+			Usage: "Manage local server users",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "users", Value: "treat-users.db", Usage: "Path to local users database"},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     "Add user or reset password",
+					ArgsUsage: "[username]",
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{Name: "group, g", Value: &cli.StringSlice{}, Usage: "One or more groups"},
+					},
+					Action: func(c *cli.Context) {
+						UserAdd(c.Parent().String("users"), c.Args().First(), c.StringSlice("group"))
+					},
+				},
+				{
+					Name:      "rm",
+					Usage:     "Remove user",
+					ArgsUsage: "[username]",
+					Action: func(c *cli.Context) {
+						UserRemove(c.Parent().String("users"), c.Args().First())
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "List users",
+					Action: func(c *cli.Context) {
+						UserList(c.Parent().String("users"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "sample",
+			Usage: "Remove, rename or re-annotate samples",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene name (all by default)"},
 			},
+			Subcommands: []cli.Command{
+				{
+					Name:      "rm",
+					Usage:     "Remove sample",
+					ArgsUsage: "[sample]",
+					Action: func(c *cli.Context) {
+						SampleRemove(c.GlobalString("db"), c.Parent().String("gene"), c.Args().First())
+					},
+				},
+				{
+					Name:      "rename",
+					Usage:     "Rename sample",
+					ArgsUsage: "[sample] [new name]",
+					Action: func(c *cli.Context) {
+						SampleRename(c.GlobalString("db"), c.Parent().String("gene"), c.Args().Get(0), c.Args().Get(1))
+					},
+				},
+				{
+					Name:      "set",
+					Usage:     "Set sample knock down, replicate or tetracycline",
+					ArgsUsage: "[sample]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "knock-down, k", Usage: "Knock Down Gene"},
+						&cli.IntFlag{Name: "replicate", Value: 0, Usage: "Replicate number"},
+						&cli.BoolFlag{Name: "tet", Usage: "Tetracycline positive"},
+						&cli.BoolFlag{Name: "no-tet", Usage: "Tetracycline negative"},
+					},
+					Action: func(c *cli.Context) {
+						SampleSet(c.GlobalString("db"), c.Parent().String("gene"), c.Args().First(), &SampleEdit{
+							KnockDown:       c.String("knock-down"),
+							Replicate:       c.Int("replicate"),
+							Tetracycline:    c.Bool("tet"),
+							SetKnockDown:    c.IsSet("knock-down"),
+							SetReplicate:    c.IsSet("replicate"),
+							SetTetracycline: c.IsSet("tet") || c.IsSet("no-tet"),
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:  "db",
+			Usage: "Merge or extract database files",
+			Subcommands: []cli.Command{
+				{
+					Name:      "merge",
+					Usage:     "Merge two or more databases into a new database",
+					ArgsUsage: "[db1 db2 ...]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "output, o", Usage: "Path to output database"},
+					},
+					Action: func(c *cli.Context) {
+						DbMerge(c.Args(), c.String("output"))
+					},
+				},
+				{
+					Name:  "extract",
+					Usage: "Extract a subset of genes or samples into a new database",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "output, o", Usage: "Path to output database"},
+						&cli.StringSliceFlag{Name: "gene, g", Value: &cli.StringSlice{}, Usage: "One or more genes (all by default)"},
+						&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples (all by default)"},
+					},
+					Action: func(c *cli.Context) {
+						DbExtract(c.GlobalString("db"), c.String("output"), &ExtractOptions{
+							Genes:   c.StringSlice("gene"),
+							Samples: c.StringSlice("sample"),
+						})
+					},
+				},
+			},
+		},
+		{
+			Name:  "realign",
+			Usage: "Re-align samples from stored fragments against the current template",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+				&cli.StringSliceFlag{Name: "sample, s", Value: &cli.StringSlice{}, Usage: "One or more samples (all by default)"},
+				&cli.StringFlag{Name: "output, o", Usage: "Write re-aligned samples to a new database instead of updating in place"},
+			}, policyFlags...),
 			Action: func(c *cli.Context) {
-				Server(c.GlobalString("db"), c.String("templates"), c.Int("port"), c.Bool("enable-cache"))
+				Realign(c.GlobalString("db"), &RealignOptions{
+					Gene:    c.String("gene"),
+					Samples: c.StringSlice("sample"),
+					Output:  c.String("output"),
+					Policy:  parsePolicy(c),
+				})
+			},
+		},
+		{
+			Name:  "template",
+			Usage: "Show, compare or change gene templates",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene Name"},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "show",
+					Usage: "Show template",
+					Flags: []cli.Flag{
+						&cli.IntFlag{Name: "version, v", Value: 0, Usage: "Template version (current by default)"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateShow(c.GlobalString("db"), c.Parent().String("gene"), uint64(c.Int("version")))
+					},
+				},
+				{
+					Name:      "diff",
+					Usage:     "Compare template versions or a template file",
+					ArgsUsage: "[version] [version]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
+						&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base(s). e.g. T or TC for multi-base editing"},
+						&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+					},
+					Action: func(c *cli.Context) {
+						v1, _ := strconv.ParseUint(c.Args().Get(0), 10, 64)
+						v2, _ := strconv.ParseUint(c.Args().Get(1), 10, 64)
+						TemplateDiff(c.GlobalString("db"), &TemplateOptions{
+							Gene:         c.Parent().String("gene"),
+							TemplatePath: c.String("template"),
+							EditBase:     c.String("base"),
+							EditOffset:   c.Int("offset"),
+						}, v1, v2)
+					},
+				},
+				{
+					Name:  "build",
+					Usage: "Build a template file from fully edited and pre-edited sequences",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "full", Usage: "Path to fully edited sequence in FASTA format"},
+						&cli.StringFlag{Name: "pre", Usage: "Path to pre-edited sequence in FASTA format"},
+						&cli.StringSliceFlag{Name: "alt", Value: &cli.StringSlice{}, Usage: "Path to alt edited sequences in FASTA format with alt_start= and alt_stop= in the header"},
+						&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base(s). e.g. T or TC for multi-base editing"},
+						&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+						&cli.IntFlag{Name: "context", Value: 10, Usage: "Number of bases to show around mismatches"},
+						&cli.StringFlag{Name: "output, o", Usage: "Output template file"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateBuild(&BuildOptions{
+							Gene:       c.Parent().String("gene"),
+							FullPath:   c.String("full"),
+							PrePath:    c.String("pre"),
+							AltPaths:   c.StringSlice("alt"),
+							EditBase:   c.String("base"),
+							EditOffset: c.Int("offset"),
+							Context:    c.Int("context"),
+							Output:     c.String("output"),
+						})
+					},
+				},
+				{
+					Name:  "set",
+					Usage: "Set a new template version",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "template, t", Usage: "Path to templates file in FASTA format"},
+						&cli.StringFlag{Name: "base, b", Value: "T", Usage: "Edit base(s). e.g. T or TC for multi-base editing"},
+						&cli.IntFlag{Name: "offset", Value: 0, Usage: "Edit site offset"},
+					},
+					Action: func(c *cli.Context) {
+						TemplateSet(c.GlobalString("db"), &TemplateOptions{
+							Gene:         c.Parent().String("gene"),
+							TemplatePath: c.String("template"),
+							EditBase:     c.String("base"),
+							EditOffset:   c.Int("offset"),
+						})
+					},
+				},
 			},
 		},
 		{
@@ -144,10 +450,23 @@ func main() {
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "gene, g", Usage: "Filter by gene"},
 				&cli.BoolFlag{Name: "unique, u", Usage: "Use unique fragment counts only"},
+				&cli.BoolFlag{Name: "molecules, m", Usage: "Use unique molecule counts of reads loaded with UMIs"},
 				&cli.BoolFlag{Name: "norm, n", Usage: "Use normalized fragment counts only"},
 			},
 			Action: func(c *cli.Context) {
-				ShowStats(c.GlobalString("db"), c.String("gene"), c.Bool("unique"), c.Bool("norm"))
+				ShowStats(c.GlobalString("db"), c.String("gene"), c.Bool("unique"), c.Bool("molecules"), c.Bool("norm"))
+			},
+		},
+		{
+			Name:  "qc",
+			Usage: "Print read quality control report of samples",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "gene, g", Usage: "Gene name"},
+				&cli.StringFlag{Name: "sample, s", Usage: "Sample name (all by default)"},
+				&cli.BoolFlag{Name: "json", Usage: "Output in JSON"},
+			},
+			Action: func(c *cli.Context) {
+				QC(c.GlobalString("db"), c.String("gene"), c.String("sample"), c.Bool("json"))
 			},
 		},
 		{
@@ -155,10 +474,35 @@ func main() {
 			Usage: "Normalize read counts",
 			Flags: []cli.Flag{
 				&cli.StringFlag{Name: "gene, g", Usage: "Gene name (all by default)"},
-				&cli.Float64Flag{Name: "normalize, n", Value: float64(0), Usage: "Normalize to read count"},
+				&cli.StringFlag{Name: "method, m", Value: NORM_TOTAL, Usage: "Normalization method (" + strings.Join(NormMethods, ", ") + ")"},
+				&cli.Float64Flag{Name: "normalize, n", Value: float64(0), Usage: "Normalize to target value (defaults to mean across samples)"},
+				&cli.IntFlag{Name: "ref-site", Value: -1, Usage: "Reference edit stop site for ref-site normalization"},
+				&cli.StringFlag{Name: "spike-in", Usage: "Spike-in gene for spike-in normalization"},
+				&cli.BoolFlag{Name: "mutant", Usage: "Also normalize mutant reads"},
+				&cli.BoolFlag{Name: "molecules", Usage: "Normalize unique molecule counts of reads loaded with UMIs"},
+				&cli.StringFlag{Name: "name", Value: NORM_DEFAULT_SET, Usage: "Name of normalization set"},
+				&cli.StringFlag{Name: "rollback", Usage: "Restore a previous normalization set by name"},
+				&cli.BoolFlag{Name: "list, l", Usage: "List normalization sets and log"},
 			},
 			Action: func(c *cli.Context) {
-				Normalize(c.GlobalString("db"), c.String("gene"), c.Float64("normalize"))
+				if c.Bool("list") {
+					NormList(c.GlobalString("db"), c.String("gene"))
+					return
+				}
+				if c.IsSet("rollback") {
+					NormRollback(c.GlobalString("db"), c.String("gene"), c.String("rollback"))
+					return
+				}
+				Normalize(c.GlobalString("db"), &NormOptions{
+					Name:      c.String("name"),
+					Gene:      c.String("gene"),
+					Method:    c.String("method"),
+					Target:    c.Float64("normalize"),
+					RefSite:   c.Int("ref-site"),
+					SpikeIn:   c.String("spike-in"),
+					Mutant:    c.Bool("mutant"),
+					Molecules: c.Bool("molecules"),
+				})
 			},
 		},
 		{
@@ -171,11 +515,16 @@ func main() {
 				&cli.IntFlag{Name: "junc-end", Value: -1, Usage: "Junction end"},
 				&cli.IntFlag{Name: "junc-len", Value: -1, Usage: "Junction len"},
 				&cli.IntFlag{Name: "alt", Value: 0, Usage: "Alt editing region"},
+				&cli.StringFlag{Name: "alt-name", Usage: "Alt editing template name"},
 				&cli.IntFlag{Name: "offset,o", Value: 0, Usage: "offset"},
 				&cli.IntFlag{Name: "limit,l", Value: 0, Usage: "limit"},
 				&cli.BoolFlag{Name: "has-mutation", Usage: "Has mutation"},
 				&cli.BoolFlag{Name: "all,a", Usage: "Include all sequences"},
 				&cli.BoolFlag{Name: "has-alt", Usage: "Has Alternative Editing"},
+				&cli.BoolFlag{Name: "no-primer", Usage: "Only reads lacking the 5' or 3' primer"},
+				&cli.IntFlag{Name: "mutation-at", Value: -1, Usage: "Only reads with a mutation at the edit site. Implies --all"},
+				&cli.IntFlag{Name: "min-chimera", Usage: "Only reads with a chimera score of at least n"},
+				&cli.StringFlag{Name: "norm-set", Usage: "Use normalized counts from named normalization set"},
 				&cli.BoolFlag{Name: "csv", Usage: "Output in csv format"},
 				&cli.BoolFlag{Name: "fasta", Usage: "Output in fasta format"},
 				&cli.BoolFlag{Name: "no-header, x", Usage: "Exclude header from output"},
@@ -190,9 +539,14 @@ func main() {
 					Offset:      c.Int("offset"),
 					Limit:       c.Int("limit"),
 					AltRegion:   c.Int("alt"),
+					AltName:     c.String("alt-name"),
 					HasMutation: c.Bool("has-mutation"),
 					HasAlt:      c.Bool("has-alt"),
-					All:         c.Bool("all"),
+					NoPrimer:    c.Bool("no-primer"),
+					MutationAt:  c.Int("mutation-at"),
+					MinChimera:  c.Int("min-chimera"),
+					All:         c.Bool("all") || c.Int("mutation-at") >= 0,
+					NormSet:     c.String("norm-set"),
 				}, c.Bool("csv"), c.Bool("no-header"), c.Bool("fasta"))
 			},
 		}}
@@ -18,49 +18,143 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
 )
 
-// DbContext sets the database context for the request
-func DbContext(app *Application) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
-
-		// Allow url to override cookie (useful for sending links)
-		dbname := r.URL.Query().Get("db")
-		if len(dbname) == 0 {
-			n := session.Values[TREAT_COOKIE_DB]
-			if n != nil {
-				dbname = n.(string)
+// DbContext sets the database context for the request. Only databases the
+// user is allowed to read are considered.
+func DbContext(app *Application) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/login" || r.URL.Path == "/logout" || strings.HasPrefix(r.URL.Path, "/static/") {
+				next.ServeHTTP(w, r)
+				return
 			}
-		}
-
-		// If neither cookie or url is set the use default
-		if len(dbname) == 0 {
-			dbname = app.defaultDb
-		}
-
-		db, err := app.GetDb(dbname)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"dbname": dbname,
-			}).Warn("Invalid database name. Using default")
-			dbname = app.defaultDb
-			db, _ = app.GetDb(app.defaultDb)
-		}
-
-		session.Values[TREAT_COOKIE_DB] = dbname
-		err = session.Save(r, w)
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"dbname": dbname,
-				"error":  err.Error(),
-			}).Error("Failed to set save session")
-		}
-
-		context.Set(r, "db", db)
-	})
+
+			user := app.GetUserFromContext(r)
+			session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+
+			// Allow url to override cookie (useful for sending links)
+			dbname := r.URL.Query().Get("db")
+			if len(dbname) == 0 {
+				n := session.Values[TREAT_COOKIE_DB]
+				if n != nil {
+					dbname = n.(string)
+				}
+			}
+
+			// If neither cookie or url is set the use default
+			if len(dbname) == 0 {
+				dbname = app.DefaultDb(user)
+			}
+
+			db, err := app.GetDb(dbname)
+			if err == nil && !app.CanAccess(user, dbname, PERM_READ) {
+				logrus.WithFields(logrus.Fields{
+					"dbname": dbname,
+					"user":   userName(user),
+				}).Warn("User does not have access to database")
+				err = fmt.Errorf("Access denied")
+			}
+
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"dbname": dbname,
+				}).Warn("Invalid database name. Using default")
+				dbname = app.DefaultDb(user)
+				db, err = app.GetDb(dbname)
+			}
+
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"user": userName(user),
+					"path": r.URL.Path,
+				}).Warn("User does not have access to any databases")
+				if strings.HasPrefix(r.URL.Path, "/data/") {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+				} else {
+					w.WriteHeader(http.StatusForbidden)
+					renderTemplate(app, "403.html", w, nil)
+				}
+				return
+			}
+
+			session.Values[TREAT_COOKIE_DB] = dbname
+			err = session.Save(r, w)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"dbname": dbname,
+					"error":  err.Error(),
+				}).Error("Failed to set save session")
+			}
+
+			if db.Loading() {
+				w.Header().Set("Retry-After", "10")
+				if strings.HasPrefix(r.URL.Path, "/data/") {
+					http.Error(w, "Database is loading", http.StatusServiceUnavailable)
+				} else {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					renderTemplate(app, "loading.html", w, map[string]interface{}{
+						"dbs":   app.UserDbs(r),
+						"user":  user,
+						"curdb": db.name,
+					})
+				}
+				return
+			}
+
+			app.Audit(r, user, dbname)
+
+			context.Set(r, "db", db)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AuthRequired ensures the request is from an authenticated user. This
+// applies to all handlers except the login page and static files.
+func AuthRequired(app *Application) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if app.auth == nil || r.URL.Path == "/login" || strings.HasPrefix(r.URL.Path, "/static/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var user *User
+			proxy, isProxy := app.auth.(*ProxyAuth)
+			if isProxy {
+				user = proxy.UserFromRequest(r)
+			} else {
+				session, _ := app.cookieStore.Get(r, TREAT_COOKIE_SESSION)
+				if name, ok := session.Values[TREAT_COOKIE_USER].(string); ok {
+					user, _ = app.auth.Lookup(name)
+				}
+			}
+
+			if user == nil {
+				logrus.WithFields(logrus.Fields{
+					"path":   r.URL.Path,
+					"remote": r.RemoteAddr,
+				}).Info("Unauthenticated request")
+
+				if isProxy || strings.HasPrefix(r.URL.Path, "/data/") {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), 302)
+				return
+			}
+
+			context.Set(r, "user", user)
+			next.ServeHTTP(w, r)
+		})
+	}
 }
@@ -18,94 +18,190 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"sort"
-	"strings"
+	"path/filepath"
+	"strconv"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/aebruno/gofasta"
-	"github.com/aebruno/nwalgo"
 	"github.com/ubccr/treat"
 )
 
-// From: https://groups.google.com/d/msg/golang-nuts/FT7cjmcL7gw/Gj4_aEsE_IsJ
-type Pair struct {
-	Key   string
-	Value int
+const (
+	FORMAT_TSV  = "tsv"
+	FORMAT_JSON = "json"
+	FORMAT_VCF  = "vcf"
+)
+
+type MutantOptions struct {
+	AlignOptions
+	Fragments []string
+	Format    string
+	MinFreq   float64
+	MinReads  uint64
 }
 
-type PairList []Pair
+// variantFilter returns the VCF filter of the variant
+func variantFilter(v *treat.Variant) string {
+	if v.Homopolymer {
+		return "homopolymer"
+	}
 
-func (p PairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-func (p PairList) Len() int           { return len(p) }
-func (p PairList) Less(i, j int) bool { return p[i].Value > p[j].Value }
+	return "PASS"
+}
 
-func sortMapByValue(m map[string]int) PairList {
-	p := make(PairList, len(m))
-	i := 0
-	for k, v := range m {
-		p[i] = Pair{k, v}
-		i++
+func writeVariantsTSV(w io.Writer, variants []*treat.Variant) error {
+	out := csv.NewWriter(w)
+	out.Comma = '\t'
+	out.Write([]string{"site", "pos", "type", "ref", "alt", "reads", "frequency", "filter"})
+	for _, v := range variants {
+		out.Write([]string{
+			strconv.Itoa(v.Site),
+			strconv.Itoa(v.Pos),
+			v.Type.String(),
+			v.Ref,
+			v.Alt,
+			strconv.FormatUint(v.Reads, 10),
+			fmt.Sprintf("%.6f", v.Frequency),
+			variantFilter(v)})
 	}
-	sort.Sort(p)
-	return p
+	out.Flush()
+
+	return out.Error()
 }
 
-func Mutant(options *AlignOptions, fragments []string, n int) {
+func writeVariantsJSON(w io.Writer, gene string, report *treat.VariantReport, variants []*treat.Variant) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{
+		"gene":     gene,
+		"reads":    report.Total,
+		"variants": variants,
+	})
+}
+
+func writeVariantsVCF(w io.Writer, gene string, tmpl *treat.Template, report *treat.VariantReport, variants []*treat.Variant) error {
+	header := []string{
+		"##fileformat=VCFv4.2",
+		"##source=treat",
+		fmt.Sprintf("##contig=<ID=%s,length=%d>", gene, len(tmpl.String())),
+		"##INFO=<ID=SITE,Number=1,Type=Integer,Description=\"Edit site\">",
+		"##INFO=<ID=TYPE,Number=1,Type=String,Description=\"Mutation type of the non-edit bases (SUB, INS or DEL)\">",
+		"##INFO=<ID=RC,Number=1,Type=Integer,Description=\"Reads with the variant\">",
+		"##INFO=<ID=DP,Number=1,Type=Integer,Description=\"Total reads\">",
+		"##INFO=<ID=AF,Number=A,Type=Float,Description=\"Frequency of the variant\">",
+		fmt.Sprintf("##FILTER=<ID=homopolymer,Description=\"Indel in a run of at least %d of the same base. Likely sequencing error\">", treat.MIN_HOMOPOLYMER),
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO",
+	}
+	for _, h := range header {
+		_, err := fmt.Fprintln(w, h)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, v := range variants {
+		pos, ref, alt := report.VCF(v)
+		_, err := fmt.Fprintf(w, "%s\t%d\t.\t%s\t%s\t.\t%s\tSITE=%d;TYPE=%s;RC=%d;DP=%d;AF=%.6f\n",
+			gene, pos, ref, alt, variantFilter(v), v.Site, v.Type, v.Reads, report.Total, v.Frequency)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mutant reports the substitutions and indels of the non-edit bases of the
+// reads in the fragment files by template position. Reads are weighted by
+// the read count in the FASTA header.
+func Mutant(options *MutantOptions) {
 	if len(options.TemplatePath) == 0 {
 		logrus.Fatal("Please provide path to templates file")
 	}
-	if len(fragments) == 0 {
+	if len(options.Fragments) == 0 {
 		logrus.Fatal("Please provide path to fragment file")
 	}
-	if len(options.EditBase) != 1 {
-		logrus.Fatal("Please provide the edit base")
+	if options.Format != FORMAT_TSV && options.Format != FORMAT_JSON && options.Format != FORMAT_VCF {
+		logrus.Fatalf("Invalid format %s. Must be one of tsv, json or vcf", options.Format)
+	}
+	bases, err := treat.ParseEditBases(options.EditBase)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	options.EditBase = bases
+
+	orientation, err := treat.ParseOrientation(options.Orientation)
+	if err != nil {
+		logrus.Fatal(err)
 	}
 
-	tmpl, err := treat.NewTemplateFromFasta(options.TemplatePath, treat.FORWARD, rune(options.EditBase[0]))
+	counts, err := treat.NewCountParser(options.CountFormat, options.CountPattern)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	tm := make(map[string]int)
-	fm := make(map[string]int)
-	for _, path := range fragments {
+	tmpl, err := treat.NewTemplateFromFastaBases(options.TemplatePath, treat.FORWARD, options.EditBase)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	options.EditBase = tmpl.EditBaseSet()
+
+	if options.EditOffset > 0 {
+		tmpl.SetOffset(options.EditOffset)
+	}
+
+	err = setPrimers(tmpl, options.Primer5, options.Primer3)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	gene := tmpl.Gene
+	if len(gene) == 0 {
+		gene = filepath.Base(options.TemplatePath)
+		gene = cleanName(gene[:len(gene)-len(filepath.Ext(gene))])
+	}
+
+	report := treat.NewVariantReport(tmpl)
+	for _, path := range options.Fragments {
 		f, err := os.Open(path)
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		defer f.Close()
 
+		sample := filepath.Base(path)
+		sample = sample[:len(sample)-len(filepath.Ext(sample))]
 		for rec := range gofasta.SimpleParser(f) {
-			frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, rune(options.EditBase[0]))
-			aln1, aln2, _ := nwalgo.Align(tmpl.Bases, frag.Bases, 1, -1, -1)
-			if strings.Index(aln1, "-") != -1 {
-				tm[aln1]++
-			}
-			if strings.Index(aln2, "-") != -1 {
-				fm[aln2]++
+			frag, _ := treat.NewFragmentOriented(rec.Id, rec.Seq, orientation, options.EditBase, tmpl)
+			frag.ReadCount = parseReadCount(counts, rec.Id)
+			if tmpl.HasPrimers() {
+				frag, _ = tmpl.TrimPrimers(frag, options.PrimerMismatch)
 			}
+			report.Add(sample, treat.NewAlignmentPolicy(frag, tmpl, options.Policy))
 		}
+		f.Close()
 	}
 
-	fmt.Println("Template Indels")
-	count := 0
-	for _, p := range sortMapByValue(tm) {
-		fmt.Printf("%d: %s\n", p.Value, p.Key)
-		count++
-		if count > n {
-			break
+	variants := make([]*treat.Variant, 0)
+	for _, v := range report.Variants() {
+		if v.Reads >= options.MinReads && v.Frequency >= options.MinFreq {
+			variants = append(variants, v)
 		}
 	}
 
-	fmt.Println("\nFragment Indels")
-	count = 0
-	for _, p := range sortMapByValue(fm) {
-		fmt.Printf("%d: %s\n", p.Value, p.Key)
-		count++
-		if count > n {
-			break
-		}
+	switch options.Format {
+	case FORMAT_JSON:
+		err = writeVariantsJSON(os.Stdout, gene, report, variants)
+	case FORMAT_VCF:
+		err = writeVariantsVCF(os.Stdout, gene, tmpl, report, variants)
+	default:
+		err = writeVariantsTSV(os.Stdout, variants)
+	}
+	if err != nil {
+		logrus.Fatal(err)
 	}
 }
@@ -18,11 +18,329 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/ubccr/treat"
 )
 
-func Normalize(dbpath, gene string, norm float64) {
+const (
+	NORM_TOTAL          = "total"
+	NORM_UPPER_QUARTILE = "upper-quartile"
+	NORM_MEDIAN_RATIO   = "median-ratio"
+	NORM_SPIKE_IN       = "spike-in"
+	NORM_REF_SITE       = "ref-site"
+	NORM_CONDITION      = "condition"
+)
+
+var NormMethods = []string{
+	NORM_TOTAL,
+	NORM_UPPER_QUARTILE,
+	NORM_MEDIAN_RATIO,
+	NORM_SPIKE_IN,
+	NORM_REF_SITE,
+	NORM_CONDITION,
+}
+
+const NORM_DEFAULT_SET = "default"
+
+type NormOptions struct {
+	Name      string
+	Gene      string
+	Method    string
+	Target    float64
+	RefSite   int
+	SpikeIn   string
+	Mutant    bool
+	Molecules bool
+}
+
+// NormMeta records how the read counts of a gene were normalized. Each
+// normalization run is stored as a named set. The normalized counts stored in
+// the alignments are those of the active set.
+type NormMeta struct {
+	Name      string             `json:"name"`
+	Gene      string             `json:"gene"`
+	Method    string             `json:"method"`
+	Target    float64            `json:"target"`
+	RefSite   int                `json:"ref_site,omitempty"`
+	SpikeIn   string             `json:"spike_in,omitempty"`
+	Mutant    bool               `json:"mutant"`
+	Molecules bool               `json:"molecules,omitempty"`
+	Scale     map[string]float64 `json:"scale"`
+	Created   time.Time          `json:"created"`
+}
+
+// NormLogEntry records a normalization run or rollback
+type NormLogEntry struct {
+	Id     uint64    `json:"id"`
+	Action string    `json:"action"`
+	Date   time.Time `json:"date"`
+	Set    *NormMeta `json:"set"`
+}
+
+// NormCount returns the normalized read count of the alignment in the sample
+// under this normalization set. Samples not normalized in this set have a
+// normalized count of 0.
+func (m *NormMeta) NormCount(sample string, a *treat.Alignment) float64 {
+	if a.HasMutation == uint8(1) && !m.Mutant {
+		return 0
+	}
+
+	return m.Scale[sample] * readCount(a, m.Molecules)
+}
+
+// readCount returns the raw read count of the alignment or, if molecules is
+// true, the number of unique molecules
+func readCount(a *treat.Alignment, molecules bool) float64 {
+	if molecules {
+		return float64(a.MoleculeCount())
+	}
+
+	return float64(a.ReadCount)
+}
+
+// Description returns a short human readable summary of the normalization
+// method and parameters
+func (m *NormMeta) Description() string {
+	desc := m.Method
+	switch m.Method {
+	case NORM_REF_SITE:
+		desc += fmt.Sprintf(" (edit stop %d)", m.RefSite)
+	case NORM_SPIKE_IN:
+		desc += fmt.Sprintf(" (%s)", m.SpikeIn)
+	}
+
+	if m.Method != NORM_MEDIAN_RATIO && m.Method != NORM_CONDITION {
+		desc += fmt.Sprintf(" target=%.4f", m.Target)
+	}
+
+	if m.Mutant {
+		desc += ", including mutant reads"
+	}
+	if m.Molecules {
+		desc += ", molecule counts"
+	}
+
+	return desc
+}
+
+// sampleNorm holds the per sample statistic used to compute scaling factors
+type sampleNorm struct {
+	key    *treat.AlignmentKey
+	counts map[int]float64
+	stat   float64
+}
+
+func total(counts map[int]float64) float64 {
+	sum := float64(0)
+	for _, c := range counts {
+		sum += c
+	}
+
+	return sum
+}
+
+func median(vals []float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+
+	sort.Float64s(vals)
+	n := len(vals)
+	if n%2 == 0 {
+		return (vals[n/2-1] + vals[n/2]) / 2
+	}
+
+	return vals[n/2]
+}
+
+// upperQuartile returns the 75th percentile of the non-zero counts
+func upperQuartile(counts map[int]float64) float64 {
+	vals := make([]float64, 0, len(counts))
+	for _, c := range counts {
+		if c > 0 {
+			vals = append(vals, c)
+		}
+	}
+
+	if len(vals) == 0 {
+		return 0
+	}
+
+	sort.Float64s(vals)
+	return vals[int(math.Ceil(0.75*float64(len(vals))))-1]
+}
+
+// medianRatios computes DESeq style size factors. For each edit stop site
+// with reads in every sample the ratio of the count to the geometric mean
+// across samples is computed. The size factor is the median of these ratios.
+func medianRatios(samples []*sampleNorm) {
+	sites := make(map[int]bool)
+	for _, s := range samples {
+		for es := range s.counts {
+			sites[es] = true
+		}
+	}
+
+	logGeoMean := make(map[int]float64)
+	for es := range sites {
+		sum := float64(0)
+		ok := true
+		for _, s := range samples {
+			if s.counts[es] <= 0 {
+				ok = false
+				break
+			}
+			sum += math.Log(s.counts[es])
+		}
+		if ok {
+			logGeoMean[es] = sum / float64(len(samples))
+		}
+	}
+
+	if len(logGeoMean) == 0 {
+		logrus.Warn("No edit stop sites with reads in all samples. Can't compute median of ratios")
+	}
+
+	for _, s := range samples {
+		ratios := make([]float64, 0, len(logGeoMean))
+		for es, lgm := range logGeoMean {
+			ratios = append(ratios, math.Exp(math.Log(s.counts[es])-lgm))
+		}
+		s.stat = median(ratios)
+	}
+}
+
+func condition(k *treat.AlignmentKey) string {
+	return fmt.Sprintf("%s;%t", k.KnockDown, k.Tetracycline)
+}
+
+// computeScale returns the scaling factor for each sample in the gene
+func computeScale(s *Storage, gene string, options *NormOptions) (map[string]float64, float64, error) {
+	keys, err := s.SampleKeys(gene)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(keys) == 0 {
+		return nil, 0, fmt.Errorf("No samples found for gene %s", gene)
+	}
+
+	samples := make([]*sampleNorm, 0, len(keys))
+	for _, k := range keys {
+		counts, err := s.EditStopCounts(k, options.Molecules)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		samples = append(samples, &sampleNorm{key: k, counts: counts})
+	}
+
+	switch options.Method {
+	case NORM_TOTAL, NORM_CONDITION:
+		for _, sn := range samples {
+			sn.stat = total(sn.counts)
+		}
+	case NORM_UPPER_QUARTILE:
+		for _, sn := range samples {
+			sn.stat = upperQuartile(sn.counts)
+		}
+	case NORM_REF_SITE:
+		for _, sn := range samples {
+			sn.stat = sn.counts[options.RefSite]
+		}
+	case NORM_SPIKE_IN:
+		for _, sn := range samples {
+			skey, err := s.GetKey(options.SpikeIn, sn.key.Sample)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Spike-in gene %s missing sample %s: %s", options.SpikeIn, sn.key.Sample, err)
+			}
+			counts, err := s.EditStopCounts(skey, options.Molecules)
+			if err != nil {
+				return nil, 0, err
+			}
+			sn.stat = total(counts)
+		}
+	case NORM_MEDIAN_RATIO:
+		medianRatios(samples)
+	default:
+		return nil, 0, fmt.Errorf("Invalid normalization method: %s", options.Method)
+	}
+
+	// Compute targets. Default is the mean across all samples or, for
+	// per-condition normalization, across samples with the same knock down
+	// and tetracycline status
+	target := options.Target
+	targets := make(map[string]float64)
+	if options.Method == NORM_MEDIAN_RATIO {
+		target = 1
+	} else if options.Method == NORM_CONDITION {
+		sums := make(map[string]float64)
+		n := make(map[string]int)
+		for _, sn := range samples {
+			sums[condition(sn.key)] += sn.stat
+			n[condition(sn.key)]++
+		}
+		for c, sum := range sums {
+			targets[c] = sum / float64(n[c])
+			logrus.Printf("Normalizing condition %s to read count: %.4f", c, targets[c])
+		}
+	} else if target == 0 {
+		sum := float64(0)
+		for _, sn := range samples {
+			sum += sn.stat
+		}
+		target = sum / float64(len(samples))
+		logrus.Printf("Using mean across all samples as normalization target: %.4f", target)
+	}
+
+	scale := make(map[string]float64)
+	for _, sn := range samples {
+		t := target
+		if options.Method == NORM_CONDITION {
+			t = targets[condition(sn.key)]
+		}
+
+		scale[sn.key.Sample] = 1.0
+		if sn.stat > 0 {
+			scale[sn.key.Sample] = t / sn.stat
+		} else {
+			logrus.Warnf("Sample %s has no reads for %s normalization. Using scaling factor of 1", sn.key.Sample, options.Method)
+		}
+	}
+
+	return scale, target, nil
+}
+
+func Normalize(dbpath string, options *NormOptions) {
+	if len(options.Method) == 0 {
+		options.Method = NORM_TOTAL
+	}
+	if len(options.Name) == 0 {
+		options.Name = NORM_DEFAULT_SET
+	}
+
+	valid := false
+	for _, m := range NormMethods {
+		if m == options.Method {
+			valid = true
+		}
+	}
+	if !valid {
+		logrus.Fatalf("Invalid normalization method %s. Must be one of: %s", options.Method, strings.Join(NormMethods, ", "))
+	}
+	if options.Method == NORM_SPIKE_IN && len(options.SpikeIn) == 0 {
+		logrus.Fatal("Please provide the spike-in gene")
+	}
+	if options.Method == NORM_REF_SITE && options.RefSite < 0 {
+		logrus.Fatal("Please provide the reference edit stop site")
+	}
+
 	s, err := NewStorageWrite(dbpath)
 	if err != nil {
 		logrus.Fatal(err)
@@ -34,40 +352,188 @@ func Normalize(dbpath, gene string, norm float64) {
 	}
 
 	for _, g := range genes {
-		if len(gene) > 0 && g != gene {
+		if len(options.Gene) > 0 && g != options.Gene {
 			continue
 		}
-		logrus.Printf("Processing gene %s...", g)
+		if g == options.SpikeIn {
+			continue
+		}
+		logrus.Printf("Processing gene %s using %s normalization...", g, options.Method)
 
-		samples, err := s.SampleKeys(g)
+		prev, err := s.GetNormSet(g, options.Name)
 		if err != nil {
 			logrus.Fatal(err)
 		}
+		if prev != nil {
+			logrus.Warnf("Replacing normalization set %s for gene %s. Use --name to keep both", options.Name, g)
+		}
 
-		gnorm := norm
+		err = normalizeGene(s, g, options, "normalize")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+}
 
-		// Default norm to average read count
-		if gnorm == 0 {
-			logrus.Info("Using default option of normalizing to average read count across all samples")
+// normalizeGene computes the scale factors for the gene, updates the
+// normalized read counts of all samples and stores the active set
+func normalizeGene(s *Storage, gene string, options *NormOptions, action string) error {
+	scale, target, err := computeScale(s, gene, options)
+	if err != nil {
+		return err
+	}
 
-			total := 0
-			err := s.Search(&SearchFields{Gene: g, HasMutation: false, EditStop: -1, JuncLen: -1, JuncEnd: -1}, func(key *treat.AlignmentKey, a *treat.Alignment) {
-				total += int(a.ReadCount)
-			})
-			if err != nil {
-				logrus.Fatal(err)
+	samples, err := s.SampleKeys(gene)
+	if err != nil {
+		return err
+	}
+
+	for _, skey := range samples {
+		err = s.NormalizeSample(skey, scale[skey.Sample], options.Mutant, options.Molecules)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.PutNormSet(&NormMeta{
+		Name:      options.Name,
+		Gene:      gene,
+		Method:    options.Method,
+		Target:    target,
+		RefSite:   options.RefSite,
+		SpikeIn:   options.SpikeIn,
+		Mutant:    options.Mutant,
+		Molecules: options.Molecules,
+		Scale:     scale,
+		Created:   time.Now(),
+	}, action)
+}
+
+// NormRollback restores the normalized read counts of a previous named
+// normalization set and makes it the active set
+func NormRollback(dbpath, gene, name string) {
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	genes, err := s.Genes()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	found := false
+	for _, g := range genes {
+		if len(gene) > 0 && g != gene {
+			continue
+		}
+
+		meta, err := s.GetNormSet(g, name)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if meta == nil {
+			if len(gene) > 0 {
+				logrus.Fatalf("Normalization set %s not found for gene %s", name, g)
 			}
+			continue
+		}
+		found = true
 
-			gnorm = float64(total) / float64(len(samples))
-			logrus.Printf("Total standard reads across all samples: %d", total)
+		logrus.Printf("Restoring normalization set %s for gene %s...", name, g)
+		samples, err := s.SampleKeys(g)
+		if err != nil {
+			logrus.Fatal(err)
 		}
 
-		logrus.Printf("Normalizing to read count: %.4f", gnorm)
 		for _, skey := range samples {
-			err = s.NormalizeSample(skey, gnorm)
+			scale, ok := meta.Scale[skey.Sample]
+			if !ok {
+				logrus.Warnf("Sample %s was not normalized in set %s. Setting normalized counts to 0", skey.Sample, name)
+			}
+			err = s.NormalizeSample(skey, scale, meta.Mutant, meta.Molecules)
 			if err != nil {
 				logrus.Fatal(err)
 			}
 		}
+
+		err = s.PutNormSet(meta, "rollback")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if !found {
+		logrus.Fatalf("Normalization set %s not found", name)
+	}
+}
+
+// NormList prints the normalization sets and log for each gene
+func NormList(dbpath, gene string) {
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	genes, err := s.Genes()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	for _, g := range genes {
+		if len(gene) > 0 && g != gene {
+			continue
+		}
+
+		fmt.Println(strings.Repeat("=", 80))
+		fmt.Println(g)
+		fmt.Println(strings.Repeat("=", 80))
+
+		active, err := s.GetNormMeta(g)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		sets, err := s.NormSets(g)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		for _, m := range sets {
+			mark := " "
+			if active != nil && active.Name == m.Name {
+				mark = "*"
+			}
+			fmt.Printf("%s %-15s %s\n", mark, m.Name, m.Description())
+			var samples []string
+			for sample := range m.Scale {
+				samples = append(samples, sample)
+			}
+			sort.Strings(samples)
+			for _, sample := range samples {
+				fmt.Printf("    %-20s%12.4f\n", sample, m.Scale[sample])
+			}
+		}
+
+		printNormLog(s, g)
+		fmt.Println()
+	}
+}
+
+func printNormLog(s *Storage, gene string) {
+	entries, err := s.NormLog(gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("%-6s%-18s%-11s%-15s%s\n", "Id", "Date", "Action", "Set", "Method")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, e := range entries {
+		fmt.Printf("%-6d%-18s%-11s%-15s%s\n", e.Id, e.Date.Format("2006-01-02 15:04"), e.Action, e.Set.Name, e.Set.Description())
 	}
 }
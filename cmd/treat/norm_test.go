@@ -0,0 +1,253 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/ubccr/treat"
+)
+
+// Reads of examples/simple-templates.fa and their edit stop sites
+const (
+	normFullyEdited = "CTTAATACACTTTTGATTAACAAACTTTAAA" // edit stop 19
+	normPreEdited   = "CTAATTACACTTTGATAACAAACTAAA"     // edit stop 2
+	normPartial     = "CTTAATTACACTTTGATTAACAAACTTTAAA" // edit stop 11
+	normMutant      = "CTTAATACACTTTTGATTAACAAACTTTGGG"
+)
+
+// loadTestReads loads a sample of the simple example templates with the
+// given read counts of each sequence
+func loadTestReads(t *testing.T, s *Storage, gene, sample, kd string, reads map[string]int) {
+	options := putTestTemplate(t, s, gene, sample, "simple-templates.fa")
+	options.KnockDown = kd
+
+	var buf bytes.Buffer
+	i := 0
+	for seq, count := range reads {
+		if count == 0 {
+			continue
+		}
+		fmt.Fprintf(&buf, ">%s%d-%d\n%s\n", sample, i, count, seq)
+		i++
+	}
+
+	path := filepath.Join(filepath.Dir(s.DB.Path()), sample+"-"+gene+".fa")
+	err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	_, err = s.ImportSample(path, options)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+// loadNormSamples loads 3 samples of gene G with 60, 120 and 120 standard
+// reads. Samples s1 and s2 share knock down kd1.
+func loadNormSamples(t *testing.T, s *Storage) {
+	loadTestReads(t, s, "G", "s1", "kd1", map[string]int{normFullyEdited: 10, normPreEdited: 30, normPartial: 20, normMutant: 7})
+	loadTestReads(t, s, "G", "s2", "kd1", map[string]int{normFullyEdited: 20, normPreEdited: 60, normPartial: 40, normMutant: 7})
+	loadTestReads(t, s, "G", "s3", "kd2", map[string]int{normFullyEdited: 30, normPreEdited: 90, normMutant: 7})
+}
+
+// normCounts returns the normalized counts of the gene by sample and edit
+// stop. Mutant reads are stored at edit stop -1.
+func normCounts(t *testing.T, s *Storage, gene string) map[string]map[int]float64 {
+	counts := make(map[string]map[int]float64)
+	err := s.Search(&SearchFields{Gene: gene, EditStop: -1, JuncEnd: -1, JuncLen: -1, MutationAt: -1, All: true}, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		if _, ok := counts[key.Sample]; !ok {
+			counts[key.Sample] = make(map[int]float64)
+		}
+		es := a.EditStop
+		if a.HasMutation == 1 {
+			es = -1
+		}
+		counts[key.Sample][es] += a.Norm
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return counts
+}
+
+func floatEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
+
+func TestNormalizeMethods(t *testing.T) {
+	tests := []struct {
+		options *NormOptions
+		target  float64
+		scale   map[string]float64
+	}{
+		{&NormOptions{Method: NORM_TOTAL}, 100, map[string]float64{"s1": 100.0 / 60, "s2": 100.0 / 120, "s3": 100.0 / 120}},
+		{&NormOptions{Method: NORM_TOTAL, Target: 1000}, 1000, map[string]float64{"s1": 1000.0 / 60, "s2": 1000.0 / 120, "s3": 1000.0 / 120}},
+		{&NormOptions{Method: NORM_UPPER_QUARTILE, Target: 100}, 100, map[string]float64{"s1": 100.0 / 30, "s2": 100.0 / 60, "s3": 100.0 / 90}},
+		// Only edit stops 19 and 2 have reads in all samples
+		{&NormOptions{Method: NORM_MEDIAN_RATIO}, 1, map[string]float64{"s1": math.Cbrt(10*20*30) / 10, "s2": math.Cbrt(10*20*30) / 20, "s3": math.Cbrt(10*20*30) / 30}},
+		{&NormOptions{Method: NORM_REF_SITE, RefSite: 19}, 20, map[string]float64{"s1": 2, "s2": 1, "s3": 20.0 / 30}},
+		{&NormOptions{Method: NORM_CONDITION}, 0, map[string]float64{"s1": 90.0 / 60, "s2": 90.0 / 120, "s3": 1}},
+		{&NormOptions{Method: NORM_SPIKE_IN, SpikeIn: "S", Target: 100}, 100, map[string]float64{"s1": 20, "s2": 10, "s3": 5}},
+	}
+
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	loadNormSamples(t, s)
+	loadTestReads(t, s, "S", "s1", "kd1", map[string]int{normFullyEdited: 5})
+	loadTestReads(t, s, "S", "s2", "kd1", map[string]int{normFullyEdited: 10})
+	loadTestReads(t, s, "S", "s3", "kd2", map[string]int{normFullyEdited: 20})
+
+	preEdited := map[string]float64{"s1": 30, "s2": 60, "s3": 90}
+
+	for _, test := range tests {
+		test.options.Name = test.options.Method
+		err := normalizeGene(s, "G", test.options, "normalize")
+		if err != nil {
+			t.Errorf("%s: %s", test.options.Method, err)
+			continue
+		}
+
+		meta, err := s.GetNormMeta("G")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if meta == nil || meta.Name != test.options.Method || meta.Method != test.options.Method {
+			t.Errorf("%s: wrong active normalization set %#v", test.options.Method, meta)
+			continue
+		}
+		if !floatEqual(meta.Target, test.target) {
+			t.Errorf("%s: wrong target %.4f != %.4f", test.options.Method, meta.Target, test.target)
+		}
+		if meta.RefSite != test.options.RefSite || meta.SpikeIn != test.options.SpikeIn || meta.Mutant {
+			t.Errorf("%s: options not stored %#v", test.options.Method, meta)
+		}
+
+		counts := normCounts(t, s, "G")
+		for sample, scale := range test.scale {
+			// Pre-edited reads at edit stop 2
+			if !floatEqual(meta.Scale[sample], scale) {
+				t.Errorf("%s: wrong scaling factor for sample %s %.4f != %.4f", test.options.Method, sample, meta.Scale[sample], scale)
+			}
+			if !floatEqual(counts[sample][2], scale*preEdited[sample]) || counts[sample][-1] != 0 {
+				t.Errorf("%s: wrong normalized counts for sample %s %v", test.options.Method, sample, counts[sample])
+			}
+		}
+	}
+
+	sets, err := s.NormSets("G")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(sets) != len(tests)-1 {
+		t.Errorf("Wrong number of normalization sets %d != %d", len(sets), len(tests)-1)
+	}
+}
+
+func TestNormalizeMutant(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	loadNormSamples(t, s)
+
+	err := normalizeGene(s, "G", &NormOptions{Name: NORM_DEFAULT_SET, Method: NORM_TOTAL, Target: 120, Mutant: true}, "normalize")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	meta, err := s.GetNormMeta("G")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if meta == nil || !meta.Mutant {
+		t.Fatalf("Mutant normalization not stored %#v", meta)
+	}
+
+	counts := normCounts(t, s, "G")
+	if !floatEqual(counts["s1"][-1], 7*2) || !floatEqual(counts["s1"][19], 10*2) {
+		t.Errorf("Wrong normalized counts with mutant reads %v", counts["s1"])
+	}
+}
+
+func TestNormalizeErrors(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	loadNormSamples(t, s)
+
+	err := normalizeGene(s, "G", &NormOptions{Name: NORM_DEFAULT_SET, Method: NORM_SPIKE_IN, SpikeIn: "missing"}, "normalize")
+	if err == nil {
+		t.Errorf("Normalizing with missing spike-in gene should fail")
+	}
+
+	err = normalizeGene(s, "G", &NormOptions{Name: NORM_DEFAULT_SET, Method: "bogus"}, "normalize")
+	if err == nil {
+		t.Errorf("Normalizing with invalid method should fail")
+	}
+
+	meta, err := s.GetNormMeta("G")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if meta != nil {
+		t.Errorf("Failed normalization should not be stored %#v", meta)
+	}
+
+	// Samples without reads at the reference site keep their read counts
+	err = normalizeGene(s, "G", &NormOptions{Name: NORM_DEFAULT_SET, Method: NORM_REF_SITE, RefSite: 5}, "normalize")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	meta, err = s.GetNormMeta("G")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, sample := range []string{"s1", "s2", "s3"} {
+		if meta.Scale[sample] != 1 {
+			t.Errorf("Wrong scaling factor for sample %s without reads at reference site %.4f != 1", sample, meta.Scale[sample])
+		}
+	}
+
+	// Samples with only mutant reads have no counts to normalize
+	loadTestReads(t, s, "M", "s1", "kd1", map[string]int{normMutant: 5})
+	loadTestReads(t, s, "M", "s2", "kd1", map[string]int{normMutant: 9})
+	err = normalizeGene(s, "M", &NormOptions{Name: NORM_DEFAULT_SET, Method: NORM_TOTAL}, "normalize")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	meta, err = s.GetNormMeta("M")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if meta.Target != 0 || meta.Scale["s1"] != 1 || meta.Scale["s2"] != 1 {
+		t.Errorf("Wrong normalization of all zero counts %#v", meta)
+	}
+
+	err = normalizeGene(s, "missing", &NormOptions{Name: NORM_DEFAULT_SET, Method: NORM_TOTAL}, "normalize")
+	if err == nil {
+		t.Errorf("Normalizing gene without samples should fail")
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aebruno/gofasta"
+	"github.com/ubccr/treat"
+)
+
+// PairOptions are the paired-end FASTQ files to merge
+type PairOptions struct {
+	R1Path      string
+	R2Path      string
+	MinOverlap  int
+	MaxMismatch float64
+}
+
+func (o *PairOptions) IsPaired() bool {
+	return len(o.R1Path) > 0 || len(o.R2Path) > 0
+}
+
+func (o *PairOptions) validate() error {
+	if len(o.R1Path) == 0 || len(o.R2Path) == 0 {
+		return fmt.Errorf("Please provide both R1 and R2 FASTQ files")
+	}
+	if o.MinOverlap < 1 {
+		return fmt.Errorf("Invalid minimum overlap %d", o.MinOverlap)
+	}
+	if o.MaxMismatch < 0 || o.MaxMismatch > 1 {
+		return fmt.Errorf("Invalid max mismatch rate %.2f. Must be between 0 and 1", o.MaxMismatch)
+	}
+
+	return nil
+}
+
+// pairId returns the read id shared by both reads of a pair
+func pairId(id string) string {
+	id = strings.SplitN(id, " ", 2)[0]
+	if strings.HasSuffix(id, "/1") || strings.HasSuffix(id, "/2") {
+		id = id[:len(id)-2]
+	}
+
+	return id
+}
+
+// mergePairs merges the reads in the R1 and R2 FASTQ files and calls f with
+// each merged read. Unmerged pairs are skipped.
+func mergePairs(options *PairOptions, f func(rec *gofasta.SeqRecord) error) (*treat.MergeStats, error) {
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	f1, err := os.Open(options.R1Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f1.Close()
+
+	f2, err := os.Open(options.R2Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f2.Close()
+
+	mopts := &treat.MergeOptions{MinOverlap: options.MinOverlap, MaxMismatch: options.MaxMismatch}
+	stats := new(treat.MergeStats)
+	reader1 := treat.NewFastqReader(f1)
+	reader2 := treat.NewFastqReader(f2)
+	for {
+		r1, err1 := reader1.Read()
+		r2, err2 := reader2.Read()
+		if err1 == io.EOF && err2 == io.EOF {
+			break
+		}
+		if err1 == io.EOF || err2 == io.EOF {
+			return nil, fmt.Errorf("R1 and R2 FASTQ files have a different number of reads")
+		}
+		if err1 != nil {
+			return nil, fmt.Errorf("%s: %s", options.R1Path, err1)
+		}
+		if err2 != nil {
+			return nil, fmt.Errorf("%s: %s", options.R2Path, err2)
+		}
+
+		if pairId(r1.Id) != pairId(r2.Id) {
+			return nil, fmt.Errorf("Reads are not paired: %s != %s. R1 and R2 files must be in the same order", r1.Id, r2.Id)
+		}
+
+		rec, overlap, mismatches, staggered := treat.MergePair(r1, r2, mopts)
+		stats.Add(rec, overlap, mismatches, staggered)
+		if rec == nil {
+			continue
+		}
+
+		err := f(&gofasta.SeqRecord{Id: rec.Id, Seq: rec.Seq})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"github.com/ubccr/treat"
+	"github.com/urfave/cli"
+)
+
+// policyFlags are the command line flags of the mutation policy
+var policyFlags = []cli.Flag{
+	&cli.IntFlag{Name: "max-snps", Value: treat.DEFAULT_MAX_MISMATCHES, Usage: "Maximum mismatches before a fragment is a mutant"},
+	&cli.BoolFlag{Name: "exclude-snps", Usage: "Exclude fragments containing SNPs. Same as --max-snps 0"},
+	&cli.IntFlag{Name: "ignore-ends", Usage: "Ignore mismatches within n bases of the fragment ends"},
+	&cli.BoolFlag{Name: "ignore-n", Usage: "Ignore mismatches with an N in the fragment"},
+	&cli.BoolFlag{Name: "edit-indel-mutant", Usage: "Edit sites with more or fewer edit bases than any template are mutations"},
+	&cli.IntFlag{Name: "max-switches", Value: treat.DEFAULT_MAX_SWITCHES, Usage: "Maximum switches between fully edited and pre-edited matches beyond the junction before a fragment is a chimera"},
+	&cli.BoolFlag{Name: "chimera-parents", Usage: "Flag fragments explained by two more abundant parent fragments as chimeras"},
+	&cli.Float64Flag{Name: "chimera-skew", Value: treat.DEFAULT_CHIMERA_SKEW, Usage: "Minimum abundance of chimera parents relative to the fragment"},
+}
+
+// parsePolicy returns the mutation policy set by the command line flags.
+// Returns nil if none of the flags are set.
+func parsePolicy(c *cli.Context) *treat.MutationPolicy {
+	set := false
+	for _, name := range []string{"max-snps", "exclude-snps", "ignore-ends", "ignore-n", "edit-indel-mutant", "max-switches", "chimera-parents", "chimera-skew"} {
+		if c.IsSet(name) {
+			set = true
+		}
+	}
+	if !set {
+		return nil
+	}
+
+	policy := treat.DefaultMutationPolicy()
+	policy.MaxMismatches = c.Int("max-snps")
+	if c.Bool("exclude-snps") {
+		policy.MaxMismatches = 0
+	}
+	policy.IgnoreEnds = c.Int("ignore-ends")
+	policy.IgnoreN = c.Bool("ignore-n")
+	policy.EditIndelMutant = c.Bool("edit-indel-mutant")
+	policy.MaxSwitches = c.Int("max-switches")
+	policy.ChimeraParents = c.Bool("chimera-parents")
+	policy.ChimeraSkew = c.Float64("chimera-skew")
+
+	return policy
+}
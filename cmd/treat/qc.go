@@ -0,0 +1,140 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+// SampleQC is the quality control report of a sample
+type SampleQC struct {
+	Key    *treat.AlignmentKey `json:"key"`
+	Report *treat.QCReport     `json:"report"`
+}
+
+// sampleQC returns the quality control reports of the samples of the gene.
+// Samples loaded without a report are skipped.
+func sampleQC(s *Storage, gene, sample string) ([]*SampleQC, error) {
+	keys, err := s.SampleKeys(gene)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*SampleQC, 0)
+	for _, k := range keys {
+		if len(sample) > 0 && k.Sample != sample {
+			continue
+		}
+
+		report, err := s.QCReport(k)
+		if err != nil {
+			return nil, err
+		}
+		if report == nil {
+			continue
+		}
+
+		reports = append(reports, &SampleQC{Key: k, Report: report})
+	}
+
+	return reports, nil
+}
+
+func printQC(q *SampleQC) {
+	r := q.Report
+	fmt.Println(strings.Repeat("=", 80))
+	fmt.Printf("%s %s\n", q.Key.Gene, q.Key.Sample)
+	fmt.Println(strings.Repeat("=", 80))
+
+	row := func(name string, n uint64) {
+		fmt.Printf("%-25s%12d%10.2f%%\n", name, n, r.Pct(n))
+	}
+	fmt.Printf("%-25s%12d\n", "Reads", r.Reads)
+	fmt.Printf("%-25s%12d\n", "Unique Fragments", r.Unique)
+	fmt.Printf("%-25s%12d\n", "Molecules", r.Molecules)
+	fmt.Printf("%-25s%12.1f\n", "Mean Read Length", r.MeanLength())
+	row("Mutant", r.Mutant)
+	row("Indels", r.Indel)
+	row("Mismatches", r.Mismatch)
+	row("Reverse Complemented", r.Reverse)
+	row("Missing 5' Primer", r.Primer5Missing)
+	row("Missing 3' Primer", r.Primer3Missing)
+	row("Reads with N", r.WithN)
+	fmt.Printf("%-25s%12d%10.2f%%\n", "N Bases", r.NBases, r.NPct())
+	row("Fully Edited", r.FullyEdited)
+	row("Pre-Edited", r.PreEdited)
+	row("Chimeras", r.Chimera)
+
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("%-25s%12s%11s\n", "Read Length", "Reads", "Percent")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, c := range r.LengthDist() {
+		fmt.Printf("%-25d%12d%10.2f%%\n", c.Key, c.Reads, r.Pct(c.Reads))
+	}
+
+	if len(r.MismatchProfile) > 0 {
+		fmt.Println(strings.Repeat("-", 80))
+		fmt.Printf("%-25s%12s%11s\n", "Mismatch Site", "Reads", "Percent")
+		fmt.Println(strings.Repeat("-", 80))
+		for _, c := range r.Profile() {
+			fmt.Printf("%-25d%12d%10.2f%%\n", c.Key, c.Reads, r.Pct(c.Reads))
+		}
+	}
+}
+
+// QC prints the quality control report of the reads of each sample computed
+// at load time
+func QC(dbpath, gene, sample string, asJSON bool) {
+	if len(gene) == 0 {
+		logrus.Fatal("Please provide a gene name")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	reports, err := sampleQC(s, gene, sample)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if len(reports) == 0 {
+		logrus.Fatalf("No QC reports found for gene %s. Samples must be loaded with this version of treat", gene)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(reports)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	for _, q := range reports {
+		printQC(q)
+	}
+}
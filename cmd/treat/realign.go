@@ -0,0 +1,157 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+type RealignOptions struct {
+	Gene    string
+	Samples []string
+	Output  string
+	Policy  *treat.MutationPolicy
+}
+
+// realignGene re-aligns the stored fragments of the samples of the gene
+// against the current template and re-runs the active normalization set
+func realignGene(s *Storage, options *RealignOptions) error {
+	tmpl, err := s.GetTemplate(options.Gene)
+	if err != nil {
+		return err
+	}
+
+	version, err := s.TemplateVersion(options.Gene)
+	if err != nil {
+		return err
+	}
+
+	keys, err := s.SampleKeys(options.Gene)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if k.Gene != options.Gene || (len(options.Samples) > 0 && !hasString(options.Samples, k.Sample)) {
+			continue
+		}
+
+		// Samples keep their mutation policy unless a new one is given
+		policy := options.Policy
+		if policy == nil {
+			policy, err = s.MutationPolicy(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		count, err := s.RealignSample(k, tmpl, policy)
+		if err != nil {
+			return err
+		}
+
+		err = s.SetMutationPolicy(k, policy)
+		if err != nil {
+			return err
+		}
+
+		err = s.SetSampleTemplate(k, version)
+		if err != nil {
+			return err
+		}
+
+		logrus.Printf("Re-aligned %d fragments for sample %s against template version %d", count, k.Sample, version)
+	}
+
+	active, err := s.GetNormMeta(options.Gene)
+	if err != nil {
+		return err
+	}
+
+	if active == nil {
+		return nil
+	}
+
+	logrus.Printf("Re-running normalization set %s for gene %s...", active.Name, options.Gene)
+
+	return normalizeGene(s, options.Gene, &NormOptions{
+		Name:      active.Name,
+		Gene:      options.Gene,
+		Method:    active.Method,
+		Target:    active.Target,
+		RefSite:   active.RefSite,
+		SpikeIn:   active.SpikeIn,
+		Mutant:    active.Mutant,
+		Molecules: active.Molecules,
+	}, "realign")
+}
+
+// Realign re-aligns the samples of a gene from the stored fragments against
+// the current template of the gene. If an output database is given the
+// samples are copied and re-aligned there, leaving the original untouched.
+func Realign(dbpath string, options *RealignOptions) {
+	if len(options.Gene) == 0 {
+		logrus.Fatal("Gene name is required")
+	}
+	if options.Policy != nil {
+		if err := options.Policy.Validate(); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	if len(options.Output) == 0 {
+		s, err := NewStorageWrite(dbpath)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		defer s.Close()
+
+		err = realignGene(s, options)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		return
+	}
+
+	src, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer src.Close()
+
+	dst, err := newOutputDb(options.Output)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = extractDb(src, dst, &ExtractOptions{Genes: []string{options.Gene}, Samples: options.Samples})
+	if err == nil {
+		err = realignGene(dst, options)
+	}
+	dst.Close()
+	if err != nil {
+		os.Remove(options.Output)
+		logrus.Fatal(err)
+	}
+
+	logrus.Printf("Wrote re-aligned samples to %s", options.Output)
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/ubccr/treat"
+)
+
+// SampleEdit describes changes to the metadata of a sample. Only fields with
+// the corresponding Set flag are changed.
+type SampleEdit struct {
+	Name            string
+	KnockDown       string
+	Replicate       int
+	Tetracycline    bool
+	SetKnockDown    bool
+	SetReplicate    bool
+	SetTetracycline bool
+}
+
+// Apply returns a copy of the key with the edits applied
+func (e *SampleEdit) Apply(akey *treat.AlignmentKey) *treat.AlignmentKey {
+	nkey := *akey
+	if len(e.Name) > 0 {
+		nkey.Sample = cleanName(e.Name)
+	}
+	if e.SetKnockDown {
+		nkey.KnockDown = cleanName(e.KnockDown)
+	}
+	if e.SetReplicate {
+		nkey.Replicate = e.Replicate
+	}
+	if e.SetTetracycline {
+		nkey.Tetracycline = e.Tetracycline
+	}
+
+	return &nkey
+}
+
+// findSample returns the keys for the sample in the gene, or in all genes if
+// gene is empty
+func findSample(s *Storage, gene, sample string) ([]*treat.AlignmentKey, error) {
+	if len(sample) == 0 {
+		return nil, fmt.Errorf("Please provide a sample name")
+	}
+
+	genes := []string{gene}
+	if len(gene) == 0 {
+		var err error
+		genes, err = s.Genes()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]*treat.AlignmentKey, 0)
+	for _, g := range genes {
+		skeys, err := s.SampleKeys(g)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range skeys {
+			if k.Gene == g && k.Sample == sample {
+				keys = append(keys, k)
+			}
+		}
+	}
+
+	if len(keys) == 0 {
+		if len(gene) > 0 {
+			return nil, fmt.Errorf("Sample %s not found for gene %s", sample, gene)
+		}
+		return nil, fmt.Errorf("Sample %s not found", sample)
+	}
+
+	return keys, nil
+}
+
+func removeSample(s *Storage, gene, sample string) error {
+	keys, err := findSample(s, gene, sample)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		err = s.DeleteSample(k)
+		if err != nil {
+			return err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"gene":   k.Gene,
+			"sample": k.Sample,
+		}).Info("Removed sample")
+	}
+
+	return nil
+}
+
+func updateSample(s *Storage, gene, sample string, edit *SampleEdit) error {
+	keys, err := findSample(s, gene, sample)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		nkey := edit.Apply(k)
+		err = s.UpdateSample(k, nkey)
+		if err != nil {
+			return err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"gene":       k.Gene,
+			"sample":     nkey.Sample,
+			"knock_down": nkey.KnockDown,
+			"replicate":  nkey.Replicate,
+			"tet":        nkey.Tetracycline,
+		}).Info("Updated sample")
+	}
+
+	if edit.SetKnockDown || edit.SetTetracycline {
+		logrus.Warn("Sample conditions changed. Re-run norm if using per-condition normalization")
+	}
+
+	return nil
+}
+
+func SampleRemove(dbpath, gene, sample string) {
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer s.Close()
+
+	err = removeSample(s, gene, sample)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func SampleRename(dbpath, gene, sample, name string) {
+	if len(name) == 0 {
+		logrus.Fatal("Please provide the new sample name")
+	}
+
+	SampleSet(dbpath, gene, sample, &SampleEdit{Name: name})
+}
+
+func SampleSet(dbpath, gene, sample string, edit *SampleEdit) {
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer s.Close()
+
+	err = updateSample(s, gene, sample, edit)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
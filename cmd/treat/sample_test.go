@@ -0,0 +1,179 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/ubccr/treat"
+)
+
+// sampleBuckets returns the number of entries stored under the sample key in
+// the alignments and fragments buckets and each per sample meta bucket
+func sampleBuckets(t *testing.T, s *Storage, akey *treat.AlignmentKey) map[string]int {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	found := make(map[string]int)
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{BUCKET_ALIGNMENTS, BUCKET_FRAGMENTS} {
+			if b := tx.Bucket([]byte(name)).Bucket(key); b != nil {
+				found[name] = b.Stats().KeyN
+			}
+		}
+		for _, name := range sampleMetaBuckets {
+			b := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(name))
+			if b != nil && b.Get(key) != nil {
+				found[name] = 1
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return found
+}
+
+// loadSampleMeta loads a sample and stores all per sample meta data
+func loadSampleMeta(t *testing.T, s *Storage, gene, sample string) *treat.AlignmentKey {
+	loadTestSample(t, s, gene, sample, "test-templates.fa", "test-sample.fa")
+
+	akey, err := s.GetKey(gene, sample)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	version, err := s.TemplateVersion(gene)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = s.SetSampleTemplate(akey, version)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = s.SetMutationPolicy(akey, treat.DefaultMutationPolicy())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	err = s.SetMergeStats(akey, &treat.MergeStats{Pairs: 10, Merged: 9, Unmerged: 1})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return akey
+}
+
+func TestSampleUpdate(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	akey := loadSampleMeta(t, s, "A6", "sample")
+	loadTestSample(t, s, "A6", "other", "test-templates.fa", "test-sample.fa")
+
+	before := sampleBuckets(t, s, akey)
+	for _, name := range append([]string{BUCKET_ALIGNMENTS, BUCKET_FRAGMENTS}, sampleMetaBuckets...) {
+		if before[name] == 0 {
+			t.Fatalf("Sample missing %s before update", name)
+		}
+	}
+	version, err := s.SampleTemplate(akey)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = normalizeGene(s, "A6", &NormOptions{Name: NORM_DEFAULT_SET, Method: NORM_TOTAL, Target: 100}, "normalize")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	err = updateSample(s, "A6", "sample", &SampleEdit{Name: "other"})
+	if err == nil {
+		t.Errorf("Renaming sample to existing sample name should fail")
+	}
+
+	edit := &SampleEdit{Name: "renamed", Replicate: 2, SetReplicate: true, Tetracycline: true, SetTetracycline: true}
+	err = updateSample(s, "A6", "sample", edit)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if _, err := s.GetKey("A6", "sample"); err == nil {
+		t.Errorf("Old sample key still found after rename")
+	}
+	if old := sampleBuckets(t, s, akey); len(old) != 0 {
+		t.Errorf("Data left under old sample key: %v", old)
+	}
+
+	nkey, err := s.GetKey("A6", "renamed")
+	if err != nil {
+		t.Fatalf("Renamed sample not found: %s", err)
+	}
+	if nkey.Replicate != 2 || !nkey.Tetracycline || nkey.KnockDown != akey.KnockDown {
+		t.Errorf("Wrong sample key after update: %#v", nkey)
+	}
+
+	after := sampleBuckets(t, s, nkey)
+	for name, n := range before {
+		if after[name] != n {
+			t.Errorf("Wrong number of %s entries after update %d != %d", name, after[name], n)
+		}
+	}
+
+	nversion, err := s.SampleTemplate(nkey)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if nversion != version {
+		t.Errorf("Template version not moved %d != %d", nversion, version)
+	}
+
+	stats, err := s.MergeStats(nkey)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if stats == nil || stats.Pairs != 10 {
+		t.Errorf("Merge stats not moved: %#v", stats)
+	}
+
+	meta, err := s.GetNormMeta("A6")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, ok := meta.Scale["sample"]; ok {
+		t.Errorf("Normalization set still uses old sample name")
+	}
+	if _, ok := meta.Scale["renamed"]; !ok {
+		t.Errorf("Normalization set missing renamed sample")
+	}
+
+	err = removeSample(s, "A6", "renamed")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if left := sampleBuckets(t, s, nkey); len(left) != 0 {
+		t.Errorf("Data left after removing sample: %v", left)
+	}
+	if _, err := s.GetKey("A6", "other"); err != nil {
+		t.Errorf("Removing sample removed other sample: %s", err)
+	}
+}
@@ -22,11 +22,22 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/ubccr/treat"
 )
 
+// mutationString returns the mutations of a read separated by semicolons
+func mutationString(mutations []*treat.Mutation) string {
+	vals := make([]string, len(mutations))
+	for i, m := range mutations {
+		vals[i] = m.String()
+	}
+
+	return strings.Join(vals, ";")
+}
+
 func Search(dbpath string, fields *SearchFields, csvOutput, noHeader, fastaOutput bool) {
 	s, err := NewStorage(dbpath)
 	if err != nil {
@@ -50,13 +61,36 @@ func Search(dbpath string, fields *SearchFields, csvOutput, noHeader, fastaOutpu
 			"edit_stop",
 			"junc_end",
 			"junc_len",
-			"junc_seq"})
+			"junc_seq",
+			"mutations",
+			"chimera",
+			"molecules"})
+	}
+
+	templates, err := s.TemplateMap()
+	if err != nil {
+		logrus.Fatal(err)
 	}
 
 	err = s.Search(fields, func(key *treat.AlignmentKey, a *treat.Alignment) {
 		alt := fmt.Sprintf("%d", a.AltEditing)
 		if a.AltEditing != 0 {
-			alt = fmt.Sprintf("A%d", a.AltEditing)
+			tmpl, ok := templates[key.Gene]
+			altName := func(i int) string {
+				if !ok {
+					return fmt.Sprintf("A%d", i)
+				}
+				return tmpl.AltName(i)
+			}
+
+			// Primary alt template first followed by any other matches
+			names := []string{altName(int(a.AltEditing))}
+			for _, i := range a.AltMatches() {
+				if i != int(a.AltEditing) {
+					names = append(names, altName(i))
+				}
+			}
+			alt = strings.Join(names, ",")
 		}
 
 		if fastaOutput {
@@ -78,7 +112,10 @@ func Search(dbpath string, fields *SearchFields, csvOutput, noHeader, fastaOutpu
 				fmt.Sprintf("%d", a.EditStop),
 				fmt.Sprintf("%d", a.JuncEnd),
 				fmt.Sprintf("%d", a.JuncLen),
-				a.JuncSeq})
+				a.JuncSeq,
+				mutationString(a.Mutations),
+				fmt.Sprintf("%d", a.Chimera),
+				fmt.Sprintf("%d", a.MoleculeCount())})
 		}
 
 		csvout.Flush()
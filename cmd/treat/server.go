@@ -18,17 +18,23 @@
 package main
 
 import (
+	stdcontext "context"
+	"crypto/rand"
 	"encoding/gob"
 	"fmt"
 	"html/template"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/aebruno/nwalgo"
 	"github.com/carbocation/interpose"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
@@ -41,20 +47,34 @@ const (
 	TREAT_COOKIE_SESSION = "treat-session"
 	TREAT_COOKIE_DB      = "dbname"
 	TREAT_COOKIE_SEARCH  = "search"
+	TREAT_COOKIE_USER    = "user"
 )
 
 type Application struct {
+	sync.RWMutex
 	templates   map[string]*template.Template
 	tmpldir     string
 	enableCache bool
+	cacheSize   int
 	dbs         map[string]*Database
+	dbPath      string
 	defaultDb   string
 	decoder     *schema.Decoder
 	cookieStore *sessions.CookieStore
+	auth        Authenticator
+	acl         *ACL
+	audit       *logrus.Logger
+	auditFile   *os.File
+	quit        chan struct{}
 }
 
 type Database struct {
 	name                string
+	path                string
+	modTime             time.Time
+	size                int64
+	loading             bool
+	updating            bool
 	storage             *Storage
 	geneTemplates       map[string]*treat.Template
 	geneSamples         map[string][]string
@@ -65,50 +85,47 @@ type Database struct {
 	maxJuncEnd          map[string]int
 	genes               []string
 	defaultGene         string
-	cache               map[string][]byte
+	cache               *ResponseCache
 	cacheEditStopTotals map[string]map[int]map[string]float64
+	geneNormSets        map[string][]*NormMeta
 }
 
 func init() {
 	gob.Register(&SearchFields{})
 }
 
-func NewApplication(dbpath, tmpldir string, enableCache bool) (*Application, error) {
+func NewApplication(options *ServerOptions) (*Application, error) {
+	dbpath := options.DbPath
+	tmpldir := options.TemplateDir
+
 	app := &Application{}
 	app.dbs = make(map[string]*Database)
+	app.dbPath = dbpath
+	app.quit = make(chan struct{})
+	app.enableCache = options.EnableCache
+	app.cacheSize = options.CacheSize
 
-	fi, err := os.Stat(dbpath)
+	if app.enableCache && app.cacheSize <= 0 {
+		return nil, fmt.Errorf("Cache size must be greater than 0")
+	}
+
+	dbfiles, err := dbFiles(dbpath)
 	if err != nil {
 		return nil, err
 	}
 
-	if fi.IsDir() {
-		dbabs, _ := filepath.Abs(dbpath)
-		dbfiles, err := filepath.Glob(filepath.Join(dbabs, "*.db"))
-		if err != nil {
-			return nil, err
-		}
-		for _, d := range dbfiles {
-			abs, _ := filepath.Abs(d)
-			base := filepath.Base(abs)
-
-			err = app.loadDb(base, abs)
-			if err != nil {
-				return nil, err
-			}
-
-			if len(app.defaultDb) == 0 {
-				app.defaultDb = base
-			}
-		}
-	} else {
-		abs, _ := filepath.Abs(dbpath)
+	for _, abs := range dbfiles {
 		base := filepath.Base(abs)
+
 		err = app.loadDb(base, abs)
 		if err != nil {
+			app.Close()
 			return nil, err
 		}
-		app.defaultDb = base
+
+		if len(app.defaultDb) == 0 {
+			app.defaultDb = base
+		}
 	}
 
 	if len(app.dbs) == 0 {
@@ -155,25 +172,185 @@ func NewApplication(dbpath, tmpldir string, enableCache bool) (*Application, err
 		}
 	}
 
-	app.enableCache = enableCache
 	app.tmpldir = tmpldir
 	app.decoder = schema.NewDecoder()
-	// Create secure cookie with in-secure key. Make this configurable in the future
-	app.cookieStore = sessions.NewCookieStore([]byte("not-secure"))
 	app.decoder.IgnoreUnknownKeys(true)
 
+	secret := []byte(options.CookieSecret)
+	if len(secret) == 0 {
+		logrus.Warn("No cookie secret provided. Using random key, sessions will not persist across restarts")
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		// Re-use the same random key when the server is reloaded
+		options.CookieSecret = string(secret)
+	}
+	app.cookieStore = sessions.NewCookieStore(secret)
+	app.cookieStore.Options.HttpOnly = true
+
+	if options.Auth != nil {
+		app.auth, err = NewAuthenticator(options.Auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if app.auth == nil {
+		logrus.Warn("Authentication is disabled. All databases are accessible by anyone")
+	}
+
+	if len(options.AclPath) > 0 {
+		if app.auth == nil {
+			return nil, fmt.Errorf("Database access control lists require authentication to be enabled")
+		}
+
+		app.acl, err = NewACLFromFile(options.AclPath)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Printf("Using database access control list: %s", options.AclPath)
+	}
+
+	if len(options.AuditLogPath) > 0 {
+		f, err := os.OpenFile(options.AuditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open audit log: %s", err)
+		}
+
+		app.auditFile = f
+		app.audit = logrus.New()
+		app.audit.Out = f
+		app.audit.Formatter = &logrus.JSONFormatter{}
+		logrus.Printf("Writing audit log to: %s", options.AuditLogPath)
+	}
+
+	if options.DbScanInterval > 0 {
+		go app.watchDbs(time.Duration(options.DbScanInterval) * time.Second)
+	}
+
 	return app, nil
 }
 
+// Close closes all databases and log files opened by the application
+func (a *Application) Close() {
+	close(a.quit)
+
+	a.Lock()
+	defer a.Unlock()
+
+	for _, db := range a.dbs {
+		db.Close()
+	}
+
+	if a.auditFile != nil {
+		a.auditFile.Close()
+	}
+}
+
 func (a *Application) loadDb(base, dbpath string) error {
+	db, err := a.openDatabase(base, dbpath)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.dbs[base] = db
+	a.Unlock()
+
+	return nil
+}
+
+func (a *Application) openDatabase(base, dbpath string) (*Database, error) {
 	logrus.Infof("Processing database: %s", base)
-	db := &Database{name: base}
+
+	fi, err := os.Stat(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &Database{name: base, path: dbpath, modTime: fi.ModTime(), size: fi.Size()}
 	stg, err := NewStorage(dbpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	db.storage = stg
 
+	err = db.computeCache()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if a.enableCache {
+		db.cache, err = NewResponseCache(a.cacheSize)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// EditStopTotals returns the total normalized read counts at each edit stop
+// site for each sample in the gene. If a normalization set is selected the
+// totals are computed using that set, otherwise the cached totals for the
+// active set are returned.
+func (db *Database) EditStopTotals(fields *SearchFields) (map[int]map[string]float64, error) {
+	if len(fields.NormSet) == 0 {
+		return db.cacheEditStopTotals[fields.Gene], nil
+	}
+
+	totals := make(map[int]map[string]float64)
+	search := &SearchFields{Gene: fields.Gene, EditStop: -1, JuncEnd: -1, JuncLen: -1, MutationAt: -1, NormSet: fields.NormSet}
+	err := db.storage.Search(search, func(key *treat.AlignmentKey, aln *treat.Alignment) {
+		if _, ok := totals[aln.EditStop]; !ok {
+			totals[aln.EditStop] = make(map[string]float64)
+		}
+		totals[aln.EditStop][key.Sample] += aln.Norm
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return totals, nil
+}
+
+// HasNormSet returns true if the named normalization set exists for the gene
+func (db *Database) HasNormSet(gene, name string) bool {
+	for _, m := range db.geneNormSets[gene] {
+		if m.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Loading returns true if the database caches are still being computed
+func (db *Database) Loading() bool {
+	return db.loading
+}
+
+func (db *Database) Close() {
+	if db.storage == nil {
+		return
+	}
+
+	err := db.storage.Close()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"dbname": db.name,
+			"error":  err.Error(),
+		}).Error("Failed to close database")
+	}
+}
+
+func (db *Database) computeCache() error {
+	var err error
 	db.geneTemplates, err = db.storage.TemplateMap()
 	if err != nil {
 		return err
@@ -189,6 +366,7 @@ func (a *Application) loadDb(base, dbpath string) error {
 	db.geneSamples = make(map[string][]string)
 	db.geneKnockDowns = make(map[string][]string)
 	db.geneReplicates = make(map[string][]int)
+	db.geneNormSets = make(map[string][]*NormMeta)
 	db.genes = make([]string, 0)
 	for k := range db.geneTemplates {
 		db.genes = append(db.genes, k)
@@ -214,12 +392,17 @@ func (a *Application) loadDb(base, dbpath string) error {
 			return err
 		}
 
+		db.geneNormSets[k], err = db.storage.NormSets(k)
+		if err != nil {
+			return err
+		}
+
 		logrus.Printf("Computing cache for gene %s...", k)
 		if _, ok := db.cacheEditStopTotals[k]; !ok {
 			db.cacheEditStopTotals[k] = make(map[int]map[string]float64)
 		}
 
-		fields := &SearchFields{Gene: k, EditStop: -1, JuncEnd: -1, JuncLen: -1}
+		fields := &SearchFields{Gene: k, EditStop: -1, JuncEnd: -1, JuncLen: -1, MutationAt: -1}
 		err = db.storage.Search(fields, func(key *treat.AlignmentKey, aln *treat.Alignment) {
 			if _, ok := db.cacheEditStopTotals[k][aln.EditStop]; !ok {
 				db.cacheEditStopTotals[k][aln.EditStop] = make(map[string]float64)
@@ -257,14 +440,13 @@ func (a *Application) loadDb(base, dbpath string) error {
 	// Set default gene for dropdown menu
 	db.defaultGene = db.genes[0]
 
-	db.cache = make(map[string][]byte)
-	a.dbs[base] = db
-
 	return nil
 }
 
 func (a *Application) GetDb(name string) (*Database, error) {
+	a.RLock()
 	db, ok := a.dbs[name]
+	a.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("Database not found: %s", name)
 	}
@@ -272,6 +454,135 @@ func (a *Application) GetDb(name string) (*Database, error) {
 	return db, nil
 }
 
+// CanAccess returns true if the user has the given permission on the database
+func (a *Application) CanAccess(user *User, dbname string, perm int) bool {
+	if a.acl == nil {
+		return true
+	}
+
+	return a.acl.Permission(user, dbname) >= perm
+}
+
+// UserDbs returns the databases the current user is allowed to read
+func (a *Application) UserDbs(r *http.Request) map[string]*Database {
+	user := a.GetUserFromContext(r)
+	dbs := make(map[string]*Database)
+
+	a.RLock()
+	defer a.RUnlock()
+	for name, db := range a.dbs {
+		if a.CanAccess(user, name, PERM_READ) {
+			dbs[name] = db
+		}
+	}
+
+	return dbs
+}
+
+// DefaultDb returns the name of the default database for the user
+func (a *Application) DefaultDb(user *User) string {
+	a.RLock()
+	defer a.RUnlock()
+
+	if db, ok := a.dbs[a.defaultDb]; ok && !db.loading && a.CanAccess(user, a.defaultDb, PERM_READ) {
+		return a.defaultDb
+	}
+
+	names := make([]string, 0, len(a.dbs))
+	for name := range a.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Prefer databases that have finished loading
+	for _, loading := range []bool{false, true} {
+		for _, name := range names {
+			if a.dbs[name].loading == loading && a.CanAccess(user, name, PERM_READ) {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+// Audit logs who viewed or exported data from a database
+func (a *Application) Audit(r *http.Request, user *User, dbname string) {
+	if a.audit == nil {
+		return
+	}
+
+	action := "view"
+	if r.URL.Query().Get("export") == "1" {
+		action = "export"
+	}
+
+	fields := logrus.Fields{
+		"user":   userName(user),
+		"remote": r.RemoteAddr,
+		"db":     dbname,
+		"action": action,
+		"path":   r.URL.Path,
+		"query":  r.URL.RawQuery,
+	}
+
+	if r.Method == "POST" {
+		fields["action"] = "update"
+		fields["form"] = r.PostFormValue("action")
+		fields["gene"] = r.PostFormValue("gene")
+		fields["sample"] = r.PostFormValue("sample")
+	}
+
+	a.audit.WithFields(fields).Info("access")
+}
+
+// CanUpdate returns true if the user is allowed to modify the database.
+// Modifying databases from the web interface requires authentication.
+func (a *Application) CanUpdate(user *User, dbname string) bool {
+	if a.auth == nil || user == nil {
+		return false
+	}
+
+	return a.CanAccess(user, dbname, PERM_UPLOAD)
+}
+
+// UpdateDb applies f to a writable copy of the database storage and reloads
+// the database. While the update is running the database is shown as loading.
+func (a *Application) UpdateDb(name string, f func(s *Storage) error) error {
+	a.Lock()
+	db, ok := a.dbs[name]
+	if !ok || db.loading {
+		a.Unlock()
+		return fmt.Errorf("Database %s is not available", name)
+	}
+	a.dbs[name] = &Database{name: name, path: db.path, loading: true, updating: true}
+	a.Unlock()
+
+	// Close waits for any open read transactions to finish
+	db.Close()
+
+	stg, err := NewStorageWrite(db.path)
+	if err == nil {
+		err = f(stg)
+		cerr := stg.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	a.refreshDb(name, db.path)
+
+	return err
+}
+
+func userName(user *User) string {
+	if user == nil {
+		return ""
+	}
+
+	return user.Name
+}
+
 func (a *Application) GetDbFromContext(r *http.Request) (*Database, error) {
 	dbp, ok := context.GetOk(r, "db")
 	if !ok {
@@ -290,13 +601,54 @@ func (a *Application) GetDbFromContext(r *http.Request) (*Database, error) {
 	return db, nil
 }
 
+func (a *Application) GetUserFromContext(r *http.Request) *User {
+	u, ok := context.GetOk(r, "user")
+	if !ok {
+		return nil
+	}
+
+	user, ok := u.(*User)
+	if !ok {
+		return nil
+	}
+
+	return user
+}
+
+// NewSearchFields returns the search fields of the request and stores them
+// in the session
 func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db *Database) (*SearchFields, error) {
+	fields, session, err := a.searchFields(r, db)
+	if err != nil {
+		return nil, err
+	}
+
+	a.saveSearchFields(w, r, session, fields)
+
+	return fields, nil
+}
+
+// saveSearchFields stores the search fields in the session
+func (a *Application) saveSearchFields(w http.ResponseWriter, r *http.Request, session *sessions.Session, fields *SearchFields) {
+	session.Values[TREAT_COOKIE_SEARCH] = fields
+	err := session.Save(r, w)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to update search in session")
+	}
+}
+
+// searchFields returns the search stored in the session overridden by the
+// values in the request url. Also returns the session.
+func (a *Application) searchFields(r *http.Request, db *Database) (*SearchFields, *sessions.Session, error) {
 	vals := r.URL.Query()
 	fields := new(SearchFields)
 	// set defaults
 	fields.EditStop = -2
 	fields.JuncLen = -2
 	fields.JuncEnd = -2
+	fields.MutationAt = -2
 	fields.Gene = db.defaultGene
 	fields.Limit = 10
 
@@ -311,6 +663,7 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 			fields.EditStop = -2
 			fields.JuncLen = -2
 			fields.JuncEnd = -2
+			fields.MutationAt = -2
 			fields.Gene = db.defaultGene
 			fields.Limit = 10
 		}
@@ -323,7 +676,7 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 	err := a.decoder.Decode(fields, vals)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if fields.FormOpen {
@@ -348,6 +701,9 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 		if vals.Get("has_alt") != "1" {
 			fields.HasAlt = false
 		}
+		if vals.Get("no_primer") != "1" {
+			fields.NoPrimer = false
+		}
 		if vals.Get("alt") == "" {
 			fields.AltRegion = 0
 		}
@@ -360,25 +716,32 @@ func (a *Application) NewSearchFields(w http.ResponseWriter, r *http.Request, db
 		if vals.Get("junc_end") == "" {
 			fields.JuncEnd = -2
 		}
+		if vals.Get("mutation_at") == "" {
+			fields.MutationAt = -2
+		}
+		if vals.Get("min_chimera") == "" {
+			fields.MinChimera = 0
+		}
 		if vals.Get("tet") == "" {
 			fields.Tetracycline = ""
 		}
+		if vals.Get("norm_set") == "" {
+			fields.NormSet = ""
+		}
 	}
 
-	session.Values[TREAT_COOKIE_SEARCH] = fields
-	err = session.Save(r, w)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("Failed to update search in session")
+	// Ignore normalization sets not available for the gene
+	if len(fields.NormSet) > 0 && !db.HasNormSet(fields.Gene, fields.NormSet) {
+		fields.NormSet = ""
 	}
 
-	return fields, nil
+	return fields, session, nil
 }
 
 func (a *Application) middlewareStruct() (*interpose.Middleware, error) {
 	mw := interpose.New()
-	mw.UseHandler(DbContext(a))
+	mw.Use(AuthRequired(a))
+	mw.Use(DbContext(a))
 	mw.UseHandler(a.router())
 
 	return mw, nil
@@ -394,29 +757,32 @@ func (a *Application) router() *mux.Router {
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir(fmt.Sprintf("%s/static", a.tmpldir)))))
 
 	router.Path("/").Handler(IndexHandler(a)).Methods("GET")
-	router.Path("/data/es-hist").Handler(EditHistogramHandler(a)).Methods("GET")
-	router.Path("/data/jl-hist").Handler(JuncLenHistogramHandler(a)).Methods("GET")
-	router.Path("/data/je-hist").Handler(JuncEndHistogramHandler(a)).Methods("GET")
-	router.Path("/data/heat").Handler(HeatMapJson(a)).Methods("GET")
-	router.Path("/data/bubble").Handler(BubbleJson(a)).Methods("GET")
-	router.Path("/data/tmpl").Handler(TemplateSummaryHistogramHandler(a)).Methods("GET")
+	router.Path("/login").Handler(LoginHandler(a)).Methods("GET", "POST")
+	router.Path("/logout").Handler(LogoutHandler(a)).Methods("GET")
+	router.Path("/data/es-hist").Handler(CacheHandler(a, EditHistogramHandler(a))).Methods("GET")
+	router.Path("/data/jl-hist").Handler(CacheHandler(a, JuncLenHistogramHandler(a))).Methods("GET")
+	router.Path("/data/je-hist").Handler(CacheHandler(a, JuncEndHistogramHandler(a))).Methods("GET")
+	router.Path("/data/heat").Handler(CacheHandler(a, HeatMapJson(a))).Methods("GET")
+	router.Path("/data/bubble").Handler(CacheHandler(a, BubbleJson(a))).Methods("GET")
+	router.Path("/data/tmpl").Handler(CacheHandler(a, TemplateSummaryHistogramHandler(a))).Methods("GET")
 	router.Path("/heat").Handler(HeatHandler(a)).Methods("GET")
 	router.Path("/bubble").Handler(BubbleHandler(a)).Methods("GET")
 	router.Path("/search").Handler(SearchHandler(a)).Methods("GET")
 	router.Path("/show").Handler(ShowHandler(a)).Methods("GET")
 	router.Path("/stats").Handler(StatsHandler(a)).Methods("GET")
+	router.Path("/qc").Handler(QCHandler(a)).Methods("GET")
 	router.Path("/db").Handler(DbHandler(a)).Methods("GET")
+	router.Path("/samples").Handler(SamplesHandler(a)).Methods("GET", "POST")
+	router.Path("/cache-stats").Handler(CacheStatsHandler(a)).Methods("GET")
 	router.Path("/tmpl-report").Handler(TemplateSummaryHandler(a)).Methods("GET")
 
 	return router
 }
 
-func writeBase(buf []string, ai int, base rune, count, max uint32, cat string) {
+func writeBase(buf []string, ai int, seq string, max uint32, cat string) {
 	buf[ai] += `<td class="tcell ` + cat + `">`
-	buf[ai] += strings.Repeat("-", int(max-count))
-	if count > 0 {
-		buf[ai] += strings.Repeat(string(base), int(count))
-	}
+	buf[ai] += strings.Repeat("-", int(max)-len(seq))
+	buf[ai] += seq
 	buf[ai] += `</td>`
 }
 
@@ -428,7 +794,7 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 	}
 	labels = append(labels, "RD")
 
-	aln1, aln2, _ := nwalgo.Align(tmpl.Bases, frag.Bases, 1, -1, -1)
+	aln1, aln2 := tmpl.AlignBases(frag.Bases)
 
 	fragCount := tmpl.Size() + 2
 	n := len(aln1)
@@ -449,22 +815,22 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 		if aln1[ai] == '-' {
 			buf[0][ai] = `<td class="text-center base-index"></td><td class="text-center base-index"></td>`
 			for i := range tmpl.EditSite {
-				writeBase(buf[i+1], ai, tmpl.EditBase, 0, frag.EditSite[fi], "ME")
+				writeBase(buf[i+1], ai, "", frag.EditSite[fi], "ME")
 				buf[i+1][ai] += `<td class="text-center base">-</td>`
 			}
 
-			writeBase(buf[fragCount-1], ai, frag.EditBase, frag.EditSite[fi], frag.EditSite[fi], "mutant")
+			writeBase(buf[fragCount-1], ai, frag.EditSeq(fi), frag.EditSite[fi], "mutant")
 			buf[fragCount-1][ai] += `<td class="text-center mutant base">` + string(frag.Bases[fi]) + `</td>`
 			fi++
 		} else if aln2[ai] == '-' {
 			buf[0][ai] = `<td class="text-center ` + hilite + `">` + fmt.Sprintf("%d", tmpl.IndexLabel(n-ti)) + `</td><td class="text-center base-index">` + fmt.Sprintf("%d", tmpl.BaseIndex[ti]) + `</td>`
 			max := tmpl.Max(ti)
 
-			for i, t := range tmpl.EditSite {
-				writeBase(buf[i+1], ai, tmpl.EditBase, t[ti], max, labels[i])
+			for i := range tmpl.EditSite {
+				writeBase(buf[i+1], ai, tmpl.EditSeq(i, ti), max, labels[i])
 				buf[i+1][ai] += `<td class="text-center base">` + string(tmpl.Bases[ti]) + `</td>`
 			}
-			writeBase(buf[fragCount-1], ai, '-', 0, max, "ME")
+			writeBase(buf[fragCount-1], ai, "", max, "ME")
 			buf[fragCount-1][ai] += `<td class="text-center mutant base">-</td>`
 			ti++
 		} else {
@@ -480,26 +846,26 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 				boldi = int(a.AltEditing) + 1
 				cat = fmt.Sprintf("A%d", a.AltEditing)
 			} else if n-ti+int(tmpl.EditOffset) > a.EditStop {
-				if frag.EditSite[fi] == tmpl.EditSite[1][ti] {
+				if tmpl.MatchSite(1, ti, frag, fi) {
 					cat = "PE"
 					boldi = 1
-				} else if frag.EditSite[fi] == tmpl.EditSite[0][ti] {
+				} else if tmpl.MatchSite(0, ti, frag, fi) {
 					cat = "FE"
 					boldi = 0
 				}
 			} else {
-				if frag.EditSite[fi] == tmpl.EditSite[0][ti] {
+				if tmpl.MatchSite(0, ti, frag, fi) {
 					cat = "FE"
 					boldi = 0
-				} else if frag.EditSite[fi] == tmpl.EditSite[1][ti] {
+				} else if tmpl.MatchSite(1, ti, frag, fi) {
 					cat = "PE"
 					boldi = 1
 				}
 			}
 
 			if boldi == -1 {
-				for i, t := range tmpl.EditSite[2:] {
-					if frag.EditSite[fi] == t[ti] {
+				for i := range tmpl.EditSite[2:] {
+					if tmpl.MatchSite(i+2, ti, frag, fi) {
 						boldi = i + 2
 						cat = fmt.Sprintf("A%d", i+1)
 					}
@@ -510,16 +876,21 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 				cat += " junction"
 			}
 
-			for i, t := range tmpl.EditSite {
+			for i := range tmpl.EditSite {
 				bold := ""
 				if boldi == i {
 					bold = "hilite"
 				}
-				writeBase(buf[i+1], ai, tmpl.EditBase, t[ti], max, labels[i]+" "+bold)
+				writeBase(buf[i+1], ai, tmpl.EditSeq(i, ti), max, labels[i]+" "+bold)
 				buf[i+1][ai] += `<td class="text-center base">` + string(tmpl.Bases[ti]) + `</td>`
 			}
-			writeBase(buf[fragCount-1], ai, frag.EditBase, frag.EditSite[fi], max, cat)
-			buf[fragCount-1][ai] += `<td class="text-center base">` + string(frag.Bases[fi]) + `</td>`
+			// Substitutions recorded as mutations are highlighted
+			mutant := ""
+			if frag.Bases[fi] != tmpl.Bases[ti] && a.HasMutationAt(len(tmpl.Bases)-ti+int(tmpl.EditOffset)) {
+				mutant = " mutant"
+			}
+			writeBase(buf[fragCount-1], ai, frag.EditSeq(fi), max, cat)
+			buf[fragCount-1][ai] += `<td class="text-center base` + mutant + `">` + string(frag.Bases[fi]) + `</td>`
 			fi++
 			ti++
 		}
@@ -532,14 +903,14 @@ func alignFunc(a *treat.Alignment, frag *treat.Fragment, tmpl *treat.Template) t
 		max = frag.EditSite[fi]
 	}
 	cat := "PE"
-	if frag.EditSite[fi] == tmpl.EditSite[0][ti] {
+	if tmpl.MatchSite(0, ti, frag, fi) {
 		cat = "FE"
 	}
 
-	for i, t := range tmpl.EditSite {
-		writeBase(buf[i+1], n, tmpl.EditBase, t[ti], max, labels[i])
+	for i := range tmpl.EditSite {
+		writeBase(buf[i+1], n, tmpl.EditSeq(i, ti), max, labels[i])
 	}
-	writeBase(buf[fragCount-1], n, frag.EditBase, frag.EditSite[fi], max, cat)
+	writeBase(buf[fragCount-1], n, frag.EditSeq(fi), max, cat)
 
 	cols := 17
 	rows := len(buf[0]) / cols
@@ -612,10 +983,10 @@ func pctEditStopFunc(a *treat.Alignment, totals map[int]map[string]float64) stri
 	return fmt.Sprintf("%.4f", d)
 }
 
-func juncseqFunc(val string) template.HTML {
+func juncseqFunc(val, bases string) template.HTML {
 	html := ""
 	for _, b := range val {
-		if b == 'T' || b == 't' {
+		if strings.ContainsRune(bases, unicode.ToUpper(b)) {
 			html += `<span style="color: red">` + string(b) + `</span>`
 		} else {
 			html += string(b)
@@ -625,24 +996,128 @@ func juncseqFunc(val string) template.HTML {
 	return template.HTML(html)
 }
 
-func Server(dbpath, tmpldir string, port int, enableCache bool) {
+// reloadHandler allows the application to be swapped out while the server is
+// running
+type reloadHandler struct {
+	sync.RWMutex
+	app     *Application
+	handler http.Handler
+}
+
+func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.RLock()
+	handler := h.handler
+	h.RUnlock()
+
+	handler.ServeHTTP(w, r)
+}
 
-	app, err := NewApplication(dbpath, tmpldir, enableCache)
+func (h *reloadHandler) load(options *ServerOptions) error {
+	app, err := NewApplication(options)
 	if err != nil {
-		logrus.Fatal(err.Error())
+		return err
 	}
 
 	middle, err := app.middlewareStruct()
 	if err != nil {
-		logrus.Fatal(err.Error())
+		app.Close()
+		return err
 	}
 
-	if enableCache {
+	h.Lock()
+	old := h.app
+	h.app = app
+	h.handler = middle
+	h.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	if options.EnableCache {
 		logrus.Info("URL caching enabled")
 	}
 
-	http.Handle("/", middle)
-	logrus.Printf("Running on http://127.0.0.1:%d", port)
+	return nil
+}
+
+func Server(load func() (*ServerOptions, error)) {
+	options, err := load()
+	if err != nil {
+		logrus.Fatal(err.Error())
+	}
+
+	handler := &reloadHandler{}
+	err = handler.load(options)
+	if err != nil {
+		logrus.Fatal(err.Error())
+	}
+
+	srv := &http.Server{
+		Addr:         options.Addr(),
+		Handler:      handler,
+		ReadTimeout:  time.Duration(options.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(options.WriteTimeout) * time.Second,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				logrus.Info("Received SIGHUP. Reloading configuration and databases")
+				newOptions, err := load()
+				if err == nil {
+					if newOptions.Addr() != options.Addr() || newOptions.TLSCert != options.TLSCert || newOptions.TLSKey != options.TLSKey {
+						logrus.Warn("Changes to bind address, port and TLS settings require a restart")
+					}
+					// Keep the generated cookie secret if none was configured
+					if len(newOptions.CookieSecret) == 0 {
+						newOptions.CookieSecret = options.CookieSecret
+					}
+					err = handler.load(newOptions)
+				}
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"error": err.Error(),
+					}).Error("Failed to reload server. Continuing with previous configuration")
+				}
+				continue
+			}
+
+			logrus.Infof("Received %s. Shutting down server", sig)
+			ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), 30*time.Second)
+			err := srv.Shutdown(ctx)
+			cancel()
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("Failed to gracefully shutdown server")
+			}
+			close(done)
+			return
+		}
+	}()
+
+	if len(options.TLSCert) > 0 {
+		logrus.Printf("Running on https://%s", options.Addr())
+		err = srv.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+	} else {
+		logrus.Printf("Running on http://%s", options.Addr())
+		err = srv.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		logrus.Fatal(err.Error())
+	}
+
+	<-done
+
+	handler.Lock()
+	handler.app.Close()
+	handler.Unlock()
 
-	http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	logrus.Info("Server stopped")
 }
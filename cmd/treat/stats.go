@@ -19,6 +19,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
@@ -28,8 +29,12 @@ import (
 const (
 	COUNT_UNIQUE = iota
 	COUNT_FRAG
+	COUNT_MOLECULE
 )
 
+// Maximum number of mutations listed in the stats summary
+const MAX_MUTATION_STATS = 25
+
 type Stats struct {
 	Total          int
 	Std            int
@@ -38,16 +43,46 @@ type Stats struct {
 	Snps           int
 	SingleMismatch int
 	DoubleMismatch int
+	NoPrimer5      int
+	NoPrimer3      int
 }
 
 type SampleStats struct {
 	Stats
 }
 
+// AltStats counts the reads matching an alt editing template
+type AltStats struct {
+	Name      string
+	Start     int
+	End       int
+	Total     int
+	Norm      float64
+	SampleMap map[string]int
+}
+
+// MutationStats counts the reads with a mutation across samples
+type MutationStats struct {
+	treat.Mutation
+	Total     int
+	SampleMap map[string]int
+}
+
 type GeneStats struct {
 	Stats
 	Name      string
 	SampleMap map[string]*SampleStats
+	Alt       []*AltStats
+	Mutations []*MutationStats
+}
+
+// TopMutations returns the mutations found in the most reads
+func (g *GeneStats) TopMutations() []*MutationStats {
+	if len(g.Mutations) > MAX_MUTATION_STATS {
+		return g.Mutations[:MAX_MUTATION_STATS]
+	}
+
+	return g.Mutations
 }
 
 func percent(x, y int) float64 {
@@ -58,7 +93,7 @@ func percent(x, y int) float64 {
 	return (float64(x) / float64(y)) * float64(100)
 }
 
-func ShowStats(dbpath, gene string, unique bool, norm bool) {
+func ShowStats(dbpath, gene string, unique, molecules, norm bool) {
 	s, err := NewStorage(dbpath)
 	if err != nil {
 		logrus.Fatal(err)
@@ -67,6 +102,8 @@ func ShowStats(dbpath, gene string, unique bool, norm bool) {
 	countby := COUNT_FRAG
 	if unique {
 		countby = COUNT_UNIQUE
+	} else if molecules {
+		countby = COUNT_MOLECULE
 	}
 
 	fmt.Printf("db path: %s\n", dbpath)
@@ -82,7 +119,7 @@ func ShowStats(dbpath, gene string, unique bool, norm bool) {
 			continue
 		}
 
-		stats, err := geneStats(s, g, countby)
+		stats, err := geneStats(s, g, tmpl, countby)
 		if err != nil {
 			logrus.Fatal(err)
 		}
@@ -100,8 +137,17 @@ func ShowStats(dbpath, gene string, unique bool, norm bool) {
 			fmt.Printf("%20s%11d\n", "Indels:", stats.Indels)
 		}
 		fmt.Printf("%20s%11d\n", "Template Edit Stop:", tmpl.EditStop)
-		fmt.Printf("%20s%11s\n", "Edit Base:", string(tmpl.EditBase))
+		fmt.Printf("%20s%11s\n", "Edit Base:", tmpl.EditBaseSet())
 		fmt.Printf("%20s%11d\n", "Alt Templates:", len(tmpl.AltRegion))
+		meta, err := s.GetNormMeta(g)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if meta != nil {
+			fmt.Printf("%20s %s: %s\n", "Normalization:", meta.Name, meta.Description())
+		} else {
+			fmt.Printf("%20s %s\n", "Normalization:", "none")
+		}
 		fmt.Println(strings.Repeat("-", 80))
 		if !norm {
 			fmt.Printf("%-15s%9s%9s%5s%9s%5s%9s%5s%9s%5s\n", "Sample", "Total", "Std", "%", "Non-Std", "%", "1MM", "%", "2MM", "%")
@@ -133,25 +179,171 @@ func ShowStats(dbpath, gene string, unique bool, norm bool) {
 			}
 		}
 
+		printAltStats(stats)
+		printMutationStats(stats)
+		printPrimerStats(stats, tmpl)
+		printMergeStats(s, g)
+		printPolicies(s, g)
+		printNormLog(s, g)
 		fmt.Println()
 	}
 }
 
-func geneStats(s *Storage, gene string, countby int) (*GeneStats, error) {
+func printAltStats(stats *GeneStats) {
+	if len(stats.Alt) == 0 {
+		return
+	}
+
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("%-25s%10s%-15s%9s%12s\n", "Alt Template", "Region  ", "Sample", "Total", "Norm")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, alt := range stats.Alt {
+		name := alt.Name
+		if len(name) > 22 {
+			name = name[0:22] + ".."
+		}
+		fmt.Printf("%-25s%10s%-15s%9d%12.4f\n", name, fmt.Sprintf("%d-%d  ", alt.Start, alt.End), "all", alt.Total, alt.Norm)
+		for _, sample := range sampleNames(alt.SampleMap) {
+			total := alt.SampleMap[sample]
+			if len(sample) > 12 {
+				sample = sample[0:12] + ".."
+			}
+			fmt.Printf("%-35s%-15s%9d\n", "", sample, total)
+		}
+	}
+}
+
+// sampleNames returns the sorted sample names of the per sample totals
+func sampleNames(totals map[string]int) []string {
+	samples := make([]string, 0, len(totals))
+	for sample := range totals {
+		samples = append(samples, sample)
+	}
+	sort.Strings(samples)
+
+	return samples
+}
+
+// printMutationStats prints the mutations found in the most reads
+func printMutationStats(stats *GeneStats) {
+	if len(stats.Mutations) == 0 {
+		return
+	}
+
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("%-8s%-6s%-24s%-15s%9s\n", "Site", "Type", "Change", "Sample", "Total")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, m := range stats.TopMutations() {
+		change := m.Ref + ">" + m.Alt
+		if len(change) > 22 {
+			change = change[0:22] + ".."
+		}
+		fmt.Printf("%-8d%-6s%-24s%-15s%9d\n", m.Site, m.Type, change, "all", m.Total)
+		for _, sample := range sampleNames(m.SampleMap) {
+			total := m.SampleMap[sample]
+			if len(sample) > 12 {
+				sample = sample[0:12] + ".."
+			}
+			fmt.Printf("%-38s%-15s%9d\n", "", sample, total)
+		}
+	}
+	if n := len(stats.Mutations) - MAX_MUTATION_STATS; n > 0 {
+		fmt.Printf("%d more mutations not shown. Use treat search --mutation-at to list reads\n", n)
+	}
+}
+
+// printPrimerStats prints the reads lacking the 5' or 3' primer of the
+// template
+func printPrimerStats(stats *GeneStats, tmpl *treat.Template) {
+	if !tmpl.HasPrimers() {
+		return
+	}
+
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("%-15s%9s%12s%5s%12s%5s\n", "Primers", "Total", "No 5'", "%", "No 3'", "%")
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("%-15s%9d%12d%5.1f%12d%5.1f\n", "all", stats.Total, stats.NoPrimer5, percent(stats.NoPrimer5, stats.Total), stats.NoPrimer3, percent(stats.NoPrimer3, stats.Total))
+	samples := make([]string, 0, len(stats.SampleMap))
+	for sample := range stats.SampleMap {
+		samples = append(samples, sample)
+	}
+	sort.Strings(samples)
+
+	for _, sample := range samples {
+		rec := stats.SampleMap[sample]
+		name := sample
+		if len(sample) > 12 {
+			name = name[0:12] + ".."
+		}
+		fmt.Printf("%-15s%9d%12d%5.1f%12d%5.1f\n", name, rec.Total, rec.NoPrimer5, percent(rec.NoPrimer5, rec.Total), rec.NoPrimer3, percent(rec.NoPrimer3, rec.Total))
+	}
+}
+
+// printMergeStats prints the paired-end read merge statistics of samples
+// loaded from R1/R2 FASTQ files
+func printMergeStats(s *Storage, gene string) {
+	keys, err := s.SampleKeys(gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	header := false
+	for _, k := range keys {
+		stats, err := s.MergeStats(k)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if stats == nil {
+			continue
+		}
+
+		if !header {
+			fmt.Println(strings.Repeat("-", 80))
+			fmt.Printf("%-15s%9s%9s%7s%11s%10s%10s%12s\n", "Merged Sample", "Pairs", "Merged", "%", "Staggered", "Unmerged", "Overlap", "Mismatches")
+			fmt.Println(strings.Repeat("-", 80))
+			header = true
+		}
+
+		name := k.Sample
+		if len(name) > 12 {
+			name = name[0:12] + ".."
+		}
+		fmt.Printf("%-15s%9d%9d%7.1f%11d%10d%10.1f%12d\n", name, stats.Pairs, stats.Merged, stats.MergedPct(), stats.Staggered, stats.Unmerged, stats.MeanOverlap(), stats.Mismatches)
+	}
+}
+
+// statsCount returns the count of the alignment used in the stats
+func statsCount(a *treat.Alignment, countby int) int {
+	switch countby {
+	case COUNT_FRAG:
+		return int(a.ReadCount)
+	case COUNT_MOLECULE:
+		return int(a.MoleculeCount())
+	}
+
+	return 1
+}
+
+func geneStats(s *Storage, gene string, tmpl *treat.Template, countby int) (*GeneStats, error) {
 	gstat := &GeneStats{Name: gene}
 	gstat.SampleMap = make(map[string]*SampleStats)
+	gstat.Alt = make([]*AltStats, len(tmpl.AltRegion))
+	for i, r := range tmpl.AltRegion {
+		gstat.Alt[i] = &AltStats{
+			Name:      tmpl.AltName(i + 1),
+			Start:     tmpl.IndexLabel(r.Start),
+			End:       tmpl.IndexLabel(r.End),
+			SampleMap: make(map[string]int),
+		}
+	}
 
-	err := s.Search(&SearchFields{Gene: gene, All: true, EditStop: -1, JuncLen: -1, JuncEnd: -1}, func(key *treat.AlignmentKey, a *treat.Alignment) {
+	mutations := make(map[string]*MutationStats)
+	err := s.Search(&SearchFields{Gene: gene, All: true, EditStop: -1, JuncLen: -1, JuncEnd: -1, MutationAt: -1}, func(key *treat.AlignmentKey, a *treat.Alignment) {
 		if _, ok := gstat.SampleMap[key.Sample]; !ok {
 			gstat.SampleMap[key.Sample] = &SampleStats{}
 		}
 
-		var readCount int
-		if countby == COUNT_FRAG {
-			readCount = int(a.ReadCount)
-		} else {
-			readCount = 1
-		}
+		readCount := statsCount(a, countby)
 
 		if a.HasMutation == uint8(0) {
 			gstat.SampleMap[key.Sample].Std += readCount
@@ -175,6 +367,24 @@ func geneStats(s *Storage, gene string, countby int) (*GeneStats, error) {
 			gstat.Snps += readCount
 		}
 
+		if a.PrimerMissing&treat.PRIMER5_MISSING != 0 {
+			gstat.SampleMap[key.Sample].NoPrimer5 += readCount
+			gstat.NoPrimer5 += readCount
+		}
+		if a.PrimerMissing&treat.PRIMER3_MISSING != 0 {
+			gstat.SampleMap[key.Sample].NoPrimer3 += readCount
+			gstat.NoPrimer3 += readCount
+		}
+
+		for _, m := range a.Mutations {
+			k := m.String()
+			if _, ok := mutations[k]; !ok {
+				mutations[k] = &MutationStats{Mutation: *m, SampleMap: make(map[string]int)}
+			}
+			mutations[k].SampleMap[key.Sample] += readCount
+			mutations[k].Total += readCount
+		}
+
 		gstat.SampleMap[key.Sample].Total += readCount
 		gstat.Total += readCount
 	})
@@ -183,5 +393,67 @@ func geneStats(s *Storage, gene string, countby int) (*GeneStats, error) {
 		return nil, err
 	}
 
+	for _, m := range mutations {
+		gstat.Mutations = append(gstat.Mutations, m)
+	}
+	sort.Slice(gstat.Mutations, func(i, j int) bool {
+		a, b := gstat.Mutations[i], gstat.Mutations[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		return a.String() < b.String()
+	})
+
+	if len(gstat.Alt) == 0 {
+		return gstat, nil
+	}
+
+	// Reads are counted for every alt template they match
+	err = s.Search(&SearchFields{Gene: gene, All: true, HasAlt: true, EditStop: -1, JuncLen: -1, JuncEnd: -1, MutationAt: -1}, func(key *treat.AlignmentKey, a *treat.Alignment) {
+		readCount := statsCount(a, countby)
+
+		for _, i := range a.AltMatches() {
+			if i > len(gstat.Alt) {
+				continue
+			}
+			alt := gstat.Alt[i-1]
+			alt.SampleMap[key.Sample] += readCount
+			alt.Total += readCount
+			alt.Norm += a.Norm
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
 	return gstat, nil
 }
+
+// printPolicies prints the mutation policy used to align each sample
+func printPolicies(s *Storage, gene string) {
+	keys, err := s.SampleKeys(gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	fmt.Println(strings.Repeat("-", 80))
+	fmt.Printf("%-15s%10s%12s%10s%12s%10s%11s\n", "Policy Sample", "Max SNPs", "Ignore Ends", "Ignore N", "Indel Mutant", "Switches", "Parents")
+	fmt.Println(strings.Repeat("-", 80))
+	for _, k := range keys {
+		policy, err := s.MutationPolicy(k)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		name := k.Sample
+		if len(name) > 12 {
+			name = name[0:12] + ".."
+		}
+		parents := "off"
+		if policy.ChimeraParents {
+			parents = fmt.Sprintf("%.1fx", policy.ChimeraSkew)
+		}
+		fmt.Printf("%-15s%10d%12d%10t%12t%10d%11s\n", name, policy.MaxMismatches, policy.IgnoreEnds, policy.IgnoreN, policy.EditIndelMutant, policy.MaxSwitches, parents)
+	}
+}
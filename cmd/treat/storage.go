@@ -20,6 +20,7 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"math"
 	"os"
@@ -36,10 +37,25 @@ const (
 	BUCKET_TEMPLATES    = "templates"
 	BUCKET_FRAGMENTS    = "fragments"
 	BUCKET_META         = "meta"
+	BUCKET_NORM         = "norm"
+	BUCKET_NORM_ACTIVE  = "norm-active"
+	BUCKET_NORM_LOG     = "norm-log"
 	STORAGE_VERSION_KEY = "version"
 	STORAGE_VERSION     = 0.2
 )
 
+const (
+	BUCKET_TEMPLATE_VERSIONS = "template-versions"
+	BUCKET_SAMPLE_TEMPLATES  = "sample-templates"
+	BUCKET_SAMPLE_MERGE      = "sample-merge"
+	BUCKET_SAMPLE_POLICY     = "sample-policy"
+	BUCKET_SAMPLE_QC         = "sample-qc"
+)
+
+// Per sample meta data buckets. Entries are keyed by the sample key and follow
+// the sample when it is renamed or deleted.
+var sampleMetaBuckets = []string{BUCKET_SAMPLE_TEMPLATES, BUCKET_SAMPLE_MERGE, BUCKET_SAMPLE_POLICY, BUCKET_SAMPLE_QC}
+
 type Storage struct {
 	DB      *bolt.DB
 	version float64
@@ -60,7 +76,12 @@ type SearchFields struct {
 	Tetracycline string   `schema:"tet"`
 	All          bool     `schema:"all"`
 	AltRegion    int      `schema:"alt"`
+	AltName      string   `schema:"alt_name"`
+	NoPrimer     bool     `schema:"no_primer"`
+	MutationAt   int      `schema:"mutation_at"`
+	MinChimera   int      `schema:"min_chimera"`
 	FormOpen     bool     `schema:"form_open"`
+	NormSet      string   `schema:"norm_set"`
 }
 
 type AlignmentResults []*treat.Alignment
@@ -180,7 +201,16 @@ func (fields *SearchFields) HasMatch(a *treat.Alignment) bool {
 	if fields.HasAlt && a.AltEditing == 0 {
 		return false
 	}
-	if fields.AltRegion > 0 && uint8(fields.AltRegion) != a.AltEditing {
+	if fields.AltRegion > 0 && !a.HasAlt(fields.AltRegion) {
+		return false
+	}
+	if fields.NoPrimer && a.PrimerMissing == 0 {
+		return false
+	}
+	if fields.MutationAt >= 0 && !a.HasMutationAt(fields.MutationAt) {
+		return false
+	}
+	if fields.MinChimera > 0 && int(a.Chimera) < fields.MinChimera {
 		return false
 	}
 
@@ -237,10 +267,20 @@ func openBolt(dbpath string, mode os.FileMode, options *bolt.Options) (*Storage,
 	return storage, nil
 }
 
+func (s *Storage) Close() error {
+	return s.DB.Close()
+}
+
 func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *treat.Alignment)) error {
 	count := 0
 	offset := 0
 
+	// Normalization sets by gene when searching using a non-active set
+	normSets := make(map[string]*NormMeta)
+
+	// Alt template numbers by gene when searching by alt template name
+	altIndex := make(map[string]int)
+
 	err := s.DB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BUCKET_ALIGNMENTS))
 		c := b.Cursor()
@@ -252,6 +292,44 @@ func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *
 				continue
 			}
 
+			var normSet *NormMeta
+			if len(fields.NormSet) > 0 {
+				var ok bool
+				normSet, ok = normSets[key.Gene]
+				if !ok {
+					var err error
+					normSet, err = getNormSet(tx, key.Gene, fields.NormSet)
+					if err != nil {
+						return err
+					}
+					if normSet == nil {
+						return fmt.Errorf("Normalization set %s not found for gene %s", fields.NormSet, key.Gene)
+					}
+					normSets[key.Gene] = normSet
+				}
+			}
+
+			alt := 0
+			if len(fields.AltName) > 0 {
+				var ok bool
+				alt, ok = altIndex[key.Gene]
+				if !ok {
+					tmpl, err := getTemplate(tx, key.Gene)
+					if err != nil {
+						return err
+					}
+					alt = tmpl.AltIndex(fields.AltName)
+					if alt == 0 {
+						// Gene has no alt template with this name
+						alt = -1
+					}
+					altIndex[key.Gene] = alt
+				}
+				if alt < 0 {
+					continue
+				}
+			}
+
 			bucket := c.Bucket().Bucket(k).Cursor()
 
 			for ak, av := bucket.First(); ak != nil; ak, av = bucket.Next() {
@@ -266,8 +344,16 @@ func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *
 					continue
 				}
 
+				if alt > 0 && !a.HasAlt(alt) {
+					continue
+				}
+
+				if normSet != nil {
+					a.Norm = normSet.NormCount(key.Sample, a)
+				}
+
 				// By default, don't include alt editing
-				if !fields.HasAlt && a.AltEditing > 0 {
+				if !fields.HasAlt && alt == 0 && fields.AltRegion == 0 && a.AltEditing > 0 {
 					continue
 				}
 
@@ -292,47 +378,355 @@ func (s *Storage) Search(fields *SearchFields, f func(k *treat.AlignmentKey, a *
 	return err
 }
 
-func (s *Storage) PutTemplate(gene string, tmpl *treat.Template) error {
+// PutTemplate stores the template as the current template for the gene. If
+// it differs from the current template a new template version is created.
+// Returns the version of the template.
+func (s *Storage) PutTemplate(gene string, tmpl *treat.Template) (uint64, error) {
+	var version uint64
+
 	err := s.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BUCKET_TEMPLATES))
 		if b == nil {
 			return fmt.Errorf("database error. templates bucket does not exist!")
 		}
 
+		vb, err := tx.Bucket([]byte(BUCKET_META)).CreateBucketIfNotExists([]byte(BUCKET_TEMPLATE_VERSIONS))
+		if err != nil {
+			return err
+		}
+		gb, err := vb.CreateBucketIfNotExists([]byte(gene))
+		if err != nil {
+			return err
+		}
+
+		if current := b.Get([]byte(gene)); current != nil {
+			ctmpl := new(treat.Template)
+			err := ctmpl.UnmarshalBytes(current)
+			if err != nil {
+				return err
+			}
+
+			// Record templates stored before versioning as version 1
+			if gb.Sequence() == 0 {
+				version, _ = gb.NextSequence()
+				err = gb.Put(versionKey(version), current)
+				if err != nil {
+					return err
+				}
+			}
+
+			if ctmpl.Equal(tmpl) {
+				version = gb.Sequence()
+				return nil
+			}
+		}
+
 		data, err := tmpl.MarshalBytes()
 		if err != nil {
 			return err
 		}
 
-		err = b.Put([]byte(gene), data)
+		version, _ = gb.NextSequence()
+		err = gb.Put(versionKey(version), data)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(gene), data)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func versionKey(version uint64) []byte {
+	kbytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(kbytes, version)
+	return kbytes
+}
+
+// TemplateVersion returns the version of the current template for the gene.
+// Returns 0 for templates stored before versioning.
+func (s *Storage) TemplateVersion(gene string) (uint64, error) {
+	var version uint64
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		vb := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_TEMPLATE_VERSIONS))
+		if vb == nil {
+			return nil
+		}
+		gb := vb.Bucket([]byte(gene))
+		if gb == nil {
+			return nil
+		}
+
+		version = gb.Sequence()
+		return nil
+	})
+
+	return version, err
+}
+
+// TemplateVersions returns all stored versions of the template for the gene
+// keyed by version
+func (s *Storage) TemplateVersions(gene string) (map[uint64]*treat.Template, error) {
+	versions := make(map[uint64]*treat.Template)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		vb := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_TEMPLATE_VERSIONS))
+		if vb == nil {
+			return nil
+		}
+		gb := vb.Bucket([]byte(gene))
+		if gb == nil {
+			return nil
+		}
+
+		return gb.ForEach(func(k, v []byte) error {
+			tmpl := new(treat.Template)
+			err := tmpl.UnmarshalBytes(v)
+			if err != nil {
+				return err
+			}
+			versions[binary.BigEndian.Uint64(k)] = tmpl
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// SetSampleTemplate links the sample to the template version it was aligned
+// against
+func (s *Storage) SetSampleTemplate(akey *treat.AlignmentKey, version uint64) error {
+	key, err := akey.MarshalBinary()
+	if err != nil {
 		return err
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(BUCKET_META)).CreateBucketIfNotExists([]byte(BUCKET_SAMPLE_TEMPLATES))
+		if err != nil {
+			return err
+		}
+
+		return b.Put(key, versionKey(version))
 	})
 
 	return err
 }
 
-func (s *Storage) GetTemplate(gene string) (*treat.Template, error) {
-	var tmpl *treat.Template
-	err := s.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BUCKET_TEMPLATES))
+// SampleTemplate returns the template version the sample was aligned
+// against. Returns 0 if unknown.
+func (s *Storage) SampleTemplate(akey *treat.AlignmentKey) (uint64, error) {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	var version uint64
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_SAMPLE_TEMPLATES))
 		if b == nil {
-			return fmt.Errorf("database error. templates bucket does not exist!")
+			return nil
+		}
+
+		v := b.Get(key)
+		if v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+
+		return nil
+	})
+
+	return version, err
+}
+
+// putSampleMeta stores v as JSON in the per sample meta bucket. If v is nil
+// any existing entry is removed.
+func (s *Storage) putSampleMeta(name string, akey *treat.AlignmentKey, v interface{}) error {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		return putSampleMetaTx(tx, name, key, v)
+	})
+
+	return err
+}
+
+// putSampleMetaTx stores v as JSON in the per sample meta bucket within the
+// transaction. If v is nil the entry is removed.
+func putSampleMetaTx(tx *bolt.Tx, name string, key []byte, v interface{}) error {
+	b, err := tx.Bucket([]byte(BUCKET_META)).CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return err
+	}
+
+	if v == nil {
+		return b.Delete(key)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, data)
+}
+
+// getSampleMeta decodes the JSON entry of the sample in the per sample meta
+// bucket into v. Returns false if there is no entry.
+func (s *Storage) getSampleMeta(name string, akey *treat.AlignmentKey, v interface{}) (bool, error) {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	err = s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(name))
+		if b == nil {
+			return nil
+		}
+
+		data := b.Get(key)
+		if data == nil {
+			return nil
+		}
+
+		found = true
+		return json.Unmarshal(data, v)
+	})
+
+	return found, err
+}
+
+// SetMergeStats stores the paired-end read merge statistics of the sample.
+// If stats is nil any existing statistics are removed.
+func (s *Storage) SetMergeStats(akey *treat.AlignmentKey, stats *treat.MergeStats) error {
+	if stats == nil {
+		return s.putSampleMeta(BUCKET_SAMPLE_MERGE, akey, nil)
+	}
+
+	return s.putSampleMeta(BUCKET_SAMPLE_MERGE, akey, stats)
+}
+
+// MergeStats returns the paired-end read merge statistics of the sample.
+// Returns nil if the sample was not loaded from paired-end reads.
+func (s *Storage) MergeStats(akey *treat.AlignmentKey) (*treat.MergeStats, error) {
+	stats := new(treat.MergeStats)
+	found, err := s.getSampleMeta(BUCKET_SAMPLE_MERGE, akey, stats)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// SetMutationPolicy stores the mutation policy used to align the sample
+func (s *Storage) SetMutationPolicy(akey *treat.AlignmentKey, policy *treat.MutationPolicy) error {
+	return s.putSampleMeta(BUCKET_SAMPLE_POLICY, akey, policy)
+}
+
+// MutationPolicy returns the mutation policy used to align the sample.
+// Samples loaded without a stored policy used the default policy. Options
+// missing from older stored policies keep their default.
+func (s *Storage) MutationPolicy(akey *treat.AlignmentKey) (*treat.MutationPolicy, error) {
+	policy := treat.DefaultMutationPolicy()
+	found, err := s.getSampleMeta(BUCKET_SAMPLE_POLICY, akey, policy)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return treat.DefaultMutationPolicy(), nil
+	}
+
+	return policy, nil
+}
+
+// SetQCReport stores the quality control report of the reads of the sample
+func (s *Storage) SetQCReport(akey *treat.AlignmentKey, report *treat.QCReport) error {
+	return s.putSampleMeta(BUCKET_SAMPLE_QC, akey, report)
+}
+
+// QCReport returns the quality control report of the sample. Returns nil if
+// the sample was loaded without a report.
+func (s *Storage) QCReport(akey *treat.AlignmentKey) (*treat.QCReport, error) {
+	report := treat.NewQCReport()
+	found, err := s.getSampleMeta(BUCKET_SAMPLE_QC, akey, report)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// moveSampleMeta moves the per sample meta data to the new key. If nkey is
+// nil the meta data is removed.
+func moveSampleMeta(tx *bolt.Tx, key, nkey []byte) error {
+	for _, name := range sampleMetaBuckets {
+		b := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(name))
+		if b == nil {
+			continue
 		}
 
-		v := b.Get([]byte(gene))
+		v := b.Get(key)
 		if v == nil {
-			return fmt.Errorf("database error. template not found for gene: %s", gene)
+			continue
+		}
+
+		if nkey != nil {
+			err := b.Put(nkey, append([]byte(nil), v...))
+			if err != nil {
+				return err
+			}
 		}
 
-		t := new(treat.Template)
-		err := t.UnmarshalBytes(v)
+		err := b.Delete(key)
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
 
-		tmpl = t
+func getTemplate(tx *bolt.Tx, gene string) (*treat.Template, error) {
+	b := tx.Bucket([]byte(BUCKET_TEMPLATES))
+	if b == nil {
+		return nil, fmt.Errorf("database error. templates bucket does not exist!")
+	}
 
-		return nil
+	v := b.Get([]byte(gene))
+	if v == nil {
+		return nil, fmt.Errorf("database error. template not found for gene: %s", gene)
+	}
+
+	tmpl := new(treat.Template)
+	err := tmpl.UnmarshalBytes(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return tmpl, nil
+}
+
+func (s *Storage) GetTemplate(gene string) (*treat.Template, error) {
+	var tmpl *treat.Template
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		tmpl, err = getTemplate(tx, gene)
+		return err
 	})
 
 	if err != nil {
@@ -694,94 +1088,600 @@ func (s *Storage) InitSample(akey *treat.AlignmentKey, force bool) error {
 	return err
 }
 
-func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.AlignmentKey, error) {
-	f, err := os.Open(path)
+// DeleteSample removes all alignments and fragments for the sample and drops
+// the sample from any normalization sets
+func (s *Storage) DeleteSample(akey *treat.AlignmentKey) error {
+	key, err := akey.MarshalBinary()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
 
-	tmpl, err := s.GetTemplate(options.Gene)
-	if err != nil {
-		return nil, err
-	}
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{BUCKET_ALIGNMENTS, BUCKET_FRAGMENTS} {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				return fmt.Errorf("database error. %s bucket does not exist!", name)
+			}
 
-	akey := &treat.AlignmentKey{
-		Gene:         options.Gene,
-		Sample:       options.Sample,
-		KnockDown:    options.KnockDown,
-		Tetracycline: options.Tetracycline,
-		Replicate:    options.Replicate,
+			err := b.DeleteBucket(key)
+			if err != nil {
+				return fmt.Errorf("database error. failed to delete nested %s bucket: %s", name, err)
+			}
+		}
+
+		err := moveSampleMeta(tx, key, nil)
+		if err != nil {
+			return err
+		}
+
+		return renameNormSample(tx, akey.Gene, akey.Sample, "")
+	})
+
+	return err
+}
+
+// UpdateSample moves all alignments and fragments of the sample to the new
+// key in a single transaction. If the sample name changed the normalization
+// sets are updated to use the new name.
+func (s *Storage) UpdateSample(akey, newKey *treat.AlignmentKey) error {
+	if akey.Gene != newKey.Gene {
+		return fmt.Errorf("Changing the gene of a sample is not supported")
 	}
 
 	key, err := akey.MarshalBinary()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	err = s.InitSample(akey, options.Force)
+	nkey, err := newKey.MarshalBinary()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	s.DB.NoSync = true
-	var tx *bolt.Tx
-	var alnBucket *bolt.Bucket
-	var fragBucket *bolt.Bucket
-	count := 0
-
+	if bytes.Equal(key, nkey) {
+		return nil
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		if akey.Sample != newKey.Sample {
+			gbytes := []byte(akey.Gene)
+			c := tx.Bucket([]byte(BUCKET_ALIGNMENTS)).Cursor()
+			for k, _ := c.Seek(gbytes); bytes.HasPrefix(k, gbytes); k, _ = c.Next() {
+				ekey := new(treat.AlignmentKey)
+				ekey.UnmarshalBinary(k)
+				if ekey.Gene == newKey.Gene && ekey.Sample == newKey.Sample {
+					return fmt.Errorf("Sample %s already exists for gene %s", newKey.Sample, newKey.Gene)
+				}
+			}
+		}
+
+		for _, name := range []string{BUCKET_ALIGNMENTS, BUCKET_FRAGMENTS} {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				return fmt.Errorf("database error. %s bucket does not exist!", name)
+			}
+
+			src := b.Bucket(key)
+			if src == nil {
+				return fmt.Errorf("database error. key not found in %s bucket", name)
+			}
+
+			dst, err := b.CreateBucket(nkey)
+			if err != nil {
+				return fmt.Errorf("database error. failed to create nested %s bucket: %s", name, err)
+			}
+
+			err = src.ForEach(func(k, v []byte) error {
+				return dst.Put(k, v)
+			})
+			if err != nil {
+				return err
+			}
+
+			err = dst.SetSequence(src.Sequence())
+			if err != nil {
+				return err
+			}
+
+			err = b.DeleteBucket(key)
+			if err != nil {
+				return fmt.Errorf("database error. failed to delete nested %s bucket: %s", name, err)
+			}
+		}
+
+		err := moveSampleMeta(tx, key, nkey)
+		if err != nil {
+			return err
+		}
+
+		if akey.Sample != newKey.Sample {
+			return renameNormSample(tx, akey.Gene, akey.Sample, newKey.Sample)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// CopySample copies all alignments, fragments, merge statistics, QC report and
+// mutation policy of the sample to the dst storage using the new key
+func (s *Storage) CopySample(dst *Storage, akey, newKey *treat.AlignmentKey) error {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	nkey, err := newKey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.View(func(stx *bolt.Tx) error {
+		return dst.DB.Update(func(dtx *bolt.Tx) error {
+			for _, name := range []string{BUCKET_ALIGNMENTS, BUCKET_FRAGMENTS} {
+				sb := stx.Bucket([]byte(name))
+				if sb == nil {
+					return fmt.Errorf("database error. %s bucket does not exist!", name)
+				}
+				src := sb.Bucket(key)
+				if src == nil {
+					return fmt.Errorf("database error. key not found in %s bucket", name)
+				}
+
+				db := dtx.Bucket([]byte(name))
+				if db == nil {
+					return fmt.Errorf("database error. %s bucket does not exist!", name)
+				}
+				dstb, err := db.CreateBucket(nkey)
+				if err != nil {
+					return fmt.Errorf("Data already exists for gene %s and sample %s (error: %s)", newKey.Gene, newKey.Sample, err)
+				}
+
+				err = src.ForEach(func(k, v []byte) error {
+					return dstb.Put(k, v)
+				})
+				if err != nil {
+					return err
+				}
+
+				err = dstb.SetSequence(src.Sequence())
+				if err != nil {
+					return err
+				}
+			}
+
+			// Sample templates are linked by the caller as versions differ
+			// between databases
+			for _, name := range []string{BUCKET_SAMPLE_MERGE, BUCKET_SAMPLE_POLICY, BUCKET_SAMPLE_QC} {
+				sb := stx.Bucket([]byte(BUCKET_META)).Bucket([]byte(name))
+				if sb == nil {
+					continue
+				}
+				v := sb.Get(key)
+				if v == nil {
+					continue
+				}
+				db, err := dtx.Bucket([]byte(BUCKET_META)).CreateBucketIfNotExists([]byte(name))
+				if err != nil {
+					return err
+				}
+
+				err = db.Put(nkey, append([]byte(nil), v...))
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	})
+
+	return err
+}
+
+// RealignSample re-aligns the stored fragments of the sample against the
+// template in a single transaction. Read counts and normalized counts of the
+// existing alignments are kept and the QC report is recomputed. Read lengths
+// and N content of the reads as loaded are kept from the existing report as
+// the stored fragments may have been trimmed. Returns the number of fragments
+// aligned.
+func (s *Storage) RealignSample(akey *treat.AlignmentKey, tmpl *treat.Template, policy *treat.MutationPolicy) (int, error) {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	old, err := s.QCReport(akey)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	qc := treat.NewQCReport()
+	chimeras := treat.NewChimeraDetector(policy)
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		ab := tx.Bucket([]byte(BUCKET_ALIGNMENTS)).Bucket(key)
+		if ab == nil {
+			return fmt.Errorf("database error. key not found in %s bucket", BUCKET_ALIGNMENTS)
+		}
+		fb := tx.Bucket([]byte(BUCKET_FRAGMENTS)).Bucket(key)
+		if fb == nil {
+			return fmt.Errorf("database error. key not found in %s bucket", BUCKET_FRAGMENTS)
+		}
+
+		err := fb.ForEach(func(k, v []byte) error {
+			frag := new(treat.Fragment)
+			err := frag.UnmarshalBytes(v)
+			if err != nil {
+				return err
+			}
+
+			orientation := treat.FORWARD
+			primerMissing := uint8(0)
+			molecules := uint32(0)
+			if data := ab.Get(k); data != nil {
+				old := new(treat.Alignment)
+				err = old.UnmarshalBinary(data)
+				if err != nil {
+					return err
+				}
+				frag.ReadCount = old.ReadCount
+				frag.Norm = old.Norm
+				orientation = old.Orientation
+				primerMissing = old.PrimerMissing
+				molecules = old.Molecules
+			}
+
+			// Fragments are stored in forward orientation
+			aln := treat.NewAlignmentPolicy(frag, tmpl, policy)
+			aln.Orientation = orientation
+			aln.PrimerMissing = primerMissing
+			aln.Molecules = molecules
+			if policy.ChimeraParents {
+				chimeras.Add(binary.BigEndian.Uint64(k), aln)
+			}
+			qc.Add(frag.String(), aln, tmpl)
+			data, err := aln.MarshalBinary()
+			if err != nil {
+				return err
+			}
+
+			count++
+			return ab.Put(k, data)
+		})
+		if err != nil {
+			return err
+		}
+
+		if policy.ChimeraParents {
+			reads, err := markChimeras(ab, chimeras.Chimeras())
+			if err != nil {
+				return err
+			}
+			qc.Chimera += reads
+		}
+
+		if count == 0 && ab.Stats().KeyN > 0 {
+			return fmt.Errorf("No fragments stored for gene %s and sample %s. The sample was loaded with --skip-fragments and must be reloaded", akey.Gene, akey.Sample)
+		}
+
+		if old != nil {
+			qc.Lengths = old.Lengths
+			qc.Bases = old.Bases
+			qc.WithN = old.WithN
+			qc.NBases = old.NBases
+		}
+
+		return putSampleMetaTx(tx, BUCKET_SAMPLE_QC, key, qc)
+	})
+
+	return count, err
+}
+
+// markChimeras raises the chimera score of the stored alignments of the reads
+// explained by two parent reads. Returns the number of reads not previously
+// flagged as chimeras.
+func markChimeras(ab *bolt.Bucket, ids []uint64) (uint64, error) {
+	reads := uint64(0)
+	kbytes := make([]byte, 8)
+	for _, id := range ids {
+		binary.BigEndian.PutUint64(kbytes, id)
+		data := ab.Get(kbytes)
+		if data == nil {
+			continue
+		}
+
+		aln := new(treat.Alignment)
+		err := aln.UnmarshalBinary(data)
+		if err != nil {
+			return 0, err
+		}
+
+		if aln.Chimera == 0 {
+			reads += uint64(aln.ReadCount)
+		}
+		if aln.Chimera < 0xff {
+			aln.Chimera++
+		}
+
+		data, err = aln.MarshalBinary()
+		if err != nil {
+			return 0, err
+		}
+
+		err = ab.Put(kbytes, data)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return reads, nil
+}
+
+// renameNormSample renames the sample in all normalization sets of the gene.
+// If name is empty the sample is removed.
+func renameNormSample(tx *bolt.Tx, gene, sample, name string) error {
+	nb := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_NORM))
+	if nb == nil {
+		return nil
+	}
+	gb := nb.Bucket([]byte(gene))
+	if gb == nil {
+		return nil
+	}
+
+	sets := make(map[string]*NormMeta)
+	err := gb.ForEach(func(k, v []byte) error {
+		meta := new(NormMeta)
+		err := json.Unmarshal(v, meta)
+		if err != nil {
+			return err
+		}
+		sets[string(k)] = meta
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, meta := range sets {
+		scale, ok := meta.Scale[sample]
+		if !ok {
+			continue
+		}
+
+		delete(meta.Scale, sample)
+		if len(name) > 0 {
+			meta.Scale[name] = scale
+		}
+
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		err = gb.Put([]byte(k), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.AlignmentKey, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return s.importSample(options, func(add func(rec *gofasta.SeqRecord) error) error {
+		for rec := range gofasta.SimpleParser(f) {
+			err := add(rec)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportPairs merges the paired-end reads and imports the merged reads.
+// Returns the merge statistics of the sample.
+func (s *Storage) ImportPairs(pairs *PairOptions, options *LoadOptions) (*treat.AlignmentKey, *treat.MergeStats, error) {
+	var stats *treat.MergeStats
+	akey, err := s.importSample(options, func(add func(rec *gofasta.SeqRecord) error) error {
+		var err error
+		stats, err = mergePairs(pairs, add)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return akey, stats, nil
+}
+
+// importSample aligns and stores each record passed to add by the read
+// function. With UMIs the records are deduplicated after all are read.
+func (s *Storage) importSample(options *LoadOptions, read func(add func(rec *gofasta.SeqRecord) error) error) (*treat.AlignmentKey, error) {
+	tmpl, err := s.GetTemplate(options.Gene)
+	if err != nil {
+		return nil, err
+	}
+
+	akey := &treat.AlignmentKey{
+		Gene:         options.Gene,
+		Sample:       options.Sample,
+		KnockDown:    options.KnockDown,
+		Tetracycline: options.Tetracycline,
+		Replicate:    options.Replicate,
+	}
+
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.InitSample(akey, options.Force)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the partially loaded sample if the import fails. Batches of
+	// fragments are committed as they are read.
+	loaded := false
+	defer func() {
+		if loaded {
+			return
+		}
+		s.DB.NoSync = false
+		if err := s.DeleteSample(akey); err != nil {
+			logrus.Errorf("Failed to delete partially loaded sample %s: %s", akey.Sample, err)
+		}
+	}()
+
+	orientation, err := treat.ParseOrientation(options.Orientation)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := treat.NewCountParser(options.CountFormat, options.CountPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	s.DB.NoSync = true
+	var tx *bolt.Tx
+	var alnBucket *bolt.Bucket
+	var fragBucket *bolt.Bucket
+	count := 0
+	records := 0
+	noCount := 0
+	reversed := 0
+	noPrimer := 0
+	qc := treat.NewQCReport()
+	chimeras := treat.NewChimeraDetector(options.Policy)
+
 	logrus.Printf("Processing fragments for sample name: %s", options.Sample)
 	if options.SkipFrags {
 		logrus.Info("not storing raw fragment reads")
 	}
 
-	for rec := range gofasta.SimpleParser(f) {
+	// readCount returns the read count in the header of the record
+	readCount := func(rec *gofasta.SeqRecord) uint32 {
+		records++
+		reads, ok := counts.ParseCount(rec.Id)
+		if !ok {
+			noCount++
+			return 1
+		}
+		return reads
+	}
 
+	// store aligns and stores the record with the given raw read count. If
+	// molecules is not 0 the record is a deduplicated sequence.
+	store := func(rec *gofasta.SeqRecord, reads, molecules uint32) error {
 		if count%100 == 0 {
 			if count > 0 {
 				if err := tx.Commit(); err != nil {
-					return nil, err
+					return err
 				}
 				fmt.Printf("\rLoaded %d fragments...", count)
 			}
 			tx, err = s.DB.Begin(true)
 			if err != nil {
-				return nil, err
+				return err
 			}
 			alnBucket = tx.Bucket([]byte(BUCKET_ALIGNMENTS)).Bucket(key)
 			fragBucket = tx.Bucket([]byte(BUCKET_FRAGMENTS)).Bucket(key)
 		}
 
-		frag := treat.NewFragment(rec.Id, rec.Seq, treat.FORWARD, rune(options.EditBase[0]))
-		aln := treat.NewAlignment(frag, tmpl, options.ExcludeSnps)
+		frag, o := treat.NewFragmentOriented(rec.Id, rec.Seq, orientation, options.EditBase, tmpl)
+		frag.ReadCount = reads
+		missing := uint8(0)
+		if tmpl.HasPrimers() {
+			frag, missing = tmpl.TrimPrimers(frag, options.PrimerMismatch)
+			if missing != 0 {
+				noPrimer++
+			}
+		}
+		aln := treat.NewAlignmentPolicy(frag, tmpl, options.Policy)
+		aln.Orientation = o
+		aln.PrimerMissing = missing
+		aln.Molecules = molecules
+		if o == treat.REVERSE {
+			reversed++
+		}
+		qc.Add(rec.Seq, aln, tmpl)
 
 		id, _ := alnBucket.NextSequence()
 		kbytes := make([]byte, 8)
 		binary.BigEndian.PutUint64(kbytes, id)
+		if options.Policy.ChimeraParents {
+			chimeras.Add(id, aln)
+		}
 
 		data, err := aln.MarshalBinary()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		err = alnBucket.Put(kbytes, data)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if !options.SkipFrags {
 			data, err = frag.MarshalBytes()
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			err = fragBucket.Put(kbytes, data)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
 
 		count++
+		return nil
+	}
+
+	if options.UMI.IsSet() {
+		dedup, err := treat.NewUMIDedup(&options.UMI)
+		if err != nil {
+			return nil, err
+		}
+
+		err = read(func(rec *gofasta.SeqRecord) error {
+			dedup.Add(rec.Id, rec.Seq, readCount(rec))
+			return nil
+		})
+		if err == nil {
+			if dedup.Missing > 0 {
+				logrus.Warnf("Skipped %d reads without a UMI", dedup.Missing)
+			}
+			err = dedup.Each(func(id, seq string, reads, molecules uint32) error {
+				return store(&gofasta.SeqRecord{Id: id, Seq: seq}, reads, molecules)
+			})
+		}
+	} else {
+		err = read(func(rec *gofasta.SeqRecord) error {
+			return store(rec, readCount(rec), 0)
+		})
+	}
+	if err != nil {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return nil, err
+	}
+
+	if tx == nil {
+		return nil, fmt.Errorf("No fragments found for sample %s", options.Sample)
 	}
 
 	// final transaction commit
@@ -792,19 +1692,53 @@ func (s *Storage) ImportSample(path string, options *LoadOptions) (*treat.Alignm
 	s.DB.NoSync = false
 	s.DB.Sync()
 
+	if options.Policy.ChimeraParents {
+		err = s.DB.Update(func(tx *bolt.Tx) error {
+			reads, err := markChimeras(tx.Bucket([]byte(BUCKET_ALIGNMENTS)).Bucket(key), chimeras.Chimeras())
+			qc.Chimera += reads
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	fmt.Println()
+	if orientation == treat.AUTO {
+		logrus.Printf("Reverse complemented %d of %d fragment sequences", reversed, count)
+	}
+	if !options.Pairs.IsPaired() && noCount*2 > records {
+		logrus.Warnf("%d of %d records have no read count in the FASTA header and were counted as 1 read. "+
+			"Select the header format with --count-format or --count-pattern", noCount, records)
+	}
+	if noPrimer > 0 {
+		logrus.Warnf("%d of %d fragment sequences lack a primer. List them with 'treat search --no-primer'", noPrimer, count)
+	}
 	logrus.Printf("Done. Loaded %d fragment sequences for sample %s", count, options.Sample)
+	if options.UMI.IsSet() {
+		logrus.Printf("Deduplicated %d reads to %d molecules", qc.Reads, qc.Molecules)
+	}
+	logrus.Printf("QC: %d reads, mean length %.1f, %.2f%% mutant, %.2f%% fully edited, %.2f%% pre-edited, %.2f%% chimeras. View with 'treat qc'",
+		qc.Reads, qc.MeanLength(), qc.Pct(qc.Mutant), qc.Pct(qc.FullyEdited), qc.Pct(qc.PreEdited), qc.Pct(qc.Chimera))
 
+	err = s.SetQCReport(akey, qc)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded = true
 	return akey, nil
 }
 
-func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, norm float64) error {
+// EditStopCounts returns the number of standard reads at each edit stop site
+// for the given sample. If molecules is true unique molecules are counted.
+func (s *Storage) EditStopCounts(akey *treat.AlignmentKey, molecules bool) (map[int]float64, error) {
 	key, err := akey.MarshalBinary()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	total := 0
+	counts := make(map[int]float64)
 	err = s.DB.View(func(tx *bolt.Tx) error {
 		ab := tx.Bucket([]byte(BUCKET_ALIGNMENTS))
 		if ab == nil {
@@ -812,7 +1746,7 @@ func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, norm float64) error
 		}
 
 		b := ab.Bucket(key)
-		if ab == nil {
+		if b == nil {
 			return fmt.Errorf("database error. key not found in alignments bucket")
 		}
 
@@ -827,7 +1761,7 @@ func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, norm float64) error
 
 			// Only count Standard Reads
 			if a.HasMutation == 0 {
-				total += int(a.ReadCount)
+				counts[a.EditStop] += readCount(a, molecules)
 			}
 		}
 
@@ -835,18 +1769,33 @@ func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, norm float64) error
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	scale := 1.0
-	if total > 0 {
-		scale = norm / float64(total)
+	return counts, nil
+}
+
+// NormalizeSample sets the normalized read count of all standard reads in the
+// sample to ReadCount * scale. If mutant is true mutant reads are scaled as
+// well, otherwise their normalized count is set to 0. If molecules is true the
+// number of unique molecules is scaled instead of ReadCount.
+func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, scale float64, mutant, molecules bool) error {
+	key, err := akey.MarshalBinary()
+	if err != nil {
+		return err
 	}
 
 	logrus.Printf("Processing sample %s using normalized scaling factor: %.4f", akey.Sample, scale)
 	err = s.DB.Update(func(tx *bolt.Tx) error {
 		ab := tx.Bucket([]byte(BUCKET_ALIGNMENTS))
+		if ab == nil {
+			return fmt.Errorf("database error. alignments bucket does not exist!")
+		}
+
 		b := ab.Bucket(key)
+		if b == nil {
+			return fmt.Errorf("database error. key not found in alignments bucket")
+		}
 
 		c := b.Cursor()
 		for ak, av := c.First(); ak != nil; ak, av = c.Next() {
@@ -857,8 +1806,10 @@ func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, norm float64) error
 				return err
 			}
 
-			if a.HasMutation == uint8(0) {
-				a.Norm = scale * float64(a.ReadCount)
+			if a.HasMutation == uint8(0) || mutant {
+				a.Norm = scale * readCount(a, molecules)
+			} else {
+				a.Norm = 0
 			}
 
 			data, err := a.MarshalBinary()
@@ -881,3 +1832,187 @@ func (s *Storage) NormalizeSample(akey *treat.AlignmentKey, norm float64) error
 
 	return nil
 }
+
+// PutNormSet stores the named normalization set for the gene, marks it as the
+// active set and records the action in the normalization log
+func (s *Storage) PutNormSet(meta *NormMeta, action string) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.Update(func(tx *bolt.Tx) error {
+		mb := tx.Bucket([]byte(BUCKET_META))
+		nb, err := mb.CreateBucketIfNotExists([]byte(BUCKET_NORM))
+		if err != nil {
+			return err
+		}
+		gb, err := nb.CreateBucketIfNotExists([]byte(meta.Gene))
+		if err != nil {
+			return err
+		}
+		err = gb.Put([]byte(meta.Name), data)
+		if err != nil {
+			return err
+		}
+
+		ab, err := mb.CreateBucketIfNotExists([]byte(BUCKET_NORM_ACTIVE))
+		if err != nil {
+			return err
+		}
+		err = ab.Put([]byte(meta.Gene), []byte(meta.Name))
+		if err != nil {
+			return err
+		}
+
+		lb, err := mb.CreateBucketIfNotExists([]byte(BUCKET_NORM_LOG))
+		if err != nil {
+			return err
+		}
+		id, _ := lb.NextSequence()
+		entry := &NormLogEntry{Id: id, Action: action, Date: time.Now(), Set: meta}
+		ldata, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		kbytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(kbytes, id)
+
+		return lb.Put(kbytes, ldata)
+	})
+
+	return err
+}
+
+func getNormSet(tx *bolt.Tx, gene, name string) (*NormMeta, error) {
+	nb := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_NORM))
+	if nb == nil {
+		return nil, nil
+	}
+	gb := nb.Bucket([]byte(gene))
+	if gb == nil {
+		return nil, nil
+	}
+
+	data := gb.Get([]byte(name))
+	if data == nil {
+		return nil, nil
+	}
+
+	meta := new(NormMeta)
+	err := json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// GetNormSet returns the named normalization set for the gene or nil if it
+// does not exist
+func (s *Storage) GetNormSet(gene, name string) (*NormMeta, error) {
+	var meta *NormMeta
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = getNormSet(tx, gene, name)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// GetNormMeta returns the active normalization set for the gene or nil if the
+// gene has not been normalized
+func (s *Storage) GetNormMeta(gene string) (*NormMeta, error) {
+	var meta *NormMeta
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		ab := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_NORM_ACTIVE))
+		if ab == nil {
+			return nil
+		}
+
+		name := ab.Get([]byte(gene))
+		if name == nil {
+			return nil
+		}
+
+		var err error
+		meta, err = getNormSet(tx, gene, string(name))
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// NormSets returns all named normalization sets for the gene
+func (s *Storage) NormSets(gene string) ([]*NormMeta, error) {
+	sets := make([]*NormMeta, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		nb := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_NORM))
+		if nb == nil {
+			return nil
+		}
+		gb := nb.Bucket([]byte(gene))
+		if gb == nil {
+			return nil
+		}
+
+		return gb.ForEach(func(k, v []byte) error {
+			meta := new(NormMeta)
+			err := json.Unmarshal(v, meta)
+			if err != nil {
+				return err
+			}
+			sets = append(sets, meta)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sets, nil
+}
+
+// NormLog returns the normalization log entries for the gene in the order
+// they were run. If gene is empty entries for all genes are returned.
+func (s *Storage) NormLog(gene string) ([]*NormLogEntry, error) {
+	entries := make([]*NormLogEntry, 0)
+
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		lb := tx.Bucket([]byte(BUCKET_META)).Bucket([]byte(BUCKET_NORM_LOG))
+		if lb == nil {
+			return nil
+		}
+
+		return lb.ForEach(func(k, v []byte) error {
+			entry := new(NormLogEntry)
+			err := json.Unmarshal(v, entry)
+			if err != nil {
+				return err
+			}
+			if len(gene) == 0 || entry.Set.Gene == gene {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ubccr/treat"
+)
+
+// newTestStorage returns a new database in a temporary directory and a
+// function to remove it
+func newTestStorage(t *testing.T) (*Storage, func()) {
+	dir, err := ioutil.TempDir("", "treat")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	s, err := NewStorageWrite(filepath.Join(dir, "treat.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%s", err)
+	}
+
+	err = s.Initialize()
+	if err != nil {
+		s.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("%s", err)
+	}
+
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// putTestTemplate stores the example templates for gene and returns the
+// load options of a sample
+func putTestTemplate(t *testing.T, s *Storage, gene, sample, templates string) *LoadOptions {
+	tmpl, err := treat.NewTemplateFromFastaBases(filepath.Join("..", "..", "examples", templates), treat.FORWARD, "T")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	_, err = s.PutTemplate(gene, tmpl)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	return &LoadOptions{
+		Gene:     gene,
+		Sample:   sample,
+		EditBase: "T",
+		Policy:   treat.DefaultMutationPolicy(),
+	}
+}
+
+// loadTestSample loads the reads of an example FASTA file as a sample of
+// gene aligned to the example templates
+func loadTestSample(t *testing.T, s *Storage, gene, sample, templates, reads string) {
+	options := putTestTemplate(t, s, gene, sample, templates)
+
+	_, err := s.ImportSample(filepath.Join("..", "..", "examples", reads), options)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+}
+
+func TestSearchAltName(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	loadTestSample(t, s, "A6", "alt", "test-templates.fa", "test-sample.fa")
+	loadTestSample(t, s, "SIMPLE", "noalt", "simple-templates.fa", "simple-sequences.fa")
+
+	fields := &SearchFields{EditStop: -1, JuncEnd: -1, JuncLen: -1, MutationAt: -1, All: true, AltName: "A1"}
+	genes := make(map[string]int)
+	err := s.Search(fields, func(k *treat.AlignmentKey, a *treat.Alignment) {
+		genes[k.Gene]++
+		if !a.HasAlt(1) {
+			t.Errorf("Alignment without alt template A1 found: %d", a.Id)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Search by alt name with a gene lacking the alt template failed: %s", err)
+	}
+
+	if genes["SIMPLE"] != 0 {
+		t.Errorf("Found %d alignments for gene without alt template", genes["SIMPLE"])
+	}
+	if genes["A6"] == 0 {
+		t.Errorf("No alignments found for alt template A1")
+	}
+}
+
+func TestImportPairsFailure(t *testing.T) {
+	s, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "treat")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// R2 is missing the last read, which is only found after the first
+	// batches of merged reads are stored
+	amplicon := "AATTCTTGCTTTCTTGTGAATA"
+	var r1, r2 strings.Builder
+	for i := 0; i < 250; i++ {
+		fmt.Fprintf(&r1, "@read%d 1:N:0\n%s\n+\n%s\n", i, amplicon[:16], strings.Repeat("I", 16))
+		if i < 249 {
+			fmt.Fprintf(&r2, "@read%d 2:N:0\n%s\n+\n%s\n", i, treat.ReverseComplement(amplicon[6:]), strings.Repeat("I", 16))
+		}
+	}
+
+	pairs := &PairOptions{
+		R1Path:      filepath.Join(dir, "sample_R1.fastq"),
+		R2Path:      filepath.Join(dir, "sample_R2.fastq"),
+		MinOverlap:  5,
+		MaxMismatch: 0.1,
+	}
+	if err := ioutil.WriteFile(pairs.R1Path, []byte(r1.String()), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := ioutil.WriteFile(pairs.R2Path, []byte(r2.String()), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	options := putTestTemplate(t, s, "A6", "sample", "test-templates.fa")
+	_, _, err = s.ImportPairs(pairs, options)
+	if err == nil {
+		t.Fatalf("Import of R1 and R2 files with a different number of reads succeeded")
+	}
+
+	samples, err := s.Samples("A6")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("Partially loaded samples found after failed import: %v", samples)
+	}
+}
+
+func TestSearchMutationAt(t *testing.T) {
+	a := &treat.Alignment{EditStop: 5, JuncEnd: 5, Mutations: []*treat.Mutation{{Site: 0, Type: treat.SUBSTITUTION, Ref: "A", Alt: "G"}}}
+
+	fields := &SearchFields{EditStop: -1, JuncEnd: -1, JuncLen: -1, MutationAt: -1}
+	if !fields.HasMatch(a) {
+		t.Errorf("Unset mutation site should match all reads")
+	}
+
+	fields.MutationAt = 0
+	if !fields.HasMatch(a) {
+		t.Errorf("Read with mutation at site 0 not matched")
+	}
+
+	fields.MutationAt = 1
+	if fields.HasMatch(a) {
+		t.Errorf("Read without mutation at site 1 matched")
+	}
+}
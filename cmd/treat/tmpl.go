@@ -0,0 +1,511 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aebruno/gofasta"
+	"github.com/ubccr/treat"
+)
+
+type TemplateOptions struct {
+	Gene         string
+	TemplatePath string
+	EditBase     string
+	EditOffset   int
+}
+
+// templateLabel returns the label of the i-th template sequence
+func templateLabel(i int) string {
+	switch i {
+	case 0:
+		return "FE"
+	case 1:
+		return "PE"
+	}
+
+	return fmt.Sprintf("A%d", i-1)
+}
+
+// editSiteString returns the i-th template sequence including edit bases
+func editSiteString(tmpl *treat.Template, i int) string {
+	var buf bytes.Buffer
+
+	for j := range tmpl.EditSite[i] {
+		buf.WriteString(tmpl.EditSeq(i, j))
+		if j < len(tmpl.Bases) {
+			buf.WriteString(string(tmpl.Bases[j]))
+		}
+	}
+
+	return buf.String()
+}
+
+func (o *TemplateOptions) load() (*treat.Template, error) {
+	if len(o.TemplatePath) == 0 {
+		return nil, fmt.Errorf("Please provide path to templates file")
+	}
+	bases, err := treat.ParseEditBases(o.EditBase)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := treat.NewTemplateFromFastaBases(o.TemplatePath, treat.FORWARD, bases)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.EditOffset > 0 {
+		tmpl.SetOffset(o.EditOffset)
+	}
+
+	return tmpl, nil
+}
+
+// templateDiff returns a list of differences between two templates
+func templateDiff(a, b *treat.Template) []string {
+	diff := make([]string, 0)
+
+	if a.Bases != b.Bases {
+		diff = append(diff, fmt.Sprintf("Non-edit bases differ (length %d -> %d)", len(a.Bases), len(b.Bases)))
+		return diff
+	}
+	if a.Gene != b.Gene {
+		diff = append(diff, fmt.Sprintf("Gene: %s -> %s", a.Gene, b.Gene))
+	}
+	if a.EditBaseSet() != b.EditBaseSet() {
+		diff = append(diff, fmt.Sprintf("Edit base: %s -> %s", a.EditBaseSet(), b.EditBaseSet()))
+	}
+	if a.EditOffset != b.EditOffset {
+		diff = append(diff, fmt.Sprintf("Edit site offset: %d -> %d", a.EditOffset, b.EditOffset))
+	}
+	if a.EditStop != b.EditStop {
+		diff = append(diff, fmt.Sprintf("Edit stop site: %d -> %d", a.EditStop, b.EditStop))
+	}
+	if a.Size() != b.Size() {
+		diff = append(diff, fmt.Sprintf("Number of templates: %d -> %d", a.Size(), b.Size()))
+	}
+
+	for i := 0; i < a.Size() && i < b.Size(); i++ {
+		for j := range a.EditSite[i] {
+			if a.EditSite[i][j] != b.EditSite[i][j] {
+				diff = append(diff, fmt.Sprintf("%s edit site %d: %d -> %d", templateLabel(i), a.IndexLabel(a.Len()-1-j), a.EditSite[i][j], b.EditSite[i][j]))
+			} else if a.EditSeq(i, j) != b.EditSeq(i, j) {
+				diff = append(diff, fmt.Sprintf("%s edit site %d: %s -> %s", templateLabel(i), a.IndexLabel(a.Len()-1-j), a.EditSeq(i, j), b.EditSeq(i, j)))
+			}
+		}
+	}
+
+	for i := 0; i < len(a.AltRegion) || i < len(b.AltRegion); i++ {
+		ra, rb := "none", "none"
+		if i < len(a.AltRegion) {
+			ra = fmt.Sprintf("%d-%d %s", a.IndexLabel(a.AltRegion[i].Start), a.IndexLabel(a.AltRegion[i].End), a.AltRegion[i].Name)
+		}
+		if i < len(b.AltRegion) {
+			rb = fmt.Sprintf("%d-%d %s", b.IndexLabel(b.AltRegion[i].Start), b.IndexLabel(b.AltRegion[i].End), b.AltRegion[i].Name)
+		}
+		if ra != rb {
+			diff = append(diff, fmt.Sprintf("A%d region: %s -> %s", i+1, ra, rb))
+		}
+	}
+
+	return diff
+}
+
+func templateVersion(s *Storage, gene string, version uint64) (*treat.Template, uint64, error) {
+	if version == 0 {
+		tmpl, err := s.GetTemplate(gene)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		version, err = s.TemplateVersion(gene)
+		return tmpl, version, err
+	}
+
+	versions, err := s.TemplateVersions(gene)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tmpl, ok := versions[version]
+	if !ok {
+		return nil, 0, fmt.Errorf("Template version %d not found for gene %s", version, gene)
+	}
+
+	return tmpl, version, nil
+}
+
+func TemplateShow(dbpath, gene string, version uint64) {
+	if len(gene) == 0 {
+		logrus.Fatal("Gene name is required")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	tmpl, version, err := templateVersion(s, gene, version)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	current, err := s.TemplateVersion(gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	fmt.Println(strings.Repeat("=", 80))
+	fmt.Println(gene)
+	fmt.Println(strings.Repeat("=", 80))
+	fmt.Printf("%20s%11d\n", "Version:", version)
+	fmt.Printf("%20s%11d\n", "Current Version:", current)
+	fmt.Printf("%20s%11d\n", "Edit Stop:", tmpl.EditStop)
+	fmt.Printf("%20s%11d\n", "Edit Offset:", tmpl.EditOffset)
+	fmt.Printf("%20s%11s\n", "Edit Base:", tmpl.EditBaseSet())
+	if len(tmpl.Gene) > 0 {
+		fmt.Printf("%20s%11s\n", "Template Gene:", tmpl.Gene)
+	}
+	for _, r := range []*treat.Region{tmpl.Primer5, tmpl.Primer3} {
+		if r != nil {
+			fmt.Printf("%20s%11s\n", r.Name+":", fmt.Sprintf("%d-%d", r.Start, r.End))
+		}
+	}
+	for _, r := range tmpl.GuideRNA {
+		fmt.Printf("%20s%11s\n", "gRNA "+r.Name+":", fmt.Sprintf("%d-%d", r.Start, r.End))
+	}
+	for i, r := range tmpl.AltRegion {
+		fmt.Printf("%20s%11s %s\n", fmt.Sprintf("A%d Region:", i+1), fmt.Sprintf("%d-%d", tmpl.IndexLabel(r.Start), tmpl.IndexLabel(r.End)), r.Name)
+	}
+	fmt.Println(strings.Repeat("-", 80))
+	for i := range tmpl.EditSite {
+		fmt.Printf(">%s\n%s\n", templateLabel(i), editSiteString(tmpl, i))
+	}
+	fmt.Println(strings.Repeat("-", 80))
+
+	keys, err := s.SampleKeys(gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	fmt.Printf("%-20s%s\n", "Sample", "Template Version")
+	for _, k := range keys {
+		if k.Gene != gene {
+			continue
+		}
+
+		sversion, err := s.SampleTemplate(k)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		v := "unknown"
+		if sversion > 0 {
+			v = fmt.Sprintf("%d", sversion)
+		}
+		if sversion != current {
+			v += " (needs re-align)"
+		}
+		fmt.Printf("%-20s%s\n", k.Sample, v)
+	}
+}
+
+// TemplateDiff compares a stored template version against another version or
+// a template FASTA file
+func TemplateDiff(dbpath string, options *TemplateOptions, v1, v2 uint64) {
+	if len(options.Gene) == 0 {
+		logrus.Fatal("Gene name is required")
+	}
+
+	s, err := NewStorage(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	a, v1, err := templateVersion(s, options.Gene, v1)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	var b *treat.Template
+	desc := ""
+	if len(options.TemplatePath) > 0 {
+		b, err = options.load()
+		desc = options.TemplatePath
+	} else {
+		b, v2, err = templateVersion(s, options.Gene, v2)
+		desc = fmt.Sprintf("version %d", v2)
+	}
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	fmt.Printf("--- %s version %d\n", options.Gene, v1)
+	fmt.Printf("+++ %s\n", desc)
+
+	diff := templateDiff(a, b)
+	if len(diff) == 0 {
+		fmt.Println("Templates are identical")
+		return
+	}
+
+	for _, d := range diff {
+		fmt.Println(d)
+	}
+}
+
+// TemplateSet stores a new template version for the gene and makes it the
+// current template
+func TemplateSet(dbpath string, options *TemplateOptions) {
+	if len(options.Gene) == 0 {
+		logrus.Fatal("Gene name is required")
+	}
+
+	tmpl, err := options.load()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	s, err := NewStorageWrite(dbpath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	err = s.Initialize()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	version, err := s.PutTemplate(options.Gene, tmpl)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Printf("Template version %d is now current for gene %s", version, options.Gene)
+
+	keys, err := s.SampleKeys(options.Gene)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	stale := make([]string, 0)
+	for _, k := range keys {
+		sversion, err := s.SampleTemplate(k)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if k.Gene == options.Gene && sversion != version {
+			stale = append(stale, k.Sample)
+		}
+	}
+
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		logrus.Warnf("The following samples were aligned against a different template and must be re-aligned using treat realign -g %s: %s", options.Gene, strings.Join(stale, ", "))
+	}
+}
+
+type BuildOptions struct {
+	Gene       string
+	FullPath   string
+	PrePath    string
+	AltPaths   []string
+	EditBase   string
+	EditOffset int
+	Output     string
+	Context    int
+}
+
+// readRecords returns all records in the FASTA file
+func readRecords(path string) ([]*gofasta.SeqRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid FASTA file: %s", err)
+	}
+	defer f.Close()
+
+	recs := make([]*gofasta.SeqRecord, 0)
+	for rec := range gofasta.SimpleParser(f) {
+		recs = append(recs, rec)
+	}
+
+	if len(recs) == 0 {
+		return nil, fmt.Errorf("No sequences found in %s", path)
+	}
+
+	return recs, nil
+}
+
+// writeRecord writes the sequence in FASTA format wrapped at 60 bases
+func writeRecord(buf *bytes.Buffer, id, seq string) {
+	buf.WriteString(">" + id + "\n")
+	for i := 0; i < len(seq); i += 60 {
+		end := i + 60
+		if end > len(seq) {
+			end = len(seq)
+		}
+		buf.WriteString(seq[i:end] + "\n")
+	}
+}
+
+// printMismatches prints each mismatching non-edit base between the full
+// edited sequence and another template sequence. Returns the number of
+// mismatches.
+func printMismatches(label string, full, frag *treat.Fragment, context int) int {
+	mismatches := treat.CompareBases(full, frag, context)
+	if len(mismatches) == 0 {
+		return 0
+	}
+
+	fmt.Printf("%d mismatches between FE and %s non-edit bases:\n", len(mismatches), label)
+	fmt.Printf("%8s %4s %8s %4s  %s\n", "FE Pos", "FE", label+" Pos", label, "Context (non-edit bases)")
+	for _, m := range mismatches {
+		fmt.Printf("%8d %4c %8d %4c  %s\n", m.APos, m.ABase, m.BPos, m.BBase, m.AContext)
+		fmt.Printf("%28s  %s\n", "", m.BContext)
+	}
+	fmt.Println()
+
+	return len(mismatches)
+}
+
+// printNumbering prints the edit site numbering of all sites where the fully
+// edited and pre-edited templates differ and a preview of the sites around
+// the edit stop site
+func printNumbering(tmpl *treat.Template) {
+	fmt.Printf("%20s%11d\n", "Edit Sites:", tmpl.Len())
+	fmt.Printf("%20s%11d\n", "Edit Offset:", tmpl.EditOffset)
+	fmt.Printf("%20s%11d\n", "Edit Stop:", tmpl.EditStop)
+	fmt.Println()
+
+	stop := tmpl.Len() - 1 - (tmpl.EditStop - int(tmpl.EditOffset))
+
+	fmt.Printf("%8s%6s%6s%6s\n", "Site", "FE", "PE", "Base")
+	for j := tmpl.Len() - 1; j >= 0; j-- {
+		near := j >= stop-5 && j <= stop+5
+		if tmpl.EditSite[0][j] == tmpl.EditSite[1][j] && !near {
+			continue
+		}
+
+		base := "-"
+		if j < len(tmpl.Bases) {
+			base = string(tmpl.Bases[j])
+		}
+
+		mark := ""
+		if j == stop {
+			mark = "  <- edit stop"
+		}
+
+		fmt.Printf("%8d%6d%6d%6s%s\n", tmpl.IndexLabel(tmpl.Len()-1-j), tmpl.EditSite[0][j], tmpl.EditSite[1][j], base, mark)
+	}
+}
+
+// TemplateBuild builds a template FASTA file from fully edited, pre-edited
+// and optional alt edited sequences. Mismatching non-edit bases are reported
+// and no file is written.
+func TemplateBuild(options *BuildOptions) {
+	if len(options.FullPath) == 0 || len(options.PrePath) == 0 {
+		logrus.Fatal("Please provide the fully edited and pre-edited sequences")
+	}
+	bases, err := treat.ParseEditBases(options.EditBase)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	options.EditBase = bases
+	if len(options.Output) == 0 {
+		logrus.Fatal("Please provide an output file")
+	}
+	if _, err := os.Stat(options.Output); err == nil {
+		logrus.Fatalf("Output file %s already exists", options.Output)
+	}
+
+	full, err := readRecords(options.FullPath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	pre, err := readRecords(options.PrePath)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	alt := make([]*gofasta.SeqRecord, 0)
+	for _, path := range options.AltPaths {
+		recs, err := readRecords(path)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		alt = append(alt, recs...)
+	}
+
+	fe := treat.NewFragmentBases(full[0].Id, full[0].Seq, treat.FORWARD, bases)
+	pe := treat.NewFragmentBases(pre[0].Id, pre[0].Seq, treat.FORWARD, bases)
+
+	count := printMismatches("PE", fe, pe, options.Context)
+	for i, rec := range alt {
+		frag := treat.NewFragmentBases(rec.Id, rec.Seq, treat.FORWARD, bases)
+		count += printMismatches(templateLabel(i+2), fe, frag, options.Context)
+	}
+
+	if count > 0 {
+		logrus.Fatalf("Found %d mismatching non-edit bases. Template file was not written", count)
+	}
+
+	var buf bytes.Buffer
+	header := "Fully Edited edit_base=" + fe.EditBaseSet()
+	if len(options.Gene) > 0 {
+		header += " gene=" + options.Gene
+	}
+	if options.EditOffset > 0 {
+		header += fmt.Sprintf(" offset=%d", options.EditOffset)
+	}
+
+	writeRecord(&buf, header, fe.String())
+	writeRecord(&buf, "Pre-Edited", pe.String())
+	for _, rec := range alt {
+		writeRecord(&buf, rec.Id, treat.NewFragmentBases(rec.Id, rec.Seq, treat.FORWARD, bases).String())
+	}
+
+	out, err := os.OpenFile(options.Output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	_, err = buf.WriteTo(out)
+	out.Close()
+	if err != nil {
+		os.Remove(options.Output)
+		logrus.Fatal(err)
+	}
+
+	// Validate the written file the same way load does
+	tmpl, err := treat.NewTemplateFromFastaBases(options.Output, treat.FORWARD, bases)
+	if err != nil {
+		os.Remove(options.Output)
+		logrus.Fatal(err)
+	}
+
+	printNumbering(tmpl)
+
+	logrus.Printf("Wrote template with %d sequences to %s", tmpl.Size(), options.Output)
+}
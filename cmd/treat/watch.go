@@ -0,0 +1,188 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// dbFiles returns the absolute paths of the database files found at dbpath.
+// If dbpath is a directory all *.db files in the directory are returned.
+func dbFiles(dbpath string) ([]string, error) {
+	abs, err := filepath.Abs(dbpath)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return []string{abs}, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(abs, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// watchDbs periodically scans the database path for new, changed or removed
+// database files until the application is closed.
+func (a *Application) watchDbs(interval time.Duration) {
+	logrus.Infof("Scanning for database changes every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.quit:
+			return
+		case <-ticker.C:
+			a.scanDbs()
+		}
+	}
+}
+
+func (a *Application) scanDbs() {
+	files, err := dbFiles(a.dbPath)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path":  a.dbPath,
+			"error": err.Error(),
+		}).Error("Failed to scan for database files")
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, path := range files {
+		base := filepath.Base(path)
+		found[base] = true
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			// File was removed during the scan
+			continue
+		}
+
+		a.RLock()
+		db, exists := a.dbs[base]
+		a.RUnlock()
+
+		if exists && db.updating {
+			continue
+		}
+
+		if exists && !db.loading && db.modTime.Equal(fi.ModTime()) && db.size == fi.Size() {
+			continue
+		}
+
+		if !exists {
+			logrus.Infof("Found new database: %s", base)
+			a.Lock()
+			a.dbs[base] = &Database{name: base, path: path, loading: true}
+			a.Unlock()
+		} else if !db.loading {
+			logrus.Infof("Database changed on disk: %s", base)
+		}
+
+		a.refreshDb(base, path)
+	}
+
+	a.Lock()
+	removed := make([]*Database, 0)
+	for name, db := range a.dbs {
+		if !found[name] {
+			removed = append(removed, db)
+			delete(a.dbs, name)
+		}
+	}
+	if _, ok := a.dbs[a.defaultDb]; !ok {
+		a.defaultDb = ""
+		names := make([]string, 0, len(a.dbs))
+		for name := range a.dbs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) > 0 {
+			a.defaultDb = names[0]
+		}
+	}
+	a.Unlock()
+
+	for _, db := range removed {
+		logrus.Infof("Database removed: %s", db.name)
+		db.Close()
+	}
+}
+
+// refreshDb builds the caches for the database at path without holding the
+// application lock and then swaps it in, closing any previous instance. If
+// the database fails to load a loading placeholder is kept so the load is
+// retried on the next scan.
+func (a *Application) refreshDb(base, path string) {
+	db, err := a.openDatabase(base, path)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"dbname": base,
+			"error":  err.Error(),
+		}).Warn("Failed to load database. Will retry on next scan")
+		a.Lock()
+		if old, ok := a.dbs[base]; ok && !old.loading {
+			// Keep serving the previous version
+			a.Unlock()
+			return
+		}
+		a.dbs[base] = &Database{name: base, path: path, loading: true}
+		a.Unlock()
+		return
+	}
+
+	a.Lock()
+	select {
+	case <-a.quit:
+		// Application was closed while the database was loading
+		a.Unlock()
+		db.Close()
+		return
+	default:
+	}
+	old := a.dbs[base]
+	a.dbs[base] = db
+	if len(a.defaultDb) == 0 {
+		a.defaultDb = base
+	}
+	a.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	logrus.Infof("Database loaded: %s", base)
+}
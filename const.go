@@ -21,3 +21,49 @@ type OrientationType int8
 
 const FORWARD OrientationType = 1
 const REVERSE OrientationType = -1
+
+// Maximum number of bases before a primer at the ends of a read
+const MAX_PRIMER_OFFSET = 5
+
+// Size of the k-mers used to detect the orientation of reads
+const ORIENT_KMER_SIZE = 10
+
+// AUTO selects the orientation of each read which best aligns to the template
+const AUTO OrientationType = 0
+
+// Maximum number of alt templates per gene
+const MAX_ALT_TEMPLATES = 64
+
+// Default maximum number of mismatches before a read is classified as a mutant
+const DEFAULT_MAX_MISMATCHES = 2
+
+// Minimum length of a run of one base in the template for indels of that
+// base to be flagged as likely sequencing errors
+const MIN_HOMOPOLYMER = 3
+
+// Default maximum number of switches between fully edited and pre-edited
+// matches beyond the junction before a read is flagged as a likely chimera
+const DEFAULT_MAX_SWITCHES = 2
+
+// Minimum number of consecutive sites matching only the fully edited or only
+// the pre-edited template counted as a switch between the templates. Shorter
+// runs are common within junctions.
+const MIN_SWITCH_RUN = 3
+
+// Default minimum abundance of parent reads relative to a chimera
+const DEFAULT_CHIMERA_SKEW = 2.0
+
+// Maximum number of the most abundant reads checked as chimera parents
+const MAX_CHIMERA_PARENTS = 100
+
+// Default maximum number of mismatches between UMIs of the same molecule
+const DEFAULT_UMI_DISTANCE = 1
+
+// Formats of the read count in the header of collapsed reads. AUTO tries
+// each of the built-in formats.
+const COUNT_AUTO = "auto"
+const COUNT_FASTX = "fastx"
+const COUNT_USEARCH = "usearch"
+const COUNT_VSEARCH = "vsearch"
+const COUNT_SEQKIT = "seqkit"
+const COUNT_NONE = "none"
@@ -19,8 +19,9 @@ package treat
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"regexp"
-	"strconv"
 	"strings"
 	"unicode"
 
@@ -38,6 +39,7 @@ var BASE_COMP = map[byte]byte{
 	[]byte("G")[0]: []byte("C")[0],
 	[]byte("T")[0]: []byte("A")[0],
 	[]byte("N")[0]: []byte("N")[0],
+	[]byte("U")[0]: []byte("A")[0],
 }
 
 // fastx_collapser will output fasta headers in the format [id]-[count]
@@ -54,6 +56,10 @@ var BASE_COMP = map[byte]byte{
 //     >791-2082
 var fastxPattern = regexp.MustCompile(`.+[_\-](\d+)$`)
 
+// Fragment is a sequence split into non-edit bases and the edit bases
+// inserted at each edit site. EditSite holds the number of edit bases at each
+// site. When more than one edit base is modelled, EditBases holds the set of
+// edit bases and SiteSeq the edit bases found at each site.
 type Fragment struct {
 	Name      string
 	ReadCount uint32
@@ -61,6 +67,8 @@ type Fragment struct {
 	Bases     string
 	EditBase  rune
 	EditSite  []uint32
+	EditBases string
+	SiteSeq   []string
 }
 
 // From: http://stackoverflow.com/a/10030772
@@ -72,52 +80,162 @@ func reverse(s string) string {
 	return string(runes)
 }
 
+// parseMergeCount returns the read count in a fastx-collapser header or 1
 func parseMergeCount(recId string) uint32 {
-	// First try and parse fastx-collapser header lines
-	parts := strings.SplitN(strings.TrimSpace(recId), " ", 2)
-	matches := fastxPattern.FindStringSubmatch(parts[0])
-	if len(matches) == 2 {
-		count, err := strconv.Atoi(matches[1])
-		if err != nil {
-			return uint32(1)
-		}
-
-		return uint32(count)
+	count, ok := fastxParser.ParseCount(recId)
+	if !ok {
+		return uint32(1)
 	}
 
-	return uint32(1)
+	return count
 }
 
 func NewFragment(name, seq string, orientation OrientationType, base rune) *Fragment {
-	base = unicode.ToUpper(base)
+	return NewFragmentBases(name, seq, orientation, string(base))
+}
+
+// NewFragmentBases creates a new fragment using the set of edit bases given
+// in bases
+func NewFragmentBases(name, seq string, orientation OrientationType, bases string) *Fragment {
+	bases = strings.ToUpper(bases)
 
 	// Ensure all sequences are in forward 5' -> 3' orientation
 	if orientation == REVERSE {
-		seq = reverse(seq)
+		seq = ReverseComplement(seq)
 	}
 
 	seq = strings.ToUpper(seq)
-	base3 := strings.Replace(seq, string(base), "", -1)
+	isEdit := func(r rune) bool {
+		return strings.ContainsRune(bases, r)
+	}
+
+	base3 := strings.Map(func(r rune) rune {
+		if isEdit(r) {
+			return -1
+		}
+		return r
+	}, seq)
 	n := len(base3) + 1
 	editSite := make([]uint32, n)
+	multi := len(bases) > 1
+	var siteSeq []string
+	if multi {
+		siteSeq = make([]string, n)
+	}
 
 	baseCount := uint32(0)
 	index := 0
+	var site bytes.Buffer
 	procBases := func(r rune) rune {
-		if r != base {
+		if !isEdit(r) {
 			editSite[index] = baseCount
+			if multi {
+				siteSeq[index] = site.String()
+				site.Reset()
+			}
 			baseCount = 0
 			index++
 			return r
 		}
 		baseCount++
+		if multi {
+			site.WriteRune(r)
+		}
 		return -1
 	}
-	bases := strings.Map(procBases, seq)
+	nonEdit := strings.Map(procBases, seq)
 	editSite[index] = baseCount
+	if multi {
+		siteSeq[index] = site.String()
+	}
 	reads := parseMergeCount(name)
 
-	return &Fragment{Name: name, ReadCount: reads, Bases: bases, EditBase: base, EditSite: editSite}
+	frag := &Fragment{Name: name, ReadCount: reads, Bases: nonEdit, EditSite: editSite}
+	if len(bases) > 0 {
+		frag.EditBase = rune(bases[0])
+	}
+	if multi {
+		frag.EditBases = bases
+		frag.SiteSeq = siteSeq
+	}
+
+	return frag
+}
+
+// NewFragmentOriented creates a new fragment in the given orientation. With
+// AUTO the non-edit bases of both the forward and reverse complement sequence
+// are scored against the non-edit bases of the template and the better
+// scoring orientation is used. Returns the fragment and the orientation used.
+func NewFragmentOriented(name, seq string, orientation OrientationType, bases string, tmpl *Template) (*Fragment, OrientationType) {
+	if orientation != AUTO {
+		return NewFragmentBases(name, seq, orientation, bases), orientation
+	}
+
+	fwd := NewFragmentBases(name, seq, FORWARD, bases)
+	rev := NewFragmentBases(name, seq, REVERSE, bases)
+
+	if tmpl.orientScore(rev.Bases) > tmpl.orientScore(fwd.Bases) {
+		return rev, REVERSE
+	}
+
+	return fwd, FORWARD
+}
+
+// ParseOrientation parses the orientation names forward, reverse and auto
+func ParseOrientation(val string) (OrientationType, error) {
+	switch strings.ToLower(val) {
+	case "", "forward", "+":
+		return FORWARD, nil
+	case "reverse", "-":
+		return REVERSE, nil
+	case "auto":
+		return AUTO, nil
+	}
+
+	return FORWARD, fmt.Errorf("Invalid orientation %s. Must be forward, reverse or auto", val)
+}
+
+func (o OrientationType) String() string {
+	switch o {
+	case FORWARD:
+		return "forward"
+	case REVERSE:
+		return "reverse"
+	case AUTO:
+		return "auto"
+	}
+
+	return "unknown"
+}
+
+// EditBaseSet returns the set of edit bases of the fragment
+func (f *Fragment) EditBaseSet() string {
+	if len(f.EditBases) > 0 {
+		return f.EditBases
+	}
+
+	return string(f.EditBase)
+}
+
+// EditSeq returns the edit bases at the i-th edit site
+func (f *Fragment) EditSeq(i int) string {
+	if f.SiteSeq != nil {
+		return f.SiteSeq[i]
+	}
+
+	return strings.Repeat(string(f.EditBase), int(f.EditSite[i]))
+}
+
+// EditCount returns the number of the given edit base at the i-th edit site
+func (f *Fragment) EditCount(i int, base rune) uint32 {
+	if f.SiteSeq == nil {
+		if unicode.ToUpper(base) == f.EditBase {
+			return f.EditSite[i]
+		}
+		return 0
+	}
+
+	return uint32(strings.Count(f.SiteSeq[i], string(unicode.ToUpper(base))))
 }
 
 func (f *Fragment) ToFasta() string {
@@ -136,8 +254,8 @@ func (f *Fragment) Len() int {
 func (f *Fragment) String() string {
 	var buf bytes.Buffer
 
-	for i, b := range f.EditSite {
-		buf.WriteString(strings.Repeat(string(f.EditBase), int(b)))
+	for i := range f.EditSite {
+		buf.WriteString(f.EditSeq(i))
 		if i < len(f.Bases) {
 			buf.WriteString(string(f.Bases[i]))
 		}
@@ -160,14 +278,27 @@ func (f *Fragment) EncodeMsgpack(enc *msgpack.Encoder) error {
 		f.Norm,
 		f.Bases,
 		f.EditBase,
-		f.EditSite)
+		f.EditSite,
+		f.EditBases,
+		f.SiteSeq)
 }
 
 func (f *Fragment) DecodeMsgpack(dec *msgpack.Decoder) error {
-	return dec.Decode(&f.Name,
+	err := dec.Decode(&f.Name,
 		&f.ReadCount,
 		&f.Norm,
 		&f.Bases,
 		&f.EditBase,
 		&f.EditSite)
+	if err != nil {
+		return err
+	}
+
+	// Fragments stored before multi-base editing end here
+	err = dec.Decode(&f.EditBases, &f.SiteSeq)
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
 }
@@ -20,6 +20,8 @@ package treat
 import (
 	"strings"
 	"testing"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 func TestFragment(t *testing.T) {
@@ -36,10 +38,10 @@ func TestFragment(t *testing.T) {
 			t.Errorf("%d != %d", 1, frag.ReadCount)
 		}
 
-		// reverse orientation
+		// reverse complement orientation
 		frag = NewFragment("1-143", s, REVERSE, 't')
 
-		if strings.ToUpper(reverse(s)) != frag.String() {
+		if ReverseComplement(s) != frag.String() {
 			t.Errorf("%s != %s", s, frag.String())
 		}
 
@@ -74,3 +76,47 @@ func TestParseReadCounts(t *testing.T) {
 		}
 	}
 }
+
+func TestFragmentMultiBase(t *testing.T) {
+	frag := NewFragmentBases("1-5", "ATCCTGtcA", FORWARD, "tc")
+
+	if frag.Bases != "AGA" {
+		t.Errorf("Wrong non-edit bases. %s != %s", frag.Bases, "AGA")
+	}
+	if frag.String() != "ATCCTGTCA" {
+		t.Errorf("%s != %s", frag.String(), "ATCCTGTCA")
+	}
+	if frag.EditSite[1] != 4 || frag.EditSeq(1) != "TCCT" || frag.EditCount(1, 'c') != 2 {
+		t.Errorf("Wrong edit site. %d %s", frag.EditSite[1], frag.EditSeq(1))
+	}
+
+	data, err := frag.MarshalBytes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	other := new(Fragment)
+	err = other.UnmarshalBytes(data)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if other.String() != frag.String() || other.EditBaseSet() != "TC" {
+		t.Errorf("Fragment not preserved. %s != %s", other.String(), frag.String())
+	}
+
+	// Fragments stored before multi-base editing
+	single := NewFragment("1-5", "ATCCTGTCA", FORWARD, 't')
+	data, err = msgpack.Marshal(single.Name, single.ReadCount, single.Norm, single.Bases, single.EditBase, single.EditSite)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	other = new(Fragment)
+	err = other.UnmarshalBytes(data)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if other.String() != single.String() || other.EditBaseSet() != "T" {
+		t.Errorf("Fragment not preserved. %s != %s", other.String(), single.String())
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// usearch and vsearch append the size of each cluster to the header, for
+// example:
+//
+//	> Uniq1;size=2082;
+var usearchPattern = regexp.MustCompile(`(?:^|[;\s])size=(\d+)(?:[;\s]|$)`)
+
+// seqkit and similar tools append the count of each unique sequence to the
+// header, for example:
+//
+//	> seq1 count:2082
+var seqkitPattern = regexp.MustCompile(`(?:^|[;|\s])count:(\d+)(?:[;|\s]|$)`)
+
+// CountParser parses the read count of a collapsed read from the header of
+// the FASTA record
+type CountParser interface {
+	// ParseCount returns the read count in the header or false if the
+	// header has no read count
+	ParseCount(header string) (uint32, bool)
+}
+
+// PatternParser parses the read count from the first capture group of a
+// regular expression. With FirstField only the header up to the first space
+// is matched.
+type PatternParser struct {
+	Pattern    *regexp.Regexp
+	FirstField bool
+}
+
+// AutoParser tries each parser in order and returns the first read count
+// found
+type AutoParser []CountParser
+
+var fastxParser = &PatternParser{Pattern: fastxPattern, FirstField: true}
+
+// noCountParser counts every record as a single read
+type noCountParser struct{}
+
+var countParsers = map[string]CountParser{
+	COUNT_FASTX:   fastxParser,
+	COUNT_USEARCH: &PatternParser{Pattern: usearchPattern},
+	COUNT_VSEARCH: &PatternParser{Pattern: usearchPattern},
+	COUNT_SEQKIT:  &PatternParser{Pattern: seqkitPattern},
+	COUNT_NONE:    noCountParser{},
+}
+
+func (p *PatternParser) ParseCount(header string) (uint32, bool) {
+	header = strings.TrimSpace(header)
+	if p.FirstField {
+		header = strings.SplitN(header, " ", 2)[0]
+	}
+
+	matches := p.Pattern.FindStringSubmatch(header)
+	if len(matches) < 2 {
+		return 0, false
+	}
+
+	count, err := strconv.ParseUint(matches[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint32(count), true
+}
+
+func (p AutoParser) ParseCount(header string) (uint32, bool) {
+	for _, parser := range p {
+		if count, ok := parser.ParseCount(header); ok {
+			return count, true
+		}
+	}
+
+	return 0, false
+}
+
+func (p noCountParser) ParseCount(header string) (uint32, bool) {
+	return 1, true
+}
+
+// RegisterCountParser adds a named header format which can be selected with
+// NewCountParser
+func RegisterCountParser(name string, parser CountParser) {
+	countParsers[strings.ToLower(name)] = parser
+}
+
+// CountFormats returns the names of the header formats
+func CountFormats() []string {
+	names := []string{COUNT_AUTO}
+	for name := range countParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+
+	return names
+}
+
+// NewCountParser returns the parser of the named header format or, if
+// pattern is given, a parser of the first capture group of the regular
+// expression. The auto format tries the usearch, seqkit and fastx formats in
+// order.
+func NewCountParser(format, pattern string) (CountParser, error) {
+	if len(pattern) > 0 {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid read count header pattern: %s", err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("Read count header pattern must contain a capture group: %s", pattern)
+		}
+
+		return &PatternParser{Pattern: re}, nil
+	}
+
+	format = strings.ToLower(format)
+	if format == "" || format == COUNT_AUTO {
+		return AutoParser{&PatternParser{Pattern: usearchPattern}, &PatternParser{Pattern: seqkitPattern}, fastxParser}, nil
+	}
+
+	parser, ok := countParsers[format]
+	if !ok {
+		return nil, fmt.Errorf("Invalid read count header format %s. Must be one of: %s", format, strings.Join(CountFormats(), ", "))
+	}
+
+	return parser, nil
+}
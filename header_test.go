@@ -0,0 +1,75 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCountParser(t *testing.T) {
+	tests := []struct {
+		format  string
+		pattern string
+		header  string
+		count   uint32
+		ok      bool
+	}{
+		{"auto", "", "Uniq1;size=2082;", 2082, true},
+		{"auto", "", "Uniq1;size=2082", 2082, true},
+		{"auto", "", "seq1 count:2082", 2082, true},
+		{"auto", "", "132-2082", 2082, true},
+		{"auto", "", "read1", 0, false},
+		{"usearch", "", "132-2082", 0, false},
+		{"vsearch", "", "Uniq1;size=12;ee=0.1", 12, true},
+		{"usearch", "", "Uniq1;xsize=12;", 0, false},
+		{"seqkit", "", "seq1|count:7", 7, true},
+		{"fastx", "", "Uniq1;size=2082;", 0, false},
+		{"none", "", "132-2082", 1, true},
+		{"", `reads=(\d+)`, "seq1 reads=42", 42, true},
+		{"", `reads=(\d+)`, "seq1", 0, false},
+	}
+
+	for _, test := range tests {
+		parser, err := NewCountParser(test.format, test.pattern)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+
+		count, ok := parser.ParseCount(test.header)
+		if ok != test.ok || count != test.count {
+			t.Errorf("%s %s: wrong count for %s: %d %t != %d %t", test.format, test.pattern, test.header, count, ok, test.count, test.ok)
+		}
+	}
+
+	if _, err := NewCountParser("bogus", ""); err == nil {
+		t.Errorf("Invalid format accepted")
+	}
+	if _, err := NewCountParser("", "reads"); err == nil {
+		t.Errorf("Pattern without capture group accepted")
+	}
+
+	RegisterCountParser("custom", &PatternParser{Pattern: regexp.MustCompile(`^(\d+)x`)})
+	parser, err := NewCountParser("Custom", "")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if count, ok := parser.ParseCount("12x_read"); !ok || count != 12 {
+		t.Errorf("Wrong count from registered parser: %d", count)
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FastqRecord is a single FASTQ sequence with quality scores
+type FastqRecord struct {
+	Id   string
+	Seq  string
+	Qual string
+}
+
+// FastqReader reads FASTQ records one at a time
+type FastqReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// MergeOptions control how paired-end reads are merged
+type MergeOptions struct {
+	// Minimum number of overlapping bases
+	MinOverlap int
+
+	// Maximum fraction of mismatching bases in the overlap
+	MaxMismatch float64
+}
+
+// MergeStats summarizes the merging of paired-end reads for a sample
+type MergeStats struct {
+	Pairs      int `json:"pairs"`
+	Merged     int `json:"merged"`
+	Unmerged   int `json:"unmerged"`
+	Staggered  int `json:"staggered"`
+	Mismatches int `json:"mismatches"`
+	Overlap    int `json:"overlap"`
+}
+
+func NewFastqReader(r io.Reader) *FastqReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &FastqReader{scanner: scanner}
+}
+
+func (r *FastqReader) next() (string, bool) {
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimRight(r.scanner.Text(), "\r")
+		if len(line) > 0 {
+			return line, true
+		}
+	}
+
+	return "", false
+}
+
+// Read returns the next record. Returns io.EOF when there are no more
+// records.
+func (r *FastqReader) Read() (*FastqRecord, error) {
+	header, ok := r.next()
+	if !ok {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	if header[0] != '@' {
+		return nil, fmt.Errorf("Invalid FASTQ record at line %d. Expected header starting with @", r.line)
+	}
+
+	rec := &FastqRecord{Id: header[1:]}
+
+	var plus string
+	rec.Seq, ok = r.next()
+	if ok {
+		plus, ok = r.next()
+	}
+	if ok {
+		rec.Qual, ok = r.next()
+	}
+	if !ok {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Truncated FASTQ record %s", rec.Id)
+	}
+
+	if plus[0] != '+' {
+		return nil, fmt.Errorf("Invalid FASTQ record %s at line %d. Expected + separator", rec.Id, r.line-1)
+	}
+	if len(rec.Seq) != len(rec.Qual) {
+		return nil, fmt.Errorf("Invalid FASTQ record %s. Sequence and quality differ in length", rec.Id)
+	}
+
+	return rec, nil
+}
+
+// ReverseComplement returns the reverse complement of seq. Bases without a
+// complement in BASE_COMP are replaced with N.
+func ReverseComplement(seq string) string {
+	seq = strings.ToUpper(seq)
+	rc := make([]byte, len(seq))
+	for i := 0; i < len(seq); i++ {
+		c, ok := BASE_COMP[seq[i]]
+		if !ok {
+			c = 'N'
+		}
+		rc[len(seq)-1-i] = c
+	}
+
+	return string(rc)
+}
+
+// overlapMismatches returns the start and end of the overlap in s1 when s2
+// starts at position p of s1 and the number of mismatches in the overlap
+func overlapMismatches(s1, s2 string, p int) (int, int, int) {
+	start, end := p, p+len(s2)
+	if start < 0 {
+		start = 0
+	}
+	if end > len(s1) {
+		end = len(s1)
+	}
+
+	mm := 0
+	for i := start; i < end; i++ {
+		b1, b2 := s1[i], s2[i-p]
+		if b1 != b2 && b1 != 'N' && b2 != 'N' {
+			mm++
+		}
+	}
+
+	return start, end, mm
+}
+
+// MergePair merges a pair of reads from opposite strands of the same
+// amplicon. R2 is reverse complemented and overlapped with the 3' end of R1.
+// The overlap with the lowest fraction of mismatches is used and mismatches
+// are resolved using the base with the higher quality. If the reads do not
+// overlap this way, staggered overlaps are tried where the amplicon is
+// shorter than the reads and each read runs into adapter sequence past the
+// start of the other. The overhangs are trimmed. Returns nil if the reads do
+// not overlap. Also returns the length of the overlap, the number of
+// mismatches resolved and whether the overlap was staggered.
+func MergePair(r1, r2 *FastqRecord, options *MergeOptions) (*FastqRecord, int, int, bool) {
+	s1 := strings.ToUpper(r1.Seq)
+	q1 := r1.Qual
+	s2 := ReverseComplement(r2.Seq)
+	q2 := reverse(r2.Qual)
+
+	max := len(s1)
+	if len(s2) < max {
+		max = len(s2)
+	}
+
+	best := -1
+	bestRate := 0.0
+	bestPos := 0
+	for ov := max; ov >= options.MinOverlap && ov > 0; ov-- {
+		p := len(s1) - ov
+		_, _, mm := overlapMismatches(s1, s2, p)
+
+		rate := float64(mm) / float64(ov)
+		if rate <= options.MaxMismatch && (best == -1 || rate < bestRate) {
+			best = ov
+			bestRate = rate
+			bestPos = p
+		}
+	}
+
+	// Staggered overlaps where R2 starts before the 5' end of R1 or ends
+	// before the 3' end of R1
+	staggered := false
+	if best == -1 {
+		for p := len(s1) - 1; p > -len(s2); p-- {
+			if p >= 0 && p+len(s2) >= len(s1) {
+				continue
+			}
+			start, end, mm := overlapMismatches(s1, s2, p)
+			ov := end - start
+			if ov < options.MinOverlap || ov == 0 {
+				continue
+			}
+
+			rate := float64(mm) / float64(ov)
+			if rate <= options.MaxMismatch && (best == -1 || rate < bestRate || (rate == bestRate && ov > best)) {
+				best = ov
+				bestRate = rate
+				bestPos = p
+				staggered = true
+			}
+		}
+	}
+
+	if best == -1 {
+		return nil, 0, 0, false
+	}
+
+	start, end, _ := overlapMismatches(s1, s2, bestPos)
+	seq := []byte(s1[:start])
+	qual := []byte(q1[:start])
+	mismatches := 0
+	for i := start; i < end; i++ {
+		j := i - bestPos
+		b1, b2 := s1[i], s2[j]
+		if b1 != b2 && b1 != 'N' && b2 != 'N' {
+			mismatches++
+		}
+		if b1 == 'N' || (b2 != 'N' && q2[j] > q1[i]) {
+			seq = append(seq, b2)
+			qual = append(qual, q2[j])
+		} else {
+			seq = append(seq, b1)
+			qual = append(qual, q1[i])
+		}
+	}
+	seq = append(seq, s2[end-bestPos:]...)
+	qual = append(qual, q2[end-bestPos:]...)
+
+	id := strings.SplitN(r1.Id, " ", 2)[0]
+
+	return &FastqRecord{Id: id, Seq: string(seq), Qual: string(qual)}, best, mismatches, staggered
+}
+
+// Add records the result of merging a pair of reads
+func (m *MergeStats) Add(rec *FastqRecord, overlap, mismatches int, staggered bool) {
+	m.Pairs++
+	if rec == nil {
+		m.Unmerged++
+		return
+	}
+
+	m.Merged++
+	m.Overlap += overlap
+	m.Mismatches += mismatches
+	if staggered {
+		m.Staggered++
+	}
+}
+
+// MergedPct returns the percent of pairs merged
+func (m *MergeStats) MergedPct() float64 {
+	if m.Pairs == 0 {
+		return 0
+	}
+
+	return float64(m.Merged) * 100 / float64(m.Pairs)
+}
+
+// MeanOverlap returns the mean overlap length of merged pairs
+func (m *MergeStats) MeanOverlap() float64 {
+	if m.Merged == 0 {
+		return 0
+	}
+
+	return float64(m.Overlap) / float64(m.Merged)
+}
+
+func (m *MergeStats) String() string {
+	return fmt.Sprintf("%d pairs, %d merged (%.1f%%) of which %d staggered, %d unmerged, mean overlap %.1f, %d mismatches resolved",
+		m.Pairs, m.Merged, m.MergedPct(), m.Staggered, m.Unmerged, m.MeanOverlap(), m.Mismatches)
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReverseComplement(t *testing.T) {
+	if rc := ReverseComplement("AACGTtx"); rc != "NAACGTT" {
+		t.Errorf("%s != %s", rc, "NAACGTT")
+	}
+}
+
+func TestMergePair(t *testing.T) {
+	amplicon := "ATGCTTAGGCTATTTGCAAGGTCCTAGATTGCA"
+	options := &MergeOptions{MinOverlap: 10, MaxMismatch: 0.1}
+
+	r1 := &FastqRecord{Id: "read1 1:N:0", Seq: amplicon[:22], Qual: strings.Repeat("I", 22)}
+	r2 := &FastqRecord{Id: "read1 2:N:0", Seq: ReverseComplement(amplicon[8:]), Qual: strings.Repeat("I", len(amplicon)-8)}
+
+	rec, overlap, mismatches, staggered := MergePair(r1, r2, options)
+	if rec == nil {
+		t.Fatalf("Failed to merge reads")
+	}
+	if rec.Seq != amplicon || rec.Id != "read1" || overlap != 14 || mismatches != 0 || staggered {
+		t.Errorf("Wrong merge %s %s overlap=%d mismatches=%d", rec.Id, rec.Seq, overlap, mismatches)
+	}
+
+	// Mismatch resolved using the base with higher quality
+	seq := []byte(r1.Seq)
+	seq[15] = 'A'
+	qual := []byte(r1.Qual)
+	qual[15] = '#'
+	r1.Seq = string(seq)
+	r1.Qual = string(qual)
+
+	rec, _, mismatches, _ = MergePair(r1, r2, options)
+	if rec == nil || rec.Seq != amplicon || mismatches != 1 {
+		t.Errorf("Mismatch not resolved")
+	}
+
+	// No overlap
+	r2.Seq = ReverseComplement(amplicon[20:])
+	r2.Qual = strings.Repeat("I", len(r2.Seq))
+	rec, _, _, _ = MergePair(r1, r2, options)
+	if rec != nil {
+		t.Errorf("Reads should not merge: %s", rec.Seq)
+	}
+
+	// Dovetailed pair of an amplicon shorter than the reads. Adapter
+	// overhangs are trimmed.
+	adapter := "AGATCGGAAGAGC"
+	r1 = &FastqRecord{Id: "read2", Seq: amplicon[:25] + adapter, Qual: strings.Repeat("I", 25+len(adapter))}
+	r2 = &FastqRecord{Id: "read2", Seq: ReverseComplement(amplicon[:25]) + adapter, Qual: strings.Repeat("I", 25+len(adapter))}
+	rec, overlap, _, staggered = MergePair(r1, r2, options)
+	if rec == nil || rec.Seq != amplicon[:25] || overlap != 25 || !staggered {
+		t.Errorf("Dovetailed pair not merged: %v overlap=%d staggered=%t", rec, overlap, staggered)
+	}
+
+	stats := new(MergeStats)
+	stats.Add(nil, 0, 0, false)
+	stats.Add(&FastqRecord{}, 14, 1, false)
+	stats.Add(&FastqRecord{}, 14, 0, true)
+	if stats.Pairs != 3 || stats.Merged != 2 || stats.Unmerged != 1 || stats.Staggered != 1 || stats.MeanOverlap() != 14 {
+		t.Errorf("Wrong merge stats: %s", stats)
+	}
+}
+
+func TestFastqReader(t *testing.T) {
+	data := "@r1 1:N:0\nACGT\n+\nIIII\n\n@r2\nAC\n+r2\nII\n"
+	reader := NewFastqReader(strings.NewReader(data))
+
+	ids := make([]string, 0)
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		ids = append(ids, rec.Id)
+	}
+	if strings.Join(ids, ",") != "r1 1:N:0,r2" {
+		t.Errorf("Wrong records: %v", ids)
+	}
+
+	reader = NewFastqReader(strings.NewReader("@r1\nACGT\n+\nII\n"))
+	if _, err := reader.Read(); err == nil {
+		t.Errorf("Expected error for mismatched quality length")
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type MutationType uint8
+
+const (
+	SUBSTITUTION MutationType = iota + 1
+	INSERTION
+	DELETION
+)
+
+// Maximum number of mutations stored per alignment
+const MAX_MUTATIONS = 0xffff
+
+// Mutation is a difference between the non-edit bases of a read and the
+// template. Sites are numbered as edit stop sites. Insertions are placed at
+// the site of the following template base. Deletions start at the site of
+// the first deleted base. Ref and Alt are the template and read bases, empty
+// for insertions and deletions respectively. Only the non-edit bases of an
+// insertion are recorded in Alt, edit bases inserted along with them are
+// dropped.
+type Mutation struct {
+	Site int          `json:"site"`
+	Type MutationType `json:"type"`
+	Ref  string       `json:"ref"`
+	Alt  string       `json:"alt"`
+}
+
+func (t MutationType) String() string {
+	switch t {
+	case SUBSTITUTION:
+		return "SUB"
+	case INSERTION:
+		return "INS"
+	case DELETION:
+		return "DEL"
+	}
+
+	return "UNKNOWN"
+}
+
+func (t MutationType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *MutationType) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "SUB":
+		*t = SUBSTITUTION
+	case "INS":
+		*t = INSERTION
+	case "DEL":
+		*t = DELETION
+	default:
+		return fmt.Errorf("Invalid mutation type: %s", text)
+	}
+
+	return nil
+}
+
+func (m *Mutation) String() string {
+	return fmt.Sprintf("%d %s %s>%s", m.Site, m.Type, m.Ref, m.Alt)
+}
+
+// addMutation records a mutation merging consecutive insertions at the same
+// site and consecutive deletions into a single record
+func (a *Alignment) addMutation(site int, mtype MutationType, ref, alt string) {
+	if n := len(a.Mutations); n > 0 {
+		last := a.Mutations[n-1]
+		if mtype == INSERTION && last.Type == INSERTION && last.Site == site {
+			last.Alt += alt
+			return
+		}
+		if mtype == DELETION && last.Type == DELETION && last.Site-len(last.Ref) == site {
+			last.Ref += ref
+			return
+		}
+	}
+
+	if len(a.Mutations) >= MAX_MUTATIONS {
+		return
+	}
+
+	a.Mutations = append(a.Mutations, &Mutation{Site: site, Type: mtype, Ref: ref, Alt: alt})
+}
+
+// HasMutationAt returns true if the read has a mutation covering the site
+func (a *Alignment) HasMutationAt(site int) bool {
+	for _, m := range a.Mutations {
+		if m.Site == site || (m.Type == DELETION && site < m.Site && site > m.Site-len(m.Ref)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// marshalMutations appends the mutations to buf. Each mutation is encoded as
+// site, type and the length prefixed ref and alt bases.
+func marshalMutations(buf []byte, mutations []*Mutation) []byte {
+	n := make([]byte, 4)
+	binary.BigEndian.PutUint16(n, uint16(len(mutations)))
+	buf = append(buf, n[0:2]...)
+	for _, m := range mutations {
+		writeInt64(n, m.Site)
+		buf = append(buf, n...)
+		buf = append(buf, byte(m.Type))
+		for _, s := range []string{m.Ref, m.Alt} {
+			binary.BigEndian.PutUint16(n, uint16(len(s)))
+			buf = append(buf, n[0:2]...)
+			buf = append(buf, s...)
+		}
+	}
+
+	return buf
+}
+
+// unmarshalMutations decodes the mutations in buf and returns the bytes
+// following them. Truncated records are ignored.
+func unmarshalMutations(buf []byte) ([]*Mutation, []byte) {
+	if len(buf) < 2 {
+		return nil, nil
+	}
+
+	count := int(binary.BigEndian.Uint16(buf[0:2]))
+	buf = buf[2:]
+	mutations := make([]*Mutation, 0, count)
+	for i := 0; i < count; i++ {
+		if len(buf) < 5 {
+			return mutations, nil
+		}
+		m := &Mutation{Site: readInt64(buf[0:4]), Type: MutationType(buf[4])}
+		buf = buf[5:]
+
+		seqs := make([]string, 2)
+		for j := range seqs {
+			if len(buf) < 2 {
+				return mutations, nil
+			}
+			l := int(binary.BigEndian.Uint16(buf[0:2]))
+			if len(buf) < 2+l {
+				return mutations, nil
+			}
+			seqs[j] = string(buf[2 : 2+l])
+			buf = buf[2+l:]
+		}
+		m.Ref, m.Alt = seqs[0], seqs[1]
+		mutations = append(mutations, m)
+	}
+
+	return mutations, buf
+}
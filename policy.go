@@ -0,0 +1,124 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+)
+
+// MutationPolicy controls which differences between a read and the template
+// classify an alignment as a mutant. Sites covered by template primers are
+// always ignored.
+type MutationPolicy struct {
+	// Maximum number of mismatches allowed before a read is a mutant
+	MaxMismatches int `json:"max_mismatches"`
+
+	// Ignore mismatches within this many non-edit bases of either end of the
+	// read
+	IgnoreEnds int `json:"ignore_ends"`
+
+	// Ignore mismatches where the read has an N
+	IgnoreN bool `json:"ignore_n"`
+
+	// An edit site with more or fewer edit bases than any template is a
+	// mutation. If false, indels of only the edit base are not mutations.
+	EditIndelMutant bool `json:"edit_indel_mutant"`
+
+	// Maximum number of switches between fully edited and pre-edited
+	// matches beyond the junction before a read is a likely chimera
+	MaxSwitches int `json:"max_switches"`
+
+	// Check whether reads are a recombination of two more abundant parent
+	// reads of the sample
+	ChimeraParents bool `json:"chimera_parents"`
+
+	// Minimum abundance of parent reads relative to the chimera
+	ChimeraSkew float64 `json:"chimera_skew"`
+}
+
+// DefaultMutationPolicy returns the policy used when none is given. Any
+// indel or more than 2 mismatches is a mutation. Reads switching between
+// fully edited and pre-edited matches more than twice beyond the junction are
+// likely chimeras.
+func DefaultMutationPolicy() *MutationPolicy {
+	return &MutationPolicy{
+		MaxMismatches: DEFAULT_MAX_MISMATCHES,
+		MaxSwitches:   DEFAULT_MAX_SWITCHES,
+		ChimeraSkew:   DEFAULT_CHIMERA_SKEW,
+	}
+}
+
+func (p *MutationPolicy) Validate() error {
+	if p.MaxMismatches < 0 {
+		return fmt.Errorf("Invalid max mismatches %d", p.MaxMismatches)
+	}
+	if p.IgnoreEnds < 0 {
+		return fmt.Errorf("Invalid number of end bases to ignore %d", p.IgnoreEnds)
+	}
+	if p.MaxSwitches < 0 {
+		return fmt.Errorf("Invalid max switches %d", p.MaxSwitches)
+	}
+	if p.ChimeraSkew < 1 {
+		return fmt.Errorf("Invalid chimera parent skew %.2f. Must be at least 1", p.ChimeraSkew)
+	}
+
+	return nil
+}
+
+// ignoreMismatch returns true if a mismatch at base i of the fragment is not
+// counted
+func (p *MutationPolicy) ignoreMismatch(frag *Fragment, i int) bool {
+	if p.IgnoreN && frag.Bases[i] == 'N' {
+		return true
+	}
+	if i < p.IgnoreEnds || i >= len(frag.Bases)-p.IgnoreEnds {
+		return true
+	}
+
+	return false
+}
+
+// editIndelMutant returns true if edit indels are mutations and count is
+// outside the range of edit base counts of all templates at site i
+func (p *MutationPolicy) editIndelMutant(tmpl *Template, i int, count uint32) bool {
+	if !p.EditIndelMutant {
+		return false
+	}
+
+	min, max := tmpl.EditSite[0][i], tmpl.EditSite[0][i]
+	for j := range tmpl.EditSite {
+		if tmpl.EditSite[j][i] < min {
+			min = tmpl.EditSite[j][i]
+		}
+		if tmpl.EditSite[j][i] > max {
+			max = tmpl.EditSite[j][i]
+		}
+	}
+
+	return count < min || count > max
+}
+
+func (p *MutationPolicy) String() string {
+	s := fmt.Sprintf("max mismatches %d, ignore ends %d, ignore N %t, edit indel mutant %t, max switches %d",
+		p.MaxMismatches, p.IgnoreEnds, p.IgnoreN, p.EditIndelMutant, p.MaxSwitches)
+	if p.ChimeraParents {
+		s += fmt.Sprintf(", chimera parent skew %.1f", p.ChimeraSkew)
+	}
+
+	return s
+}
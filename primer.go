@@ -0,0 +1,225 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aebruno/nwalgo"
+)
+
+// Flags set on alignments of reads lacking a template primer
+const (
+	PRIMER5_MISSING uint8 = 1 << iota
+	PRIMER3_MISSING
+)
+
+// HasPrimers returns true if the template has a 5' or 3' primer region
+func (tmpl *Template) HasPrimers() bool {
+	return tmpl.Primer5 != nil || tmpl.Primer3 != nil
+}
+
+// FindPrimer locates the primer sequence in the fully edited template and
+// returns its region. The 3' primer may be given either as the reverse
+// primer or in template orientation.
+func (tmpl *Template) FindPrimer(seq string, three bool) (*Region, error) {
+	fe := tmpl.String()
+	seq = strings.ToUpper(seq)
+
+	name := "primer5"
+	candidates := []string{seq}
+	if three {
+		name = "primer3"
+		candidates = []string{ReverseComplement(seq), seq}
+	}
+
+	for _, c := range candidates {
+		if len(c) == 0 {
+			break
+		}
+		if i := strings.Index(fe, c); i != -1 {
+			return &Region{Name: name, Start: i + 1, End: i + len(c)}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s %s not found in the fully edited template", name, seq)
+}
+
+// PrimerSeq returns the sequence of the primer region in template
+// orientation
+func (tmpl *Template) PrimerSeq(r *Region) string {
+	fe := tmpl.String()
+	if r == nil || r.Start < 1 || r.End > len(fe) || r.Start > r.End {
+		return ""
+	}
+
+	return fe[r.Start-1 : r.End]
+}
+
+// siteRange returns the range of template sites [from, to) covering the
+// positions of the region in the fully edited template
+func (tmpl *Template) siteRange(r *Region) (int, int) {
+	from, to := -1, -1
+	pos := 0
+	for i := range tmpl.EditSite[0] {
+		n := int(tmpl.EditSite[0][i])
+		if i < len(tmpl.Bases) {
+			n++
+		}
+		if n > 0 && pos+1 <= r.End && pos+n >= r.Start {
+			if from == -1 {
+				from = i
+			}
+			to = i + 1
+		}
+		pos += n
+	}
+
+	// Region extends to the 3' end so includes the last edit site
+	if to != -1 && r.End >= pos {
+		to = tmpl.Len()
+	}
+
+	return from, to
+}
+
+// coreSites returns the range of template sites [from, to) between the
+// primers
+func (tmpl *Template) coreSites() (int, int) {
+	from, to := 0, tmpl.Len()
+	if tmpl.Primer5 != nil {
+		if _, end := tmpl.siteRange(tmpl.Primer5); end != -1 {
+			from = end
+		}
+	}
+	if tmpl.Primer3 != nil {
+		if start, _ := tmpl.siteRange(tmpl.Primer3); start != -1 {
+			to = start
+		}
+	}
+	if to < from {
+		to = from
+	}
+
+	return from, to
+}
+
+// PrimerMask returns the template sites covered by a primer or outside the
+// primers. Primer derived bases are not counted as mismatches or edits.
+// Returns nil if the template has no primers.
+func (tmpl *Template) PrimerMask() []bool {
+	if !tmpl.HasPrimers() {
+		return nil
+	}
+
+	from, to := tmpl.coreSites()
+	mask := make([]bool, tmpl.Len())
+	for i := range mask {
+		mask[i] = i < from || i >= to
+	}
+
+	return mask
+}
+
+// AlignBases aligns the non-edit bases of a fragment to the template. With
+// primers the fragment is aligned to the bases between the primers only and
+// the primer bases of the template are added back as gaps in the fragment.
+// Returns the aligned template and fragment bases.
+func (tmpl *Template) AlignBases(bases string) (string, string) {
+	if !tmpl.HasPrimers() {
+		aln1, aln2, _ := nwalgo.Align(tmpl.Bases, bases, 1, -1, -1)
+		return aln1, aln2
+	}
+
+	from, to := tmpl.coreSites()
+	if to > len(tmpl.Bases) {
+		to = len(tmpl.Bases)
+	}
+	if from > to {
+		from = to
+	}
+
+	aln1, aln2, _ := nwalgo.Align(tmpl.Bases[from:to], bases, 1, -1, -1)
+	head := tmpl.Bases[:from]
+	tail := tmpl.Bases[to:]
+
+	return head + aln1 + tail, strings.Repeat("-", len(head)) + aln2 + strings.Repeat("-", len(tail))
+}
+
+// TrimPrimers removes the template primers from the ends of the fragment.
+// Primers may have up to maxMismatch mismatches and start within
+// MAX_PRIMER_OFFSET bases of the fragment ends. Returns the trimmed fragment
+// and flags for any primers not found.
+func (tmpl *Template) TrimPrimers(frag *Fragment, maxMismatch int) (*Fragment, uint8) {
+	seq := frag.String()
+	missing := uint8(0)
+	start, end := 0, len(seq)
+
+	if p := tmpl.PrimerSeq(tmpl.Primer5); len(p) > 0 {
+		if i := matchPrimer(seq, p, maxMismatch, false); i != -1 {
+			start = i + len(p)
+		} else {
+			missing |= PRIMER5_MISSING
+		}
+	}
+
+	if p := tmpl.PrimerSeq(tmpl.Primer3); len(p) > 0 {
+		if i := matchPrimer(seq, p, maxMismatch, true); i != -1 && i >= start {
+			end = i
+		} else {
+			missing |= PRIMER3_MISSING
+		}
+	}
+
+	if start == 0 && end == len(seq) {
+		return frag, missing
+	}
+
+	trimmed := NewFragmentBases(frag.Name, seq[start:end], FORWARD, frag.EditBaseSet())
+	trimmed.ReadCount = frag.ReadCount
+	trimmed.Norm = frag.Norm
+
+	return trimmed, missing
+}
+
+// matchPrimer returns the start of the primer near the 5' end of seq or, if
+// three is true, near the 3' end. Returns -1 if not found.
+func matchPrimer(seq, primer string, maxMismatch int, three bool) int {
+	for offset := 0; offset <= MAX_PRIMER_OFFSET; offset++ {
+		i := offset
+		if three {
+			i = len(seq) - len(primer) - offset
+		}
+		if i < 0 || i+len(primer) > len(seq) {
+			break
+		}
+
+		mismatches := 0
+		for j := 0; j < len(primer) && mismatches <= maxMismatch; j++ {
+			if seq[i+j] != primer[j] {
+				mismatches++
+			}
+		}
+		if mismatches <= maxMismatch {
+			return i
+		}
+	}
+
+	return -1
+}
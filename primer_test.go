@@ -0,0 +1,68 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"testing"
+)
+
+func TestAlignPrimers(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	tmpl.Primer5, err = tmpl.FindPrimer("CTAATACACTTTTGATAACA", false)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tmpl.Primer3, err = tmpl.FindPrimer("AAAAACATATCTTA", true)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fe := tmpl.String()
+	frag, missing := tmpl.TrimPrimers(NewFragment("fe", fe, FORWARD, 't'), 2)
+	if missing != 0 {
+		t.Errorf("Primers not found in fully edited read: %d", missing)
+	}
+	if frag.String() != fe[20:len(fe)-14] {
+		t.Errorf("Primers not trimmed: %s", frag.String())
+	}
+
+	aln := NewAlignment(frag, tmpl, false)
+	if aln.HasMutation != 0 || int(aln.EditStop) != tmpl.Len()-1 || int(aln.JuncEnd) != tmpl.Len()-1 {
+		t.Errorf("Trimmed fully edited read should have no mutation: %#v", aln)
+	}
+
+	// Mismatches in the primer are ignored
+	mm := "G" + fe[1:]
+	frag, missing = tmpl.TrimPrimers(NewFragment("mm", mm, FORWARD, 't'), 2)
+	if missing != 0 {
+		t.Errorf("Primer with mismatch not found: %d", missing)
+	}
+	aln = NewAlignment(frag, tmpl, false)
+	if aln.HasMutation != 0 {
+		t.Errorf("Primer mismatch counted as mutation")
+	}
+
+	_, missing = tmpl.TrimPrimers(NewFragment("short", fe[25:], FORWARD, 't'), 2)
+	if missing != PRIMER5_MISSING {
+		t.Errorf("Missing 5' primer not flagged: %d", missing)
+	}
+}
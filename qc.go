@@ -0,0 +1,163 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"sort"
+	"strings"
+)
+
+// QCReport summarizes the reads of a sample as loaded. Counts are weighted
+// by the read count of each fragment.
+type QCReport struct {
+	Reads           uint64         `json:"reads"`
+	Unique          uint64         `json:"unique"`
+	Molecules       uint64         `json:"molecules"`
+	Lengths         map[int]uint64 `json:"lengths"`
+	Mutant          uint64         `json:"mutant"`
+	Indel           uint64         `json:"indel"`
+	Mismatch        uint64         `json:"mismatch"`
+	Reverse         uint64         `json:"reverse"`
+	Primer5Missing  uint64         `json:"primer5_missing"`
+	Primer3Missing  uint64         `json:"primer3_missing"`
+	WithN           uint64         `json:"with_n"`
+	Bases           uint64         `json:"bases"`
+	NBases          uint64         `json:"n_bases"`
+	FullyEdited     uint64         `json:"fully_edited"`
+	PreEdited       uint64         `json:"pre_edited"`
+	Chimera         uint64         `json:"chimera"`
+	MismatchProfile map[int]uint64 `json:"mismatch_profile"`
+}
+
+// QCCount is the number of reads for a read length or template site
+type QCCount struct {
+	Key   int
+	Reads uint64
+}
+
+func NewQCReport() *QCReport {
+	return &QCReport{
+		Lengths:         make(map[int]uint64),
+		MismatchProfile: make(map[int]uint64),
+	}
+}
+
+// Add records a read with its sequence as loaded and its alignment to the
+// template
+func (q *QCReport) Add(seq string, a *Alignment, tmpl *Template) {
+	count := uint64(a.ReadCount)
+	q.Reads += count
+	q.Unique++
+	q.Molecules += uint64(a.MoleculeCount())
+	q.Lengths[len(seq)] += count
+	q.Bases += uint64(len(seq)) * count
+
+	if n := strings.Count(strings.ToUpper(seq), "N"); n > 0 {
+		q.WithN += count
+		q.NBases += uint64(n) * count
+	}
+
+	if a.HasMutation != 0 {
+		q.Mutant += count
+	}
+	if a.Indel != 0 {
+		q.Indel += count
+	}
+	if a.Mismatches != 0 {
+		q.Mismatch += count
+	}
+	if a.IsChimera() {
+		q.Chimera += count
+	}
+	if a.Orientation == REVERSE {
+		q.Reverse += count
+	}
+	if a.PrimerMissing&PRIMER5_MISSING != 0 {
+		q.Primer5Missing += count
+	}
+	if a.PrimerMissing&PRIMER3_MISSING != 0 {
+		q.Primer3Missing += count
+	}
+
+	if a.HasMutation == 0 && a.JuncLen == 0 {
+		if a.EditStop == tmpl.Len()-1+int(tmpl.EditOffset) {
+			q.FullyEdited += count
+		} else if a.EditStop == tmpl.EditStop {
+			q.PreEdited += count
+		}
+	}
+
+	for _, m := range a.Mutations {
+		if m.Type == SUBSTITUTION {
+			q.MismatchProfile[m.Site] += count
+		}
+	}
+}
+
+// Pct returns n as a percent of all reads
+func (q *QCReport) Pct(n uint64) float64 {
+	if q.Reads == 0 {
+		return 0
+	}
+
+	return float64(n) * 100 / float64(q.Reads)
+}
+
+// NPct returns the percent of bases which are N
+func (q *QCReport) NPct() float64 {
+	if q.Bases == 0 {
+		return 0
+	}
+
+	return float64(q.NBases) * 100 / float64(q.Bases)
+}
+
+// MeanLength returns the mean read length
+func (q *QCReport) MeanLength() float64 {
+	if q.Reads == 0 {
+		return 0
+	}
+
+	return float64(q.Bases) / float64(q.Reads)
+}
+
+func sortedCounts(m map[int]uint64, desc bool) []*QCCount {
+	counts := make([]*QCCount, 0, len(m))
+	for k, v := range m {
+		counts = append(counts, &QCCount{Key: k, Reads: v})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if desc {
+			return counts[i].Key > counts[j].Key
+		}
+		return counts[i].Key < counts[j].Key
+	})
+
+	return counts
+}
+
+// LengthDist returns the read counts by read length
+func (q *QCReport) LengthDist() []*QCCount {
+	return sortedCounts(q.Lengths, false)
+}
+
+// Profile returns the reads with a mismatch at each template site ordered
+// from the 5' end
+func (q *QCReport) Profile() []*QCCount {
+	return sortedCounts(q.MismatchProfile, true)
+}
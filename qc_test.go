@@ -0,0 +1,79 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQCReport(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fe := tmpl.String()
+	var pe bytes.Buffer
+	for i := range tmpl.EditSite[1] {
+		pe.WriteString(tmpl.EditSeq(1, i))
+		if i < len(tmpl.Bases) {
+			pe.WriteByte(tmpl.Bases[i])
+		}
+	}
+
+	reads := []struct {
+		name string
+		seq  string
+	}{
+		{"1-10", fe},
+		{"2-4", pe.String()},
+		{"3-5", strings.Replace(fe, "GCGTATGTGAT", "GCGTATCTGAT", 1)},
+		{"4-1", strings.Replace(fe, "GCGTATGTGAT", "GCGTATNTGAT", 1)},
+	}
+
+	qc := NewQCReport()
+	for _, r := range reads {
+		qc.Add(r.seq, NewAlignment(NewFragment(r.name, r.seq, FORWARD, 't'), tmpl, false), tmpl)
+	}
+
+	if qc.Reads != 20 || qc.Unique != 4 {
+		t.Errorf("Wrong read counts %d/%d != 20/4", qc.Reads, qc.Unique)
+	}
+	if qc.FullyEdited != 16 {
+		t.Errorf("Wrong fully edited count %d != 16", qc.FullyEdited)
+	}
+	if qc.PreEdited != 4 {
+		t.Errorf("Wrong pre-edited count %d != 4", qc.PreEdited)
+	}
+	if qc.Mutant != 0 || qc.Mismatch != 6 {
+		t.Errorf("Wrong mutant/mismatch counts %d/%d != 0/6", qc.Mutant, qc.Mismatch)
+	}
+	if qc.WithN != 1 || qc.NBases != 1 {
+		t.Errorf("Wrong N counts %d/%d != 1/1", qc.WithN, qc.NBases)
+	}
+	if qc.Lengths[len(fe)] != 16 {
+		t.Errorf("Wrong length distribution: %v", qc.Lengths)
+	}
+
+	profile := qc.Profile()
+	if len(profile) != 1 || profile[0].Key != 133 || profile[0].Reads != 6 {
+		t.Errorf("Wrong mismatch profile: %v", qc.MismatchProfile)
+	}
+}
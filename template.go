@@ -25,87 +25,418 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/aebruno/gofasta"
+	"github.com/aebruno/nwalgo"
 )
 
-var startPattern = regexp.MustCompile(`\s*alt_start=(\d+)\s*`)
-var endPattern = regexp.MustCompile(`\s*alt_stop=(\d+)\s*`)
+// headerPattern matches key=value annotations in template FASTA headers.
+// Values containing spaces can be quoted, e.g. name="Cruz-Reyes 2013"
+var headerPattern = regexp.MustCompile(`(\w+)=("[^"]*"|\S+)`)
+
+// seqPattern matches a nucleotide sequence given in place of a region
+var seqPattern = regexp.MustCompile(`^[ACGTUNacgtun]+$`)
+
+// Region is a named region of a template. Coordinates are inclusive.
+type Region struct {
+	Name  string
+	Start int
+	End   int
+}
 
 type AltRegion struct {
+	Name  string
 	Start int
 	End   int
 }
 
 type Template struct {
+	Gene       string
 	Bases      string
 	EditOffset uint32
 	EditStop   int
 	EditBase   rune
+	EditBases  string
 	EditSite   [][]uint32
+	SiteSeq    [][]string
 	BaseIndex  []uint32
 	AltRegion  []*AltRegion
+	Primer5    *Region
+	Primer3    *Region
+	GuideRNA   []*Region
+
+	// k-mers of the non-edit bases used to orient reads. Built once on first
+	// use as templates are also decoded from the database.
+	kmers     map[string]bool
+	kmersOnce sync.Once
+}
+
+// ParseHeader returns the key=value annotations of a template FASTA header.
+// Keys are lower cased and surrounding quotes are removed from values.
+func ParseHeader(header string) map[string][]string {
+	attrs := make(map[string][]string)
+	for _, m := range headerPattern.FindAllStringSubmatch(header, -1) {
+		key := strings.ToLower(m[1])
+		attrs[key] = append(attrs[key], strings.Trim(m[2], `"`))
+	}
+
+	return attrs
+}
+
+// parseRange parses a region of the form START-END
+func parseRange(val string) (int, int, error) {
+	parts := strings.SplitN(val, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid region %s. Must be START-END", val)
+	}
+
+	start, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid region start %s", val)
+	}
+	end, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid region end %s", val)
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("Invalid region %s. End must be greater than start", val)
+	}
+
+	return start, end, nil
 }
 
+// parseRegion parses a region of the form [NAME:]START-END
+func parseRegion(val string) (*Region, error) {
+	r := &Region{}
+	if i := strings.LastIndex(val, ":"); i != -1 {
+		r.Name = val[:i]
+		val = val[i+1:]
+	}
+
+	start, end, err := parseRange(val)
+	if err != nil {
+		return nil, err
+	}
+	r.Start = start
+	r.End = end
+
+	return r, nil
+}
+
+// templateAttrs are the gene level annotations which may be given in the
+// header of any template record
+type templateAttrs struct {
+	gene     string
+	bases    string
+	offset   int
+	primer5  *Region
+	primer3  *Region
+	primers  map[string]string
+	guideRNA []*Region
+}
+
+func (ta *templateAttrs) parse(attrs map[string][]string) error {
+	for key, vals := range attrs {
+		val := vals[len(vals)-1]
+		switch key {
+		case "gene":
+			ta.gene = val
+		case "edit_base":
+			bases, err := ParseEditBases(val)
+			if err != nil {
+				return err
+			}
+			ta.bases = bases
+		case "offset":
+			offset, err := strconv.Atoi(val)
+			if err != nil || offset < 0 {
+				return fmt.Errorf("Invalid offset %s", val)
+			}
+			ta.offset = offset
+		case "primer5", "primer3":
+			if seqPattern.MatchString(val) {
+				if ta.primers == nil {
+					ta.primers = make(map[string]string)
+				}
+				ta.primers[key] = val
+				continue
+			}
+			r, err := parseRegion(val)
+			if err != nil {
+				return fmt.Errorf("Invalid %s: %s", key, err)
+			}
+			if len(r.Name) == 0 {
+				r.Name = key
+			}
+			if key == "primer5" {
+				ta.primer5 = r
+			} else {
+				ta.primer3 = r
+			}
+		case "grna":
+			for _, v := range vals {
+				for _, g := range strings.Split(v, ",") {
+					r, err := parseRegion(g)
+					if err != nil {
+						return fmt.Errorf("Invalid grna: %s", err)
+					}
+					ta.guideRNA = append(ta.guideRNA, r)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseEditBases validates a set of edit bases such as T or TC. Returns the
+// upper cased set.
+func ParseEditBases(val string) (string, error) {
+	bases := strings.ToUpper(val)
+	if len(bases) == 0 {
+		return "", fmt.Errorf("Please provide an edit base")
+	}
+
+	for i, b := range bases {
+		if !strings.ContainsRune("ACGTU", b) {
+			return "", fmt.Errorf("Invalid edit base %s. Must be one of A, C, G, T or U", string(b))
+		}
+		if strings.IndexRune(bases, b) != i {
+			return "", fmt.Errorf("Duplicate edit base %s in %s", string(b), val)
+		}
+	}
+
+	return bases, nil
+}
+
+// NewTemplateFromFasta parses the template file at path. The first record is
+// the fully edited template, the second the pre-edited template and any
+// remaining records are alt edited templates. Headers may carry key=value
+// annotations:
+//
+//	gene=NAME          gene name
+//	edit_base=T        edit base(s), overrides base. e.g. TC
+//	offset=N           edit site numbering offset
+//	primer5=START-END  5' primer position in the fully edited sequence
+//	primer3=START-END  3' primer position in the fully edited sequence
+//	primer5=SEQ        5' primer sequence, located in the fully edited sequence
+//	primer3=SEQ        3' (reverse) primer sequence
+//	grna=NAME:START-END[,...]  guide RNA boundaries in edit sites
+//	strand=+|-         orientation of the record sequence
+//	name=NAME          name of an alt template
+//	alt_start=N alt_stop=N  edit sites of an alt editing region
 func NewTemplateFromFasta(path string, orientation OrientationType, base rune) (*Template, error) {
+	return NewTemplateFromFastaBases(path, orientation, string(base))
+}
+
+// NewTemplateFromFastaBases parses the template file at path using the set of
+// edit bases given in bases
+func NewTemplateFromFastaBases(path string, orientation OrientationType, bases string) (*Template, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid FASTA file: %s", err)
 	}
 	defer f.Close()
 
-	t := make([]*Fragment, 0, 2)
-	alt := make([]*AltRegion, 0)
+	recs := make([]*gofasta.SeqRecord, 0, 2)
+	headers := make([]map[string][]string, 0, 2)
+	ta := &templateAttrs{}
 
 	for rec := range gofasta.SimpleParser(f) {
-		frag := NewFragment(rec.Id, rec.Seq, orientation, base)
-		t = append(t, frag)
+		attrs := ParseHeader(rec.Id)
+		err := ta.parse(attrs)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template header %s: %s", rec.Id, err)
+		}
+		recs = append(recs, rec)
+		headers = append(headers, attrs)
+	}
 
-		if len(t) > 2 {
-			start, end := -1, -1
+	if len(recs) < 2 {
+		return nil, fmt.Errorf("Must provide at least 2 templates. Full and Pre edited")
+	}
 
-			matches := startPattern.FindStringSubmatch(rec.Id)
-			if len(matches) == 2 {
-				start, err = strconv.Atoi(matches[1])
-				if err != nil {
-					start = 0
-				}
+	if len(ta.bases) > 0 {
+		bases = ta.bases
+	}
+
+	t := make([]*Fragment, 0, len(recs))
+	alt := make([]*AltRegion, 0)
+
+	for i, rec := range recs {
+		attrs := headers[i]
+
+		o := orientation
+		if strand, ok := attrs["strand"]; ok {
+			switch strand[0] {
+			case "+":
+				o = FORWARD
+			case "-":
+				o = REVERSE
+			default:
+				return nil, fmt.Errorf("Invalid strand %s for template %s. Must be + or -", strand[0], rec.Id)
 			}
-			matches = endPattern.FindStringSubmatch(rec.Id)
-			if len(matches) == 2 {
-				end, err = strconv.Atoi(matches[1])
-				if err != nil {
-					end = 0
-				}
+		}
+
+		t = append(t, NewFragmentBases(rec.Id, rec.Seq, o, bases))
+
+		if i < 2 {
+			continue
+		}
+
+		_, hasStart := attrs["alt_start"]
+		_, hasEnd := attrs["alt_stop"]
+		if !hasStart || !hasEnd {
+			continue
+		}
+
+		start, end, err := parseRange(attrs["alt_start"][0] + "-" + attrs["alt_stop"][0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid alt region for template %s: %s", rec.Id, err)
+		}
+
+		region := &AltRegion{Start: start, End: end}
+		if name, ok := attrs["name"]; ok {
+			region.Name = name[0]
+		}
+		alt = append(alt, region)
+	}
+
+	tmpl, err := NewTemplate(t[0], t[1], t[2:], alt)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl.Gene = ta.gene
+	tmpl.Primer5 = ta.primer5
+	tmpl.Primer3 = ta.primer3
+	tmpl.GuideRNA = ta.guideRNA
+	for key, seq := range ta.primers {
+		r, err := tmpl.FindPrimer(seq, key == "primer3")
+		if err != nil {
+			return nil, err
+		}
+		if key == "primer5" {
+			tmpl.Primer5 = r
+		} else {
+			tmpl.Primer3 = r
+		}
+	}
+	if ta.offset > 0 {
+		tmpl.SetOffset(ta.offset)
+	}
+
+	return tmpl, nil
+}
+
+// BaseMismatch is a difference between the non-edit bases of two template
+// sequences. Positions are 1-based positions in the full sequence including
+// edit bases and are 0 if the base is missing from the sequence.
+type BaseMismatch struct {
+	APos     int
+	BPos     int
+	ABase    byte
+	BBase    byte
+	AContext string
+	BContext string
+}
+
+func (m *BaseMismatch) String() string {
+	return fmt.Sprintf("%d:%c -> %d:%c  %s / %s", m.APos, m.ABase, m.BPos, m.BBase, m.AContext, m.BContext)
+}
+
+// basePos returns the 1-based position of the i-th non-edit base of the
+// fragment in the full sequence
+func basePos(f *Fragment, i int) int {
+	pos := i + 1
+	for j := 0; j <= i; j++ {
+		pos += int(f.EditSite[j])
+	}
+
+	return pos
+}
+
+// CompareBases aligns the non-edit bases of two fragments and returns each
+// mismatching position along with the surrounding aligned bases
+func CompareBases(a, b *Fragment, context int) []*BaseMismatch {
+	mismatches := make([]*BaseMismatch, 0)
+	if a.Bases == b.Bases {
+		return mismatches
+	}
+
+	aln1, aln2, _ := nwalgo.Align(a.Bases, b.Bases, 1, -1, -1)
+
+	ai, bi := 0, 0
+	for i := 0; i < len(aln1); i++ {
+		if aln1[i] != aln2[i] {
+			from, to := i-context, i+context+1
+			if from < 0 {
+				from = 0
+			}
+			if to > len(aln1) {
+				to = len(aln1)
 			}
 
-			if start > -1 && end > -1 {
-				alt = append(alt, &AltRegion{Start: start, End: end})
+			m := &BaseMismatch{
+				ABase:    aln1[i],
+				BBase:    aln2[i],
+				AContext: aln1[from:i] + strings.ToLower(aln1[i:i+1]) + aln1[i+1:to],
+				BContext: aln2[from:i] + strings.ToLower(aln2[i:i+1]) + aln2[i+1:to],
 			}
+			if aln1[i] != '-' {
+				m.APos = basePos(a, ai)
+			}
+			if aln2[i] != '-' {
+				m.BPos = basePos(b, bi)
+			}
+			mismatches = append(mismatches, m)
 		}
-	}
 
-	if len(t) < 2 {
-		return nil, fmt.Errorf("Must provide at least 2 templates. Full and Pre edited")
+		if aln1[i] != '-' {
+			ai++
+		}
+		if aln2[i] != '-' {
+			bi++
+		}
 	}
 
-	return NewTemplate(t[0], t[1], t[2:], alt)
+	return mismatches
 }
 
 func NewTemplate(full, pre *Fragment, alt []*Fragment, altRegion []*AltRegion) (*Template, error) {
-	if full.Bases != pre.Bases || full.EditBase != pre.EditBase {
+	if full.EditBaseSet() != pre.EditBaseSet() {
+		return nil, fmt.Errorf("Invalid template sequences. Full and Pre templates must have the same edit base")
+	}
+
+	if full.Bases != pre.Bases {
+		mismatches := CompareBases(full, pre, 5)
 		logrus.WithFields(logrus.Fields{
 			"full": full,
 			"pre":  pre,
 		}).Error("Invalid template sequences")
-		return nil, fmt.Errorf("Invalid template sequences. Full and Pre templates must have the same non-edit bases")
+		for _, m := range mismatches {
+			logrus.Errorf("Full/Pre mismatch %s", m)
+		}
+		return nil, fmt.Errorf("Invalid template sequences. Full and Pre templates must have the same non-edit bases (%d mismatches)", len(mismatches))
 	}
 
 	for _, a := range alt {
-		if full.Bases != a.Bases || full.EditBase != a.EditBase {
-			return nil, fmt.Errorf("Invalid alt template sequence. All templates must have the same non-edit bases")
+		if full.EditBaseSet() != a.EditBaseSet() {
+			return nil, fmt.Errorf("Invalid alt template sequence. All templates must have the same edit base")
 		}
+		if full.Bases != a.Bases {
+			mismatches := CompareBases(full, a, 5)
+			for _, m := range mismatches {
+				logrus.Errorf("Full/Alt mismatch %s", m)
+			}
+			return nil, fmt.Errorf("Invalid alt template sequence. All templates must have the same non-edit bases (%d mismatches)", len(mismatches))
+		}
+	}
+
+	if len(alt) > MAX_ALT_TEMPLATES {
+		return nil, fmt.Errorf("Too many alt templates. At most %d are supported", MAX_ALT_TEMPLATES)
 	}
 
 	if len(alt) != len(altRegion) {
@@ -119,6 +450,16 @@ func NewTemplate(full, pre *Fragment, alt []*Fragment, altRegion []*AltRegion) (
 		editSite[i+2] = a.EditSite
 	}
 
+	var siteSeq [][]string
+	if len(full.EditBases) > 0 {
+		siteSeq = make([][]string, len(alt)+2)
+		siteSeq[0] = full.SiteSeq
+		siteSeq[1] = pre.SiteSeq
+		for i, a := range alt {
+			siteSeq[i+2] = a.SiteSeq
+		}
+	}
+
 	bi := make([]uint32, len(editSite[0]))
 
 	index := uint32(0)
@@ -134,12 +475,12 @@ func NewTemplate(full, pre *Fragment, alt []*Fragment, altRegion []*AltRegion) (
 		bi[i] = index
 	}
 
-	tmpl := &Template{Bases: full.Bases, EditBase: full.EditBase, EditSite: editSite, AltRegion: altRegion, BaseIndex: bi}
+	tmpl := &Template{Bases: full.Bases, EditBase: full.EditBase, EditBases: full.EditBases, EditSite: editSite, SiteSeq: siteSeq, AltRegion: altRegion, BaseIndex: bi}
 
 	// Compute Edit Stop Site based on full and pre-edit templates
 	tmpl.EditStop = tmpl.Len() - 1
 	for j := tmpl.EditStop; j >= 0; j-- {
-		if tmpl.EditSite[0][j] != tmpl.EditSite[1][j] {
+		if !tmpl.siteMatch(1, j, tmpl.EditSite[0][j], tmpl.EditSeq(0, j)) {
 			tmpl.EditStop = (tmpl.Len() - 1) - j
 			break
 		}
@@ -150,13 +491,16 @@ func NewTemplate(full, pre *Fragment, alt []*Fragment, altRegion []*AltRegion) (
 	return tmpl, nil
 }
 
+// SetOffset sets the edit site numbering offset. Any previous offset is
+// replaced.
 func (tmpl *Template) SetOffset(offset int) {
+	delta := offset - int(tmpl.EditOffset)
 	tmpl.EditOffset = uint32(offset)
-	tmpl.EditStop += offset
+	tmpl.EditStop += delta
 
 	for _, region := range tmpl.AltRegion {
-		region.Start -= offset
-		region.End -= offset
+		region.Start -= delta
+		region.End -= delta
 	}
 }
 
@@ -171,8 +515,8 @@ func (tmpl *Template) Len() int {
 func (tmpl *Template) String() string {
 	var buf bytes.Buffer
 
-	for i, b := range tmpl.EditSite[0] {
-		buf.WriteString(strings.Repeat(string(tmpl.EditBase), int(b)))
+	for i := range tmpl.EditSite[0] {
+		buf.WriteString(tmpl.EditSeq(0, i))
 		if i < len(tmpl.Bases) {
 			buf.WriteString(string(tmpl.Bases[i]))
 		}
@@ -181,6 +525,89 @@ func (tmpl *Template) String() string {
 	return buf.String()
 }
 
+// EditBaseSet returns the set of edit bases of the template
+func (tmpl *Template) EditBaseSet() string {
+	if len(tmpl.EditBases) > 0 {
+		return tmpl.EditBases
+	}
+
+	return string(tmpl.EditBase)
+}
+
+// EditSeq returns the edit bases at site i of the t-th template
+func (tmpl *Template) EditSeq(t, i int) string {
+	if tmpl.SiteSeq != nil {
+		return tmpl.SiteSeq[t][i]
+	}
+
+	return strings.Repeat(string(tmpl.EditBase), int(tmpl.EditSite[t][i]))
+}
+
+// siteMatch returns true if site i of the t-th template has count edit bases.
+// With multiple edit bases the edit bases in seq must also match.
+func (tmpl *Template) siteMatch(t, i int, count uint32, seq string) bool {
+	if tmpl.EditSite[t][i] != count {
+		return false
+	}
+
+	return tmpl.SiteSeq == nil || tmpl.SiteSeq[t][i] == seq
+}
+
+// MatchSite returns true if site i of the t-th template matches the edit
+// bases at site fi of the fragment
+func (tmpl *Template) MatchSite(t, i int, frag *Fragment, fi int) bool {
+	seq := ""
+	if tmpl.SiteSeq != nil {
+		seq = frag.EditSeq(fi)
+	}
+
+	return tmpl.siteMatch(t, i, frag.EditSite[fi], seq)
+}
+
+// orientScore returns the fraction of k-mers in bases found in the non-edit
+// bases of the template. Global alignment scores favor longer sequences so
+// are not comparable between orientations.
+func (tmpl *Template) orientScore(bases string) float64 {
+	k := ORIENT_KMER_SIZE
+	if len(bases) < k {
+		k = len(bases)
+	}
+	if k == 0 {
+		return 0
+	}
+
+	if k != ORIENT_KMER_SIZE {
+		return kmerScore(templateKmers(tmpl.Bases, k), bases, k)
+	}
+
+	tmpl.kmersOnce.Do(func() {
+		tmpl.kmers = templateKmers(tmpl.Bases, k)
+	})
+
+	return kmerScore(tmpl.kmers, bases, k)
+}
+
+func templateKmers(bases string, k int) map[string]bool {
+	kmers := make(map[string]bool)
+	for i := 0; i+k <= len(bases); i++ {
+		kmers[bases[i:i+k]] = true
+	}
+
+	return kmers
+}
+
+func kmerScore(kmers map[string]bool, bases string, k int) float64 {
+	found := 0
+	n := len(bases) - k + 1
+	for i := 0; i < n; i++ {
+		if kmers[bases[i:i+k]] {
+			found++
+		}
+	}
+
+	return float64(found) / float64(n)
+}
+
 func (tmpl *Template) Max(i int) uint32 {
 	max := uint32(0)
 	for j := range tmpl.EditSite {
@@ -191,10 +618,94 @@ func (tmpl *Template) Max(i int) uint32 {
 	return max
 }
 
+// AltName returns the name of the i-th alt template. Alt templates are
+// numbered from 1 and default to A1, A2, ...
+func (tmpl *Template) AltName(i int) string {
+	if i > 0 && i <= len(tmpl.AltRegion) && len(tmpl.AltRegion[i-1].Name) > 0 {
+		return tmpl.AltRegion[i-1].Name
+	}
+
+	return fmt.Sprintf("A%d", i)
+}
+
+// AltIndex returns the number of the alt template with the given name or 0
+// if not found
+func (tmpl *Template) AltIndex(name string) int {
+	for i := range tmpl.AltRegion {
+		if strings.EqualFold(tmpl.AltName(i+1), name) || strings.EqualFold(fmt.Sprintf("A%d", i+1), name) {
+			return i + 1
+		}
+	}
+
+	return 0
+}
+
 func (tmpl *Template) IndexLabel(i int) int {
 	return i + int(tmpl.EditOffset)
 }
 
+// Equal returns true if both templates have the same bases, edit sites,
+// offset and alt regions. Genes are only compared if set on both templates as
+// templates stored in older databases have no gene name.
+func (tmpl *Template) Equal(other *Template) bool {
+	if other == nil {
+		return false
+	}
+
+	if len(tmpl.Gene) > 0 && len(other.Gene) > 0 && tmpl.Gene != other.Gene {
+		return false
+	}
+
+	if tmpl.Bases != other.Bases ||
+		tmpl.EditBaseSet() != other.EditBaseSet() ||
+		tmpl.EditOffset != other.EditOffset ||
+		tmpl.EditStop != other.EditStop ||
+		len(tmpl.EditSite) != len(other.EditSite) ||
+		len(tmpl.AltRegion) != len(other.AltRegion) {
+		return false
+	}
+
+	for i := range tmpl.EditSite {
+		if len(tmpl.EditSite[i]) != len(other.EditSite[i]) {
+			return false
+		}
+		for j := range tmpl.EditSite[i] {
+			if tmpl.EditSite[i][j] != other.EditSite[i][j] || tmpl.EditSeq(i, j) != other.EditSeq(i, j) {
+				return false
+			}
+		}
+	}
+
+	for i := range tmpl.AltRegion {
+		if *tmpl.AltRegion[i] != *other.AltRegion[i] {
+			return false
+		}
+	}
+
+	if !regionEqual(tmpl.Primer5, other.Primer5) || !regionEqual(tmpl.Primer3, other.Primer3) {
+		return false
+	}
+
+	if len(tmpl.GuideRNA) != len(other.GuideRNA) {
+		return false
+	}
+	for i := range tmpl.GuideRNA {
+		if !regionEqual(tmpl.GuideRNA[i], other.GuideRNA[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func regionEqual(a, b *Region) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
 func (tmpl *Template) UnmarshalBytes(data []byte) error {
 	buf := bytes.NewReader(data)
 	dec := gob.NewDecoder(buf)
@@ -68,3 +68,127 @@ func TestTemplate(t *testing.T) {
 		t.Errorf("Alt region should match alt template length. Should throw and error")
 	}
 }
+
+func TestTemplateEqual(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	data, err := tmpl.MarshalBytes()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	other := new(Template)
+	err = other.UnmarshalBytes(data)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if !tmpl.Equal(other) {
+		t.Errorf("Template should equal its decoded copy")
+	}
+
+	// Templates stored in older databases have no gene
+	other.Gene = ""
+	tmpl.Gene = "A6"
+	if !tmpl.Equal(other) {
+		t.Errorf("Template without gene should equal template with gene")
+	}
+
+	other.Gene = "ND7"
+	if tmpl.Equal(other) {
+		t.Errorf("Templates with different genes should not be equal")
+	}
+	other.Gene = tmpl.Gene
+
+	other.SetOffset(10)
+	if tmpl.Equal(other) {
+		t.Errorf("Templates with different offsets should not be equal")
+	}
+
+	full := NewFragment("full", "ttCCAATTGCAATTT", FORWARD, 't')
+	pre := NewFragment("pre", "ttttCCAATTTTGCAATTTTT", FORWARD, 't')
+	a, _ := NewTemplate(full, pre, nil, nil)
+
+	pre = NewFragment("pre", "tttCCAATTTTGCAATTTTT", FORWARD, 't')
+	b, _ := NewTemplate(full, pre, nil, nil)
+
+	if a.Equal(b) {
+		t.Errorf("Templates with different edit sites should not be equal")
+	}
+}
+
+func TestCompareBases(t *testing.T) {
+	full := NewFragment("full", "ttCCAATTGCAATTT", FORWARD, 't')
+	pre := NewFragment("pre", "ttCCAATTGGAATTT", FORWARD, 't')
+
+	mismatches := CompareBases(full, pre, 2)
+	if len(mismatches) != 1 {
+		t.Fatalf("Wrong number of mismatches. %d != %d", len(mismatches), 1)
+	}
+
+	m := mismatches[0]
+	if m.APos != 10 || m.BPos != 10 || m.ABase != 'C' || m.BBase != 'G' {
+		t.Errorf("Wrong mismatch: %s", m)
+	}
+
+	if m.AContext != "AGcAA" || m.BContext != "AGgAA" {
+		t.Errorf("Wrong mismatch context: %s", m)
+	}
+
+	mismatches = CompareBases(full, full, 2)
+	if len(mismatches) != 0 {
+		t.Errorf("Identical sequences should not have mismatches")
+	}
+}
+
+func TestTemplateHeader(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/annotated-templates.fa", FORWARD, 'a')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	if tmpl.Gene != "RPS12" {
+		t.Errorf("Wrong gene. %s != %s", tmpl.Gene, "RPS12")
+	}
+	if tmpl.EditBase != 'T' {
+		t.Errorf("Edit base in header should override. %c != %c", tmpl.EditBase, 'T')
+	}
+	if tmpl.EditOffset != 3 {
+		t.Errorf("Wrong offset. %d != %d", tmpl.EditOffset, 3)
+	}
+	if tmpl.Primer5 == nil || tmpl.Primer5.Start != 1 || tmpl.Primer5.End != 20 {
+		t.Errorf("Wrong 5' primer region: %v", tmpl.Primer5)
+	}
+	if tmpl.Primer3 == nil || tmpl.Primer3.Start != 305 || tmpl.Primer3.End != 325 {
+		t.Errorf("Wrong 3' primer region: %v", tmpl.Primer3)
+	}
+	if len(tmpl.GuideRNA) != 2 || tmpl.GuideRNA[1].Name != "gRPS12-2" || tmpl.GuideRNA[1].Start != 61 {
+		t.Errorf("Wrong gRNA regions")
+	}
+	if tmpl.AltRegion[0].Name != "Cruz-Reyes 2013" {
+		t.Errorf("Wrong alt region name. %s != %s", tmpl.AltRegion[0].Name, "Cruz-Reyes 2013")
+	}
+
+	plain, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	plain.SetOffset(3)
+
+	if plain.EditStop != tmpl.EditStop {
+		t.Errorf("Wrong edit stop. %d != %d", tmpl.EditStop, plain.EditStop)
+	}
+	for i := range plain.AltRegion {
+		if plain.AltRegion[i].Start != tmpl.AltRegion[i].Start || plain.AltRegion[i].End != tmpl.AltRegion[i].End {
+			t.Errorf("Wrong alt region %d", i)
+		}
+	}
+
+	attrs := ParseHeader(`Alt name="A B" alt_start=1 alt_stop=2 grna=g1:1-2 grna=g2:3-4`)
+	if attrs["name"][0] != "A B" || len(attrs["grna"]) != 2 {
+		t.Errorf("Failed to parse header: %v", attrs)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// UMIOptions selects where unique molecular identifiers are found in a read.
+// Header is a regular expression matched against the read header whose first
+// capture group is the UMI. Prefix is a pattern of the bases at the start of
+// the read where N is a UMI base and X a base which is discarded, for example
+// NNNNNNNNXXXX. UMIs within MaxDistance mismatches are clustered.
+type UMIOptions struct {
+	Header      string
+	Prefix      string
+	MaxDistance int
+}
+
+// IsSet returns true if UMIs are extracted from the reads
+func (o *UMIOptions) IsSet() bool {
+	return len(o.Header) > 0 || len(o.Prefix) > 0
+}
+
+type umiGroup struct {
+	id    string
+	seq   string
+	reads uint32
+	umis  map[string]uint32
+}
+
+// UMIDedup collapses reads with the same sequence and counts the unique
+// molecules of each sequence from the UMIs of the reads
+type UMIDedup struct {
+	header  *regexp.Regexp
+	prefix  string
+	maxDist int
+	groups  map[string]*umiGroup
+	order   []*umiGroup
+
+	// Number of reads where no UMI was found
+	Missing int
+}
+
+func NewUMIDedup(options *UMIOptions) (*UMIDedup, error) {
+	d := &UMIDedup{
+		prefix:  strings.ToUpper(options.Prefix),
+		maxDist: options.MaxDistance,
+		groups:  make(map[string]*umiGroup),
+	}
+
+	if len(options.Header) > 0 && len(options.Prefix) > 0 {
+		return nil, fmt.Errorf("Please provide either a UMI header pattern or prefix, not both")
+	}
+	if options.MaxDistance < 0 {
+		return nil, fmt.Errorf("Invalid UMI max distance %d", options.MaxDistance)
+	}
+
+	if len(options.Header) > 0 {
+		re, err := regexp.Compile(options.Header)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid UMI header pattern: %s", err)
+		}
+		if re.NumSubexp() < 1 {
+			return nil, fmt.Errorf("UMI header pattern must contain a capture group: %s", options.Header)
+		}
+		d.header = re
+	}
+
+	if len(options.Prefix) > 0 {
+		if strings.Trim(d.prefix, "NX") != "" || !strings.Contains(d.prefix, "N") {
+			return nil, fmt.Errorf("Invalid UMI prefix %s. Must contain only N (UMI) and X (discarded) bases", options.Prefix)
+		}
+	}
+
+	return d, nil
+}
+
+// Extract returns the UMI of the read and the sequence with any UMI prefix
+// removed. Returns false if the UMI is not found.
+func (d *UMIDedup) Extract(id, seq string) (string, string, bool) {
+	if d.header != nil {
+		matches := d.header.FindStringSubmatch(id)
+		if len(matches) < 2 || len(matches[1]) == 0 {
+			return "", seq, false
+		}
+
+		return strings.ToUpper(matches[1]), seq, true
+	}
+
+	if len(seq) <= len(d.prefix) {
+		return "", seq, false
+	}
+
+	umi := make([]byte, 0, len(d.prefix))
+	for i := range d.prefix {
+		if d.prefix[i] == 'N' {
+			umi = append(umi, seq[i])
+		}
+	}
+
+	return strings.ToUpper(string(umi)), seq[len(d.prefix):], true
+}
+
+// Add records a read with the read count parsed from its header. Reads
+// without a UMI are counted in Missing and skipped.
+func (d *UMIDedup) Add(id, seq string, count uint32) {
+	umi, seq, ok := d.Extract(id, seq)
+	if !ok {
+		d.Missing++
+		return
+	}
+
+	key := strings.ToUpper(seq)
+	g, ok := d.groups[key]
+	if !ok {
+		g = &umiGroup{id: id, seq: seq, umis: make(map[string]uint32)}
+		d.groups[key] = g
+		d.order = append(d.order, g)
+	}
+
+	g.reads += count
+	g.umis[umi] += count
+}
+
+// Each calls fn with each unique sequence in the order first seen, the id of
+// the first read, the raw read count and the number of unique molecules
+func (d *UMIDedup) Each(fn func(id, seq string, reads, molecules uint32) error) error {
+	for _, g := range d.order {
+		err := fn(g.id, g.seq, g.reads, uint32(ClusterUMIs(g.umis, d.maxDist)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// umiDistance returns the number of mismatches between two UMIs of the same
+// length or -1 if the lengths differ
+func umiDistance(a, b string) int {
+	if len(a) != len(b) {
+		return -1
+	}
+
+	dist := 0
+	for i := range a {
+		if a[i] != b[i] {
+			dist++
+		}
+	}
+
+	return dist
+}
+
+// ClusterUMIs returns the number of molecules given the read count of each
+// UMI. Following the directional method of UMI-tools, a UMI absorbs UMIs
+// within maxDist mismatches having at most half its read count, which are
+// likely PCR or sequencing errors. UMIs with a read count of 0 are counted as
+// a single read.
+func ClusterUMIs(umis map[string]uint32, maxDist int) int {
+	counts := make(map[string]uint64, len(umis))
+	keys := make([]string, 0, len(umis))
+	for u, n := range umis {
+		if n == 0 {
+			n = 1
+		}
+		counts[u] = uint64(n)
+		keys = append(keys, u)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	if maxDist == 0 {
+		return len(keys)
+	}
+
+	assigned := make(map[string]bool, len(keys))
+	clusters := 0
+	for _, u := range keys {
+		if assigned[u] {
+			continue
+		}
+		clusters++
+		assigned[u] = true
+
+		queue := []string{u}
+		for len(queue) > 0 {
+			cur := queue[0]
+			queue = queue[1:]
+			for _, v := range keys {
+				if assigned[v] {
+					continue
+				}
+				dist := umiDistance(cur, v)
+				if dist < 0 || dist > maxDist || counts[cur] < 2*counts[v]-1 {
+					continue
+				}
+				assigned[v] = true
+				queue = append(queue, v)
+			}
+		}
+	}
+
+	return clusters
+}
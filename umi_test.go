@@ -0,0 +1,101 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"testing"
+)
+
+func TestClusterUMIs(t *testing.T) {
+	tests := []struct {
+		name    string
+		umis    map[string]uint32
+		maxDist int
+		count   int
+	}{
+		{"distinct", map[string]uint32{"AAAA": 10, "CCCC": 10, "GGGG": 1}, 1, 3},
+		{"error", map[string]uint32{"AAAA": 10, "AAAT": 2}, 1, 1},
+		{"similar abundance", map[string]uint32{"AAAA": 10, "AAAT": 8}, 1, 2},
+		{"chain", map[string]uint32{"AAAA": 20, "AAAT": 5, "AATT": 2}, 1, 1},
+		{"exact", map[string]uint32{"AAAA": 10, "AAAT": 2}, 0, 2},
+		{"length", map[string]uint32{"AAAA": 10, "AAA": 1}, 1, 2},
+		{"zero count", map[string]uint32{"AAAA": 3, "AAAT": 0}, 1, 1},
+	}
+
+	for _, test := range tests {
+		if n := ClusterUMIs(test.umis, test.maxDist); n != test.count {
+			t.Errorf("%s: wrong molecule count %d != %d", test.name, n, test.count)
+		}
+	}
+}
+
+func TestUMIDedup(t *testing.T) {
+	dedup, err := NewUMIDedup(&UMIOptions{Prefix: "NNNNXX", MaxDistance: 1})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	reads := []struct {
+		id  string
+		seq string
+	}{
+		{"1-3", "AAAAGGCTGGTTTCA"},
+		{"2", "AAATGGCTGGTTTCA"},
+		{"3", "CCCCGGCTGGTTTCA"},
+		{"4", "GGGGTTCTAATACAC"},
+		{"5", "GGG"},
+	}
+	for _, r := range reads {
+		dedup.Add(r.id, r.seq, parseMergeCount(r.id))
+	}
+
+	if dedup.Missing != 1 {
+		t.Errorf("Wrong number of reads without UMI %d != 1", dedup.Missing)
+	}
+
+	type result struct {
+		id               string
+		reads, molecules uint32
+	}
+	got := make(map[string]result)
+	dedup.Each(func(id, seq string, reads, molecules uint32) error {
+		got[seq] = result{id, reads, molecules}
+		return nil
+	})
+
+	if r := got["CTGGTTTCA"]; r.id != "1-3" || r.reads != 5 || r.molecules != 2 {
+		t.Errorf("Wrong deduplication: %#v", r)
+	}
+	if r := got["CTAATACAC"]; r.reads != 1 || r.molecules != 1 {
+		t.Errorf("Wrong deduplication: %#v", r)
+	}
+
+	dedup, err = NewUMIDedup(&UMIOptions{Header: `umi=([ACGTN]+)`})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if umi, seq, ok := dedup.Extract("read1 umi=ACGTAC", "CTGG"); !ok || umi != "ACGTAC" || seq != "CTGG" {
+		t.Errorf("Wrong UMI from header: %s %s", umi, seq)
+	}
+
+	for _, opts := range []*UMIOptions{{Prefix: "NNAB"}, {Header: "umi"}, {Header: "(x)", Prefix: "NN"}} {
+		if _, err := NewUMIDedup(opts); err == nil {
+			t.Errorf("Invalid UMI options accepted: %#v", opts)
+		}
+	}
+}
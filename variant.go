@@ -0,0 +1,178 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"sort"
+	"strings"
+)
+
+// Variant is a mutation summed across reads weighted by read count
+type Variant struct {
+	Mutation
+	Pos         int               `json:"pos"`
+	Reads       uint64            `json:"reads"`
+	Frequency   float64           `json:"frequency"`
+	Homopolymer bool              `json:"homopolymer"`
+	Samples     map[string]uint64 `json:"samples"`
+}
+
+// VariantReport collects the mutations of reads by template position
+type VariantReport struct {
+	Total    uint64
+	tmpl     *Template
+	fe       string
+	variants map[string]*Variant
+}
+
+func NewVariantReport(tmpl *Template) *VariantReport {
+	return &VariantReport{tmpl: tmpl, fe: tmpl.String(), variants: make(map[string]*Variant)}
+}
+
+// baseIndex returns the template base index of the site
+func (r *VariantReport) baseIndex(site int) int {
+	return len(r.tmpl.Bases) - (site - int(r.tmpl.EditOffset))
+}
+
+// fullPos returns the 0-based position of template base ti in the fully
+// edited template
+func (r *VariantReport) fullPos(ti int) int {
+	pos := ti
+	for i := 0; i <= ti && i < len(r.tmpl.EditSite[0]); i++ {
+		pos += int(r.tmpl.EditSite[0][i])
+	}
+
+	return pos
+}
+
+// Add counts the mutations of the alignment for the sample
+func (r *VariantReport) Add(sample string, a *Alignment) {
+	count := uint64(a.ReadCount)
+	r.Total += count
+
+	for _, m := range a.Mutations {
+		k := m.String()
+		v, ok := r.variants[k]
+		if !ok {
+			v = &Variant{Mutation: *m, Samples: make(map[string]uint64)}
+			ti := r.baseIndex(m.Site)
+			if ti >= 0 && ti <= len(r.tmpl.Bases) {
+				if ti < len(r.tmpl.Bases) {
+					v.Pos = r.fullPos(ti) + 1
+				} else {
+					v.Pos = len(r.fe) + 1
+				}
+				v.Homopolymer = r.homopolymer(v)
+			}
+			r.variants[k] = v
+		}
+		v.Reads += count
+		v.Samples[sample] += count
+	}
+}
+
+// homopolymer returns true if the variant is an indel of a single base
+// within a run of at least MIN_HOMOPOLYMER of that base in the fully edited
+// template. These are likely sequencing errors.
+func (r *VariantReport) homopolymer(v *Variant) bool {
+	indel := v.Ref + v.Alt
+	if v.Type == SUBSTITUTION || len(indel) == 0 || strings.Count(indel, indel[:1]) != len(indel) {
+		return false
+	}
+	b := indel[0]
+
+	// Run of the base touching the position of the indel
+	start := v.Pos - 1
+	if v.Type == INSERTION {
+		start--
+	}
+	run := 0
+	for i := start; i >= 0 && i < len(r.fe) && r.fe[i] == b; i-- {
+		run++
+	}
+	for i := start + 1; i >= 0 && i < len(r.fe) && r.fe[i] == b; i++ {
+		run++
+	}
+
+	return run >= MIN_HOMOPOLYMER
+}
+
+// Variants returns the variants sorted by position with frequencies relative
+// to the total read count
+func (r *VariantReport) Variants() []*Variant {
+	variants := make([]*Variant, 0, len(r.variants))
+	for _, v := range r.variants {
+		if r.Total > 0 {
+			v.Frequency = float64(v.Reads) / float64(r.Total)
+		}
+		variants = append(variants, v)
+	}
+
+	sort.Slice(variants, func(i, j int) bool {
+		if variants[i].Pos != variants[j].Pos {
+			return variants[i].Pos < variants[j].Pos
+		}
+		return variants[i].String() < variants[j].String()
+	})
+
+	return variants
+}
+
+// VCF returns the 1-based position and the ref and alt alleles of the
+// variant in the fully edited template. Indels include the preceding base
+// or, at the start of the template, the following base. Edit bases between
+// deleted bases are kept in the alt allele.
+func (r *VariantReport) VCF(v *Variant) (int, string, string) {
+	fe := r.fe
+	start := v.Pos - 1
+
+	switch v.Type {
+	case INSERTION:
+		if start == 0 {
+			return 1, fe[:1], v.Alt + fe[:1]
+		}
+		return start, fe[start-1 : start], fe[start-1:start] + v.Alt
+	case DELETION:
+		ti := r.baseIndex(v.Site)
+		deleted := make(map[int]bool)
+		end := start
+		for j := 0; j < len(v.Ref) && ti+j < len(r.tmpl.Bases); j++ {
+			end = r.fullPos(ti + j)
+			deleted[end] = true
+		}
+
+		from, to := start-1, end+1
+		if start == 0 {
+			from, to = start, end+2
+			if to > len(fe) {
+				to = len(fe)
+			}
+		}
+
+		alt := make([]byte, 0, to-from)
+		for i := from; i < to; i++ {
+			if !deleted[i] {
+				alt = append(alt, fe[i])
+			}
+		}
+
+		return from + 1, fe[from:to], string(alt)
+	}
+
+	return v.Pos, v.Ref, v.Alt
+}
@@ -0,0 +1,75 @@
+// Copyright 2015 TREAT Authors. All rights reserved.
+//
+// This file is part of TREAT.
+//
+// TREAT is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// TREAT is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with TREAT.  If not, see <http://www.gnu.org/licenses/>.
+
+package treat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVariantReport(t *testing.T) {
+	tmpl, err := NewTemplateFromFasta("examples/templates.fa", FORWARD, 't')
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	fe := tmpl.String()
+	i := strings.Index(fe, "AAA")
+	reads := []struct {
+		name string
+		seq  string
+	}{
+		{"1-10", fe},
+		{"2-5", strings.Replace(fe, "GCGTATGTGAT", "GCGTATCTGAT", 1)},
+		{"3-3", strings.Replace(fe, "GCGTATGTGAT", "GCGTATTGAT", 1)},
+		{"4-2", fe[:i] + fe[i+1:]},
+	}
+
+	report := NewVariantReport(tmpl)
+	for _, r := range reads {
+		report.Add("test", NewAlignment(NewFragment(r.name, r.seq, FORWARD, 't'), tmpl, false))
+	}
+
+	if report.Total != 20 {
+		t.Errorf("Wrong total reads %d != 20", report.Total)
+	}
+
+	variants := report.Variants()
+	if len(variants) != 3 {
+		t.Fatalf("Wrong number of variants %d != 3", len(variants))
+	}
+
+	hp := variants[0]
+	if hp.Type != DELETION || hp.Reads != 2 || !hp.Homopolymer {
+		t.Errorf("Homopolymer deletion not flagged: %#v", hp)
+	}
+
+	sub := variants[1]
+	if sub.Type != SUBSTITUTION || sub.Reads != 5 || sub.Frequency != 0.25 || sub.Homopolymer {
+		t.Errorf("Wrong substitution: %#v", sub)
+	}
+	if pos, ref, alt := report.VCF(sub); fe[pos-1:pos] != ref || ref != "G" || alt != "C" {
+		t.Errorf("Wrong VCF substitution %d %s %s", pos, ref, alt)
+	}
+
+	del := variants[2]
+	pos, ref, alt := report.VCF(del)
+	if fe[pos-1:pos-1+len(ref)] != ref || len(ref) != len(alt)+1 || del.Homopolymer {
+		t.Errorf("Wrong VCF deletion %d %s %s", pos, ref, alt)
+	}
+}